@@ -6,34 +6,22 @@ import (
 	"hash/fnv"
 	"math"
 	"os"
+	"project/structures/Errors"
 	"time"
 )
 
 const DEFAULT_FALSE_POSITIVE_RATE = 0.05
 
-var FALSE_POSITIVE_RATE float64
-
 type BloomFilter struct {
 	M, K          uint     // Size of bloom filter and number of hash functions
 	HashFunctions []uint32 // array of hashes
 	Data          []byte   // Data array
 }
 
-func SetDefaultParam() {
-	FALSE_POSITIVE_RATE = DEFAULT_FALSE_POSITIVE_RATE
-}
-
-func Panic(err error) {
-	if err != nil {
-		panic(err.Error())
-	}
-}
-
 func hash(s string) uint32 {
 	// Hashes string to an unsigned 32 bit integer
 	h := fnv.New32a()
-	_, err := h.Write([]byte(s))
-	Panic(err)
+	h.Write([]byte(s)) // Writing to a hash never returns an error
 	return h.Sum32()
 }
 
@@ -63,8 +51,7 @@ func CreateHashFunctions(k uint) []uint32 {
 		hashed.Reset()
 		b := make([]byte, 8)
 		binary.LittleEndian.PutUint32(b, ts+uint32(i))
-		_, err := hashed.Write(b)
-		Panic(err)
+		hashed.Write(b)
 		h = append(h, hashed.Sum32())
 	}
 	return h
@@ -107,19 +94,25 @@ func (bf *BloomFilter) Contains(key string) bool {
 
 }
 
-func ReadBloomFilter(path string) *BloomFilter {
+func ReadBloomFilter(path string) (*BloomFilter, error) {
 	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
-	Panic(err)
+	if err != nil {
+		return nil, Errors.IO("open", path, err)
+	}
 	defer file.Close()
 	decoder := gob.NewDecoder(file)
 	var bf = new(BloomFilter)
-	file.Seek(0, 0)
 	err = decoder.Decode(bf)
-	Panic(err)
-	return bf
+	if err != nil {
+		return nil, Errors.Corrupted(path, 0, "bloom filter can't be decoded: "+err.Error())
+	}
+	if bf.M == 0 || uint(len(bf.Data)) != bf.M || uint(len(bf.HashFunctions)) != bf.K {
+		return nil, Errors.Corrupted(path, 0, "bloom filter sizes don't match")
+	}
+	return bf, nil
 }
 
-func WriteBloomFilter(bf *BloomFilter, path string, createdFile *os.File) bool {
+func WriteBloomFilter(bf *BloomFilter, path string, createdFile *os.File) error {
 	// Function that either takes a reference to an already created file or a path where the file
 	// will be opened/created
 	var file *os.File
@@ -127,20 +120,16 @@ func WriteBloomFilter(bf *BloomFilter, path string, createdFile *os.File) bool {
 
 	if path == "" {
 		file = createdFile
+		path = createdFile.Name()
 	} else {
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			// If selected file does not exist a new file is created
-			file, err = os.Create(path)
-			Panic(err)
-		} else {
-			// If it exists it is opened
-			file, err = os.OpenFile(path, os.O_WRONLY, 0700)
-			Panic(err)
+		// If selected file does not exist a new file is created, if it exists it is truncated
+		file, err = os.Create(path)
+		if err != nil {
+			return Errors.IO("create", path, err)
 		}
+		defer file.Close()
 	}
-	defer file.Close()
 	encoder := gob.NewEncoder(file)
 	err = encoder.Encode(bf)
-	Panic(err)
-	return true
+	return Errors.IO("write", path, err)
 }
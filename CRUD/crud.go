@@ -1,14 +1,13 @@
 package CRUD
 
 import (
-	"project/structures/LSM"
+	"encoding/hex"
+	"errors"
+	"project/structures/DB"
+	"project/structures/Iterator"
 	"project/structures/ReadPath"
-	"project/structures/SSTable"
-	"project/structures/WritePath"
-	"project/structures/lru"
 	"project/structures/memtable"
-	wal "project/structures/mmap"
-	"time"
+	"strings"
 )
 
 /* CRUD takes in which function will be performed
@@ -16,51 +15,96 @@ import (
 "r" = read
 "u" = update
 "d" = delete
+"x" = delete range
+"p" = prefix scan
+"s" = compare and swap
+"a" = put if absent
+"i" = increment
 */
 
-func Create(mem *memtable.SkipList, cache *lru.Cache, key string, value []byte) {
-	WritePath.WritePath(mem, cache, key, value)
+var ErrInvalidToken = errors.New("invalid continuation token")
+
+func Create(db *DB.DB, key string, value []byte) error {
+	return db.Put(key, value)
 }
 
-func Read(mem *memtable.SkipList, cache *lru.Cache, key string) *ReadPath.ElementInfo {
-	element := ReadPath.ReadPath(mem, cache, key)
-	return element
+// Read : Returns the element stored under the key, Errors.ErrNotFound if the key was never written
+func Read(db *DB.DB, key string) (*ReadPath.ElementInfo, error) {
+	return db.Lookup(key)
 }
 
-func Update(mem *memtable.SkipList, cache *lru.Cache, key string, value []byte) {
-	WritePath.WritePath(mem, cache, key, value)
+// MultiRead : Returns the values of the keys in the same order, nil for a key that doesn't exist or was deleted
+// errs[i] holds the error the read of keys[i] failed with
+func MultiRead(db *DB.DB, keys []string) ([][]byte, []error, error) {
+	return db.MultiGet(keys)
 }
 
-func Delete(mem *memtable.SkipList, cache *lru.Cache, key string) bool {
+func Update(db *DB.DB, key string, value []byte) error {
+	return db.Put(key, value)
+}
 
-	if WritePath.SegmentElements > wal.SEGMENT_SIZE {	// Wal segment at capacity - new segment is created
-		WritePath.CreateLogFile()
-		WritePath.SegmentElements = 0
-	}
-	err := wal.Add(key, []byte(""), WritePath.WalSegmentName, true)
-	if err == nil { 		// Commit log confirmed entry
-		WritePath.SegmentElements += 1
-		_, found := cache.Find(key)
-		if found {
-			cache.Update(key, []byte(""), uint64(time.Now().Unix()), true)
-		}
-		// If key exists in memtable, tombstone is put to true
-		deleted := mem.Delete(key)
-		// If key doesn't exist in memtable it is first added than deleted
-		if !deleted {
-			a := mem.Insert(key, []byte(""), time.Now().Unix())
-			mem.Delete(key)
-			if a != nil {			// Memtable up to capacity, flush to disk
-				SSTable.Flush(a)
-				mem.NewSkipList()		// Reset memtable
-				wal.DeleteWal()
-			}
+func Delete(db *DB.DB, key string) error {
+	return db.Delete(key)
+}
+
+// DeleteRange : Deletes every key in [start, end) at once, an empty end deletes everything from start on
+func DeleteRange(db *DB.DB, start, end string) error {
+	return db.DeleteRange(start, end)
+}
+
+// PrefixScan : Returns at most limit elements whose keys start with the prefix, in sorted order
+// The scan starts from the beginning when the token is empty, otherwise from where the previous page stopped
+// The returned token continues the scan on the next call, it is empty when there are no more keys
+func PrefixScan(db *DB.DB, prefix string, limit int, token string) ([]*memtable.Pair, string, error) {
+	start := prefix
+	if token != "" {
+		decoded, err := hex.DecodeString(token)
+		if err != nil || !strings.HasPrefix(string(decoded), prefix) {
+			return nil, "", ErrInvalidToken
 		}
-		return true
+		start = string(decoded)
+	}
+	it, err := db.NewIterator(start, Iterator.PrefixEnd(prefix))
+	if err != nil {
+		return nil, "", err
+	}
+	defer it.Close()
+
+	list := []*memtable.Pair{}
+	for ; it.Valid() && len(list) < limit; it.Next() {
+		list = append(list, &memtable.Pair{Key: it.Key(), Value: it.Value()})
 	}
-	return false
+	if it.Err() != nil {
+		return nil, "", it.Err()
+	}
+	nextToken := ""
+	if it.Valid() {
+		// The next page starts with the first key that didn't fit in to this one
+		nextToken = hex.EncodeToString([]byte(it.Key()))
+	}
+	return list, nextToken, nil
+}
+
+// CompareAndSwap : Writes the value only if the key holds the expected value, returns whether it was written
+func CompareAndSwap(db *DB.DB, key string, expected, value []byte) (bool, error) {
+	return db.CompareAndSwap(key, expected, value)
+}
+
+// PutIfAbsent : Writes the value only if the key doesn't exist, returns whether it was written
+func PutIfAbsent(db *DB.DB, key string, value []byte) (bool, error) {
+	return db.PutIfAbsent(key, value)
+}
+
+// Increment : Adds delta to the integer stored under the key and returns the new value
+func Increment(db *DB.DB, key string, delta int64) (int64, error) {
+	return db.Increment(key, delta)
+}
+
+// Merge : Writes the operand that the merge operator of the database applies on top of the value of the key
+func Merge(db *DB.DB, key string, operand []byte) error {
+	return db.Merge(key, operand)
 }
 
-func Compact() {
-	LSM.Compactions()
+func Compact(db *DB.DB) error {
+	return db.Compact()
 }
@@ -9,8 +9,13 @@ import (
 type Configuration struct {
 
 	WalSegmentSize uint64				`json:"WalSegmentSize"`	// Number of appends per segment
+	WalSegmentBytes uint64				`json:"WalSegmentBytes"`	// Size of a segment in bytes, 0 for no limit
+	WalSyncMode string					`json:"WalSyncMode"`	// "always", "interval" or "none"
+	WalSyncInterval int64				`json:"WalSyncInterval"`	// Milliseconds between two syncs in the interval mode
+	WalSkipCorrupted bool				`json:"WalSkipCorrupted"`	// Skip the broken log records when the log is loaded
 
 	MemtableCapacity uint64				`json:"MemtableCapacity"`
+	MemtableBytes uint64				`json:"MemtableBytes"`	// Memory of a memtable in bytes, 0 for no limit
 
 	MemtableMaxHeight int				`json:"MemtableMaxHeight"`
 
@@ -20,9 +25,34 @@ type Configuration struct {
 
 	LSMMaxLevel int						`json:"LSMMaxLevel"`
 
+	CompactionStrategy string			`json:"CompactionStrategy"`	// "leveled", "size-tiered" or "pairwise"
+
+	LSMLevel1Tables int					`json:"LSMLevel1Tables"`	// Number of tables on Level1 that triggers its compaction
+	LSMLevelBaseBytes int64				`json:"LSMLevelBaseBytes"`	// Target size of Level2 in bytes
+	LSMLevelFanOut int					`json:"LSMLevelFanOut"`	// Each level below Level2 is this many times bigger
+	LSMTierThreshold int				`json:"LSMTierThreshold"`	// Number of tables of similar size merged together
+	LSMLevel1StopTables int				`json:"LSMLevel1StopTables"`	// Writes wait while Level1 holds this many tables
+	LSMTargetFileSize int64				`json:"LSMTargetFileSize"`	// Size of the SSTables written by the compactions
+
 	MaxRequestPerInterval int			`json:"MaxRequestPerInterval"`
 	Interval int64						`json:"Interval"`
 
+	ColumnFamilies map[string]ColumnFamilyConfig	`json:"ColumnFamilies"`	// Named column families besides the default one
+
+}
+
+// ColumnFamilyConfig : Parameters of one column family, the ones left out are taken from the rest of the configuration
+type ColumnFamilyConfig struct {
+
+	MemtableCapacity uint64				`json:"MemtableCapacity"`
+	MemtableBytes uint64				`json:"MemtableBytes"`
+
+	MemtableMaxHeight int				`json:"MemtableMaxHeight"`
+
+	BloomFalsePositiveRate float64 		`json:"BloomFalsePositiveRate"`
+
+	LSMMaxLevel int						`json:"LSMMaxLevel"`
+
 }
 
 func LoadConfig() *Configuration {
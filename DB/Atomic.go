@@ -0,0 +1,76 @@
+package DB
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"project/structures/Errors"
+	"strconv"
+)
+
+var ErrNotANumber = errors.New("value is not an integer")
+var ErrOverflow = errors.New("result doesn't fit in a 64-bit integer")
+
+// CompareAndSwap : Writes the new value only if the key currently holds the expected value
+// Returns false if the key doesn't exist or holds a different value
+func (db *DB) CompareAndSwap(key string, expected, value []byte) (bool, error) {
+	swapped := false
+	err := db.update(func() error {
+		current, err := db.def.get(key)
+		if errors.Is(err, Errors.ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, expected) {
+			return nil
+		}
+		swapped = true
+		return db.def.put(key, value)
+	})
+	return swapped, err
+}
+
+// PutIfAbsent : Writes the value only if the key doesn't exist, deleted and expired keys count as absent
+// Returns false if the key already exists
+func (db *DB) PutIfAbsent(key string, value []byte) (bool, error) {
+	written := false
+	err := db.update(func() error {
+		_, err := db.def.get(key)
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, Errors.ErrNotFound) {
+			return err
+		}
+		written = true
+		return db.def.put(key, value)
+	})
+	return written, err
+}
+
+// Increment : Adds delta to the integer stored under the key as decimal text and returns the new value
+// A missing key counts as 0, ErrNotANumber is returned if the value isn't an integer
+// ErrOverflow is returned and nothing is written if the sum doesn't fit in an int64
+func (db *DB) Increment(key string, delta int64) (int64, error) {
+	var number int64 = 0
+	err := db.update(func() error {
+		current, err := db.def.get(key)
+		if err == nil {
+			number, err = strconv.ParseInt(string(current), 10, 64)
+			if err != nil {
+				return ErrNotANumber
+			}
+		} else if !errors.Is(err, Errors.ErrNotFound) {
+			return err
+		}
+		if (delta > 0 && number > math.MaxInt64-delta) || (delta < 0 && number < math.MinInt64-delta) {
+			return ErrOverflow
+		}
+		number += delta
+		return db.def.put(key, []byte(strconv.FormatInt(number, 10)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return number, nil
+}
@@ -0,0 +1,31 @@
+package DB
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestIncrementOverflow(t *testing.T) {
+	db := openTest(t, DefaultOptions())
+	for _, limit := range []int64{math.MaxInt64, math.MinInt64} {
+		key := strconv.FormatInt(limit, 10)
+		db.Put(key, []byte(key))
+		delta := int64(1)
+		if limit < 0 {
+			delta = -1
+		}
+		number, err := db.Increment(key, delta)
+		if !errors.Is(err, ErrOverflow) {
+			t.Fatalf("increment of %s by %d returned %d (%v), expected an overflow", key, delta, number, err)
+		}
+		value, err := db.Get(key)
+		expectValue(t, key, value, err, key)
+		// The other way it fits
+		number, err = db.Increment(key, -delta)
+		if err != nil || number != limit-delta {
+			t.Fatalf("increment of %s by %d returned %d (%v)", key, -delta, number, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package DB
+
+import (
+	"project/structures/WritePath"
+	"sync"
+)
+
+// DEFAULT_LEVEL1_STOP_TABLES : Number of tables on Level1 of a family at which the writes wait for the compactions
+const DEFAULT_LEVEL1_STOP_TABLES = 12
+
+// Background work
+// A full memtable is made immutable by the write that filled it, the flush worker writes it to the disk later and
+// wakes the compaction worker, which runs the compactions the strategies pick until they have nothing left to merge
+// The workers pick what to flush or merge with the lock held and release it while the SSTables are written, the lock is
+// taken again to install the new tables (see LSM.Locker), reads and writes go on in the meantime
+// One flush and one compaction run at a time, Compact waits for the ones the workers are running
+
+// startBackground : Starts the flush worker and the compaction worker, they stop when the database is closed
+func (db *DB) startBackground() {
+	db.work = sync.NewCond(&db.mu)
+	db.room = sync.NewCond(&db.mu)
+	// From now on the trees are only used with the lock held
+	for _, family := range db.families {
+		family.Tree.Locker = &db.mu
+	}
+	// The SSTables left by the last run might need a compaction already
+	db.compacting = true
+	db.updateStall()
+	db.workers.Add(2)
+	go db.flushWorker()
+	go db.compactionWorker()
+}
+
+// flushWorker : Writes the immutable memtables to the disk, the ones left when the database is closed are flushed first
+func (db *DB) flushWorker() {
+	defer db.workers.Done()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for {
+		if db.bgErr == nil && db.families.Flushing() {
+			if !db.flushing {
+				db.flushOnce()
+				continue
+			}
+		} else if db.closed {
+			return
+		}
+		db.work.Wait()
+	}
+}
+
+// flushOnce : Flushes the oldest immutable memtables and wakes the compaction worker
+// The memtable stays readable until its SSTable is live, no other flush may be running
+func (db *DB) flushOnce() error {
+	db.flushing = true
+	_, err := WritePath.FlushImmutable(db.log, db.families)
+	db.flushing = false
+	db.work.Broadcast()
+	if err != nil {
+		db.fail(err)
+		return err
+	}
+	db.compacting = true
+	db.updateStall()
+	return nil
+}
+
+// flushAll : Flushes every immutable memtable, waits for the flush the worker is running
+func (db *DB) flushAll() error {
+	for db.bgErr == nil && db.families.Flushing() {
+		if db.closed {
+			return ErrClosed
+		}
+		if db.flushing {
+			db.work.Wait()
+			continue
+		}
+		err := db.flushOnce()
+		if err != nil {
+			return err
+		}
+	}
+	return db.bgErr
+}
+
+// compactionWorker : Runs one compaction at a time while the strategies have something to merge
+func (db *DB) compactionWorker() {
+	defer db.workers.Done()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for !db.closed {
+		if db.bgErr == nil && db.compacting && !db.merging {
+			done, err := db.compactOnce(db.ColumnFamilies())
+			if err != nil {
+				db.fail(err)
+			}
+			db.compacting = done && err == nil
+			db.updateStall()
+			continue
+		}
+		db.work.Wait()
+	}
+}
+
+// compactOnce : Runs one compaction in the first of the families whose strategy has something to merge
+// No other compaction may be running
+func (db *DB) compactOnce(names []string) (bool, error) {
+	db.merging = true
+	defer func() {
+		db.merging = false
+		db.work.Broadcast()
+	}()
+	for _, name := range names {
+		done, err := db.families[name].Tree.CompactOnce()
+		if err != nil || done {
+			return done, err
+		}
+	}
+	return false, nil
+}
+
+// compactAll : Runs the compactions of the families until their strategies have nothing left to merge, waits for the
+// compaction the worker is running
+func (db *DB) compactAll(names []string) error {
+	for {
+		for db.merging && !db.closed {
+			db.work.Wait()
+		}
+		if db.closed {
+			return ErrClosed
+		}
+		done, err := db.compactOnce(names)
+		if err != nil || !done {
+			return err
+		}
+	}
+}
+
+// fail : Stops the background work, the writes fail with the error from now on
+func (db *DB) fail(err error) {
+	db.bgErr = err
+	db.compacting = false
+	db.updateStall()
+}
+
+// updateStall : Writes wait while Level1 of a family holds LSMLevel1StopTables tables, as long as the compactions
+// might still shrink it
+func (db *DB) updateStall() {
+	stalled := false
+	if db.compacting && db.opts.LSMLevel1StopTables > 0 {
+		for _, family := range db.families {
+			if family.Tree.TableCount(1) >= db.opts.LSMLevel1StopTables {
+				stalled = true
+			}
+		}
+	}
+	db.stalled = stalled
+	if !stalled {
+		db.room.Broadcast()
+	}
+}
+
+// admit : Waits until the writes may go on, has to be called with the lock held before a write reads anything
+// ErrClosed is returned if the database got closed, or the error that stopped the background work
+func (db *DB) admit() error {
+	for db.stalled && !db.closed && db.bgErr == nil {
+		db.room.Wait()
+	}
+	if db.closed {
+		return ErrClosed
+	}
+	return db.bgErr
+}
+
+// wake : Wakes the flush worker if the write made the memtables immutable, has to be called with the lock held
+func (db *DB) wake() {
+	if db.families.Flushing() {
+		db.work.Broadcast()
+	}
+}
@@ -0,0 +1,126 @@
+package DB
+
+import (
+	"fmt"
+	wal "project/structures/mmap"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// releaseHook : Lock of a tree that runs released every time the tree lets go of it
+type releaseHook struct {
+	sync.Locker
+	released func()
+	running  sync.WaitGroup // Calls of released that didn't return yet
+}
+
+func (h *releaseHook) Unlock() {
+	h.running.Add(1)
+	defer h.running.Done()
+	h.Locker.Unlock()
+	h.released()
+}
+
+func TestBackgroundWorkReleasesTheLock(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemtableCapacity = 2
+	opts.LSMLevel1Tables = 2
+	db := openTest(t, opts)
+	db.Put("k", []byte("v"))
+	var releases int32
+	var mu sync.Mutex
+	var written []string
+	// The reads and the writes would wait for the flush or the compaction forever if the lock was still held
+	hook := &releaseHook{Locker: &db.mu}
+	hook.released = func() {
+		value, err := db.Get("k")
+		if err != nil || string(value) != "v" {
+			t.Errorf("k is %q (%v) while the lock is released", value, err)
+		}
+		key := fmt.Sprint("during", atomic.AddInt32(&releases, 1))
+		err = db.Put(key, []byte("v"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		written = append(written, key)
+		mu.Unlock()
+	}
+	db.mu.Lock()
+	db.def.family.Tree.Locker = hook
+	db.mu.Unlock()
+	for i := 0; i < 8; i++ {
+		db.Put(fmt.Sprint("key", i), []byte("v"))
+	}
+	err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mu.Lock()
+	db.def.family.Tree.Locker = &db.mu
+	db.mu.Unlock()
+	hook.running.Wait()
+
+	if releases < 2 {
+		t.Fatalf("the lock was released %d times, expected it for the flushes and the compactions", releases)
+	}
+	for _, key := range written {
+		value, err := db.Get(key)
+		expectValue(t, key, value, err, "v")
+	}
+}
+
+func TestWritesDuringBackgroundWork(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemtableCapacity = 8
+	opts.WalSegmentSize = 16
+	opts.LSMLevel1Tables = 2
+	opts.LSMLevel1StopTables = 4
+	opts.LSMTargetFileSize = 256
+	opts.WalSyncMode = wal.SYNC_NONE
+	db := openTest(t, opts)
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("w%d-%03d", w, i)
+				err := db.Put(key, []byte(key))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				value, err := db.Get(key)
+				if err != nil || string(value) != key {
+					t.Errorf("%s is %q (%v) right after it was written", key, value, err)
+					return
+				}
+			}
+		}(w)
+	}
+	// Compact runs along with the workers
+	for i := 0; i < 5; i++ {
+		err := db.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writers.Wait()
+
+	check := func(db *DB, when string) {
+		t.Helper()
+		for w := 0; w < 4; w++ {
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("w%d-%03d", w, i)
+				value, err := db.Get(key)
+				expectValue(t, key+" "+when, value, err, key)
+			}
+		}
+	}
+	check(db, "after the writes")
+	db = reopen(t, db)
+	check(db, "after the reopen")
+}
@@ -0,0 +1,161 @@
+package DB
+
+import (
+	"project/structures/Errors"
+	"project/structures/Iterator"
+	"project/structures/MergeOperator"
+	"project/structures/ReadPath"
+	"project/structures/WritePath"
+	"time"
+)
+
+// ColumnFamily : Handle of one column family, the same key in different families holds different values
+// Sequence numbers and the log are shared, a WriteBatch can write to several families atomically
+type ColumnFamily struct {
+	db     *DB
+	family *WritePath.Family
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.family.Name
+}
+
+// Lookup : Returns all the information stored about the key, including deleted elements
+func (cf *ColumnFamily) Lookup(key string) (*ReadPath.ElementInfo, error) {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.db.closed {
+		return nil, ErrClosed
+	}
+	return cf.lookup(key)
+}
+
+// lookup : Has to be called with the lock held
+func (cf *ColumnFamily) lookup(key string) (*ReadPath.ElementInfo, error) {
+	return ReadPath.ReadPath(cf.family.Tree, cf.family.Memtables(), cf.family.Cache, key)
+}
+
+// get : Value of the key read through the read path, has to be called with the lock held
+func (cf *ColumnFamily) get(key string) ([]byte, error) {
+	element, err := cf.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if element.Tombstone {
+		return nil, Errors.ErrNotFound
+	}
+	return element.Value, nil
+}
+
+// Get : Returns the value of the key, Errors.ErrNotFound if the key doesn't exist or was deleted
+func (cf *ColumnFamily) Get(key string) ([]byte, error) {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.db.closed {
+		return nil, ErrClosed
+	}
+	return cf.get(key)
+}
+
+// MultiGet : Returns the values of the keys in the same order, nil for a key that doesn't exist or was deleted
+// Every SSTable is read once for the whole batch instead of once per key
+// errs[i] holds the error the read of keys[i] failed with, the error of the call is set only if nothing was read
+func (cf *ColumnFamily) MultiGet(keys []string) ([][]byte, []error, error) {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.db.closed {
+		return nil, nil, ErrClosed
+	}
+	elements, errs := ReadPath.MultiGet(cf.family.Tree, cf.family.Memtables(), cf.family.Cache, keys)
+	values := make([][]byte, len(keys))
+	for i, element := range elements {
+		if element != nil && !element.Tombstone {
+			values[i] = element.Value
+		}
+	}
+	return values, errs, nil
+}
+
+// NewIterator : Iterates over the keys of the family in [start, end) in sorted order
+// The iterator has to be closed when it is no longer needed
+func (cf *ColumnFamily) NewIterator(start, end string) (*Iterator.Iterator, error) {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.db.closed {
+		return nil, ErrClosed
+	}
+	tables, err := cf.family.Tree.Tables()
+	if err != nil {
+		return nil, err
+	}
+	return Iterator.NewIterator(cf.family.Memtables(), tables, cf.db.opts.MergeOperator, start, end)
+}
+
+func (cf *ColumnFamily) Put(key string, value []byte) error {
+	return cf.db.update(func() error {
+		return cf.put(key, value)
+	})
+}
+
+// put : Has to be called with the lock held
+func (cf *ColumnFamily) put(key string, value []byte) error {
+	cf.db.seq++
+	return WritePath.WritePath(cf.db.log, cf.db.families, cf.family, key, value, cf.db.seq, 0)
+}
+
+// PutWithTTL : Writes the value that is treated as absent once the ttl passes, the expiry is kept with a precision of a second
+func (cf *ColumnFamily) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return cf.db.update(func() error {
+		cf.db.seq++
+		expiry := time.Now().Add(ttl).Unix()
+		return WritePath.WritePath(cf.db.log, cf.db.families, cf.family, key, value, cf.db.seq, expiry)
+	})
+}
+
+func (cf *ColumnFamily) Delete(key string) error {
+	return cf.db.update(func() error {
+		cf.db.seq++
+		return WritePath.DeletePath(cf.db.log, cf.db.families, cf.family, key, cf.db.seq)
+	})
+}
+
+// DeleteRange : Deletes every key of the family in [start, end), an empty end means there is no upper bound
+// ErrInvalidRange is returned if the range is empty
+func (cf *ColumnFamily) DeleteRange(start, end string) error {
+	if end != "" && start >= end {
+		return ErrInvalidRange
+	}
+	return cf.db.update(func() error {
+		cf.db.seq++
+		return WritePath.DeleteRangePath(cf.db.log, cf.db.families, cf.family, start, end, cf.db.seq)
+	})
+}
+
+// Merge : Writes the operand that the merge operator of the options applies on top of the current value of the key
+func (cf *ColumnFamily) Merge(key string, operand []byte) error {
+	if cf.db.opts.MergeOperator == nil {
+		return MergeOperator.ErrNoMergeOperator
+	}
+	return cf.db.update(func() error {
+		cf.db.seq++
+		return WritePath.MergePath(cf.db.log, cf.db.families, cf.family, cf.db.opts.MergeOperator, key, operand, cf.db.seq)
+	})
+}
+
+// Compact : Flushes the immutable memtables and runs the compactions of the family only
+func (cf *ColumnFamily) Compact() error {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.db.closed {
+		return ErrClosed
+	}
+	defer cf.db.updateStall()
+	err := cf.db.flushAll()
+	if err != nil {
+		return err
+	}
+	return cf.db.compactAll([]string{cf.family.Name})
+}
@@ -0,0 +1,546 @@
+package DB
+
+import (
+	"errors"
+	"fmt"
+	bloom_filter "project/structures/Bloom_Filter"
+	"project/structures/Configuration"
+	"project/structures/Initialization"
+	"project/structures/Iterator"
+	"project/structures/LSM"
+	"project/structures/MergeOperator"
+	"project/structures/ReadPath"
+	"project/structures/TokenBucket"
+	"project/structures/WritePath"
+	"project/structures/lru"
+	"project/structures/memtable"
+	wal "project/structures/mmap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("database is closed")
+var ErrInvalidTTL = errors.New("ttl has to be positive")
+var ErrInvalidColumnFamily = errors.New("invalid column family name")
+var ErrUnknownColumnFamily = wal.ErrUnknownFamily
+var ErrInvalidRange = errors.New("start of the range has to be before its end")
+
+// DEFAULT_COLUMN_FAMILY : Column family used by the methods of DB that don't take one
+const DEFAULT_COLUMN_FAMILY = wal.DEFAULT_FAMILY
+
+// WriteBatch : Puts and deletes that are written together, see Write
+type WriteBatch = wal.WriteBatch
+
+func NewWriteBatch() *WriteBatch {
+	return wal.NewWriteBatch()
+}
+
+// Options : Parameters of one database, the same values that can be set in the configuration file
+// Open takes the parameters left at zero from DefaultOptions, except for the ones where zero turns a limit off
+type Options struct {
+	WalSegmentSize         uint64 // Number of appends per segment
+	WalSegmentBytes        uint64 // Size a segment may reach, 0 if only the number of appends counts
+	WalSyncMode            string // wal.SYNC_ALWAYS, wal.SYNC_INTERVAL or wal.SYNC_NONE, always if empty
+	WalSyncInterval        int64  // Milliseconds between two syncs of the log in the interval mode
+	WalSkipCorrupted       bool   // Open skips the broken log records instead of failing with ErrCorrupted
+	MemtableCapacity       uint64
+	MemtableBytes          uint64 // Memory a memtable may take, 0 if only the number of elements counts
+	MemtableMaxHeight      int
+	BloomFalsePositiveRate float64
+	LRUCapacity            int
+	LSMMaxLevel            int
+	CompactionStrategy     string // LSM.LEVELED, LSM.SIZE_TIERED or LSM.PAIRWISE, leveled if empty
+	LSMLevel1Tables        int    // Number of tables on Level1 that triggers its compaction (leveled)
+	LSMLevelBaseBytes      int64  // Target size of Level2, every level below is LSMLevelFanOut times bigger (leveled)
+	LSMLevelFanOut         int
+	LSMTierThreshold       int   // Number of tables of similar size that are merged together (size-tiered)
+	LSMLevel1StopTables    int   // Writes wait while Level1 of a family holds this many tables and compactions can shrink it, 0 if they never wait
+	LSMTargetFileSize      int64 // Compactions start a new SSTable once the Data file reaches this size
+	MaxRequestPerInterval  int
+	Interval               int64
+	MergeOperator          MergeOperator.MergeOperator // Folds the operands written by Merge, set by the application
+	// Named column families besides the default one, an entry named DEFAULT_COLUMN_FAMILY configures the default one
+	ColumnFamilies map[string]ColumnFamilyOptions
+}
+
+// ColumnFamilyOptions : Parameters of one column family, the ones left at zero are taken from the Options of the database
+type ColumnFamilyOptions struct {
+	MemtableCapacity       uint64
+	MemtableBytes          uint64
+	MemtableMaxHeight      int
+	BloomFalsePositiveRate float64
+	LSMMaxLevel            int
+}
+
+// family : Options of the column family with the missing parameters filled in from the database options
+func (opts Options) family(name string) ColumnFamilyOptions {
+	fo := opts.ColumnFamilies[name]
+	if fo.MemtableCapacity == 0 {
+		fo.MemtableCapacity = opts.MemtableCapacity
+	}
+	if fo.MemtableBytes == 0 {
+		fo.MemtableBytes = opts.MemtableBytes
+	}
+	if fo.MemtableMaxHeight <= 0 {
+		fo.MemtableMaxHeight = opts.MemtableMaxHeight
+	}
+	if fo.BloomFalsePositiveRate <= 0 {
+		fo.BloomFalsePositiveRate = opts.BloomFalsePositiveRate
+	}
+	if fo.LSMMaxLevel <= 0 {
+		fo.LSMMaxLevel = opts.LSMMaxLevel
+	}
+	return fo
+}
+
+// withDefaults : Options with the parameters left at zero, or below it, replaced by their DefaultOptions values
+// MemtableBytes, WalSegmentBytes and LSMLevel1StopTables stay at zero, it turns their limit off
+func (opts Options) withDefaults() Options {
+	def := DefaultOptions()
+	if opts.WalSegmentSize == 0 {
+		opts.WalSegmentSize = def.WalSegmentSize
+	}
+	if opts.WalSyncMode == "" {
+		opts.WalSyncMode = def.WalSyncMode
+	}
+	if opts.WalSyncInterval <= 0 {
+		opts.WalSyncInterval = def.WalSyncInterval
+	}
+	if opts.MemtableCapacity == 0 {
+		opts.MemtableCapacity = def.MemtableCapacity
+	}
+	if opts.MemtableMaxHeight <= 0 {
+		opts.MemtableMaxHeight = def.MemtableMaxHeight
+	}
+	if opts.BloomFalsePositiveRate <= 0 {
+		opts.BloomFalsePositiveRate = def.BloomFalsePositiveRate
+	}
+	if opts.LRUCapacity <= 0 {
+		opts.LRUCapacity = def.LRUCapacity
+	}
+	if opts.LSMMaxLevel <= 0 {
+		opts.LSMMaxLevel = def.LSMMaxLevel
+	}
+	if opts.CompactionStrategy == "" {
+		opts.CompactionStrategy = def.CompactionStrategy
+	}
+	if opts.LSMLevel1Tables <= 0 {
+		opts.LSMLevel1Tables = def.LSMLevel1Tables
+	}
+	if opts.LSMLevelBaseBytes <= 0 {
+		opts.LSMLevelBaseBytes = def.LSMLevelBaseBytes
+	}
+	if opts.LSMLevelFanOut <= 0 {
+		opts.LSMLevelFanOut = def.LSMLevelFanOut
+	}
+	if opts.LSMTierThreshold <= 0 {
+		opts.LSMTierThreshold = def.LSMTierThreshold
+	}
+	if opts.LSMTargetFileSize <= 0 {
+		opts.LSMTargetFileSize = def.LSMTargetFileSize
+	}
+	if opts.MaxRequestPerInterval <= 0 {
+		opts.MaxRequestPerInterval = def.MaxRequestPerInterval
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = def.Interval
+	}
+	return opts
+}
+
+// strategy : Compaction strategy of a tree, every tree gets its own since a strategy can keep state between compactions
+func (opts Options) strategy() (LSM.CompactionStrategy, error) {
+	name := opts.CompactionStrategy
+	if name == "" {
+		name = LSM.LEVELED
+	}
+	return LSM.NewStrategy(name, LSM.StrategyOptions{
+		Level1Tables:   opts.LSMLevel1Tables,
+		LevelBaseBytes: opts.LSMLevelBaseBytes,
+		LevelFanOut:    opts.LSMLevelFanOut,
+		TierThreshold:  opts.LSMTierThreshold,
+	})
+}
+
+// familyNames : Names of all the column families, the default one included
+func (opts Options) familyNames() []string {
+	names := []string{DEFAULT_COLUMN_FAMILY}
+	for name := range opts.ColumnFamilies {
+		if name != DEFAULT_COLUMN_FAMILY {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// validFamilyName : The name of a column family is the name of its directory
+func validFamilyName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+func DefaultOptions() Options {
+	return Options{
+		WalSegmentSize:         wal.DEFAULT_SEGMENT_SIZE,
+		WalSegmentBytes:        wal.DEFAULT_SEGMENT_BYTES,
+		WalSyncMode:            wal.SYNC_ALWAYS,
+		WalSyncInterval:        wal.DEFAULT_SYNC_INTERVAL,
+		MemtableCapacity:       memtable.DEFAULT_CAPACITY,
+		MemtableBytes:          memtable.DEFAULT_CAPACITY_BYTES,
+		MemtableMaxHeight:      memtable.DEFAULT_MAX_HEIGHT,
+		BloomFalsePositiveRate: bloom_filter.DEFAULT_FALSE_POSITIVE_RATE,
+		LRUCapacity:            lru.DEFAULT_CAPACITY,
+		LSMMaxLevel:            LSM.DEFAULT_MAX_LEVEL,
+		LSMLevel1Tables:        LSM.DEFAULT_LEVEL1_TABLES,
+		LSMLevelBaseBytes:      LSM.DEFAULT_LEVEL_BASE_BYTES,
+		LSMLevelFanOut:         LSM.DEFAULT_LEVEL_FAN_OUT,
+		CompactionStrategy:     LSM.LEVELED,
+		LSMTierThreshold:       LSM.DEFAULT_TIER_THRESHOLD,
+		LSMLevel1StopTables:    DEFAULT_LEVEL1_STOP_TABLES,
+		LSMTargetFileSize:      LSM.DEFAULT_TARGET_FILE_SIZE,
+		MaxRequestPerInterval:  TokenBucket.DEFAULT_MAX_REQUEST,
+		Interval:               TokenBucket.DEFAULT_INTERVAL,
+	}
+}
+
+// OptionsFromConfig : Extracts the options from the configuration file, DefaultOptions if there is none
+// The parameters the file leaves out stay at zero, Open takes them from DefaultOptions
+func OptionsFromConfig(config *Configuration.Configuration) Options {
+	if config == nil {
+		return DefaultOptions()
+	}
+	families := make(map[string]ColumnFamilyOptions, len(config.ColumnFamilies))
+	for name, family := range config.ColumnFamilies {
+		families[name] = ColumnFamilyOptions{
+			MemtableCapacity:       family.MemtableCapacity,
+			MemtableBytes:          family.MemtableBytes,
+			MemtableMaxHeight:      family.MemtableMaxHeight,
+			BloomFalsePositiveRate: family.BloomFalsePositiveRate,
+			LSMMaxLevel:            family.LSMMaxLevel,
+		}
+	}
+	return Options{
+		WalSegmentSize:         config.WalSegmentSize,
+		WalSegmentBytes:        config.WalSegmentBytes,
+		WalSyncMode:            config.WalSyncMode,
+		WalSyncInterval:        config.WalSyncInterval,
+		WalSkipCorrupted:       config.WalSkipCorrupted,
+		MemtableCapacity:       config.MemtableCapacity,
+		MemtableBytes:          config.MemtableBytes,
+		MemtableMaxHeight:      config.MemtableMaxHeight,
+		BloomFalsePositiveRate: config.BloomFalsePositiveRate,
+		LRUCapacity:            config.LRUCapacity,
+		LSMMaxLevel:            config.LSMMaxLevel,
+		LSMLevel1Tables:        config.LSMLevel1Tables,
+		LSMLevelBaseBytes:      config.LSMLevelBaseBytes,
+		LSMLevelFanOut:         config.LSMLevelFanOut,
+		CompactionStrategy:     config.CompactionStrategy,
+		LSMTierThreshold:       config.LSMTierThreshold,
+		LSMLevel1StopTables:    config.LSMLevel1StopTables,
+		LSMTargetFileSize:      config.LSMTargetFileSize,
+		MaxRequestPerInterval:  config.MaxRequestPerInterval,
+		Interval:               config.Interval,
+		ColumnFamilies:         families,
+	}
+}
+
+// DB : One independent store, all the structures in memory and the files on the disk belong to the instance
+// Several databases can be opened in the same process as long as their directories differ
+// Keys are kept in column families, each with its own memtable, cache and SSTables, and one log shared by all of them
+type DB struct {
+	mu       sync.Mutex
+	dir      string
+	opts     Options
+	log      *wal.Wal
+	families WritePath.Families
+	def      *ColumnFamily // Family used by the methods of DB and transactions, and by snapshot reads that don't name one
+	tb       *TokenBucket.TokenBucket
+	seq      uint64 // Sequence number of the last write
+	closed   bool
+	// Snapshots that are not released yet, see Snapshot.go
+	snapshots map[*Snapshot]bool
+	// Background work, see Background.go
+	work       *sync.Cond // Wakes the workers, used with mu
+	room       *sync.Cond // Wakes the writes waiting for Level1 to shrink, used with mu
+	workers    sync.WaitGroup
+	compacting bool  // The strategies might have something to merge
+	flushing   bool  // A flush is running, it releases the lock while it writes the SSTable
+	merging    bool  // A compaction is running, it releases the lock while it merges the SSTables
+	stalled    bool  // Writes wait until the compactions shrink Level1
+	bgErr      error // Error that stopped the background work, writes fail with it
+}
+
+// Open : Opens the database stored in dir, the directories are created if they don't exist
+// The SSTables of each column family are kept in their own directory, Data/SSTable/<family>/LevelN
+// Data left in the log segments is loaded back in to the memtables
+func Open(dir string, opts Options) (*DB, error) {
+	opts = opts.withDefaults()
+	names := opts.familyNames()
+	levels := make(map[string]int, len(names))
+	for _, name := range names {
+		if !validFamilyName(name) {
+			return nil, fmt.Errorf("%w %q", ErrInvalidColumnFamily, name)
+		}
+		levels[name] = opts.family(name).LSMMaxLevel
+	}
+	err := Initialization.CreateDataFiles(dir, levels)
+	if err != nil {
+		return nil, err
+	}
+	db := DB{dir: dir, opts: opts, families: WritePath.Families{}, snapshots: make(map[*Snapshot]bool)}
+	for _, name := range names {
+		fo := opts.family(name)
+		family := WritePath.Family{Name: name}
+		family.Mem = memtable.NewMemtable(fo.MemtableMaxHeight, fo.MemtableCapacity, fo.MemtableBytes)
+		family.Cache = lru.NewCache(opts.LRUCapacity)
+		family.Tree = LSM.NewLSM(Initialization.FamilyDir(dir, name), fo.LSMMaxLevel, fo.BloomFalsePositiveRate)
+		family.Tree.MergeOperator = opts.MergeOperator
+		family.Tree.TargetFileSize = opts.LSMTargetFileSize
+		family.Tree.Strategy, err = opts.strategy()
+		if err != nil {
+			db.closeTrees()
+			return nil, err
+		}
+		db.families[name] = &family
+		// Only the tables the manifest lists are live, the ones left behind by an unfinished merge are removed
+		err = family.Tree.Load()
+		if err != nil {
+			db.closeTrees()
+			return nil, err
+		}
+	}
+	db.def = &ColumnFamily{db: &db, family: db.families[DEFAULT_COLUMN_FAMILY]}
+	db.tb = TokenBucket.NewTokenBucket(opts.MaxRequestPerInterval, opts.Interval)
+	db.tb.LastReset = time.Now().Unix()
+	db.tb.AvailableReq = db.tb.MaxReq
+
+	// Snapshots don't outlive the process, the SSTables kept for them aren't needed anymore
+	for _, family := range db.families {
+		err = family.Tree.RemoveRetired()
+		if err != nil {
+			db.closeTrees()
+			return nil, err
+		}
+	}
+	// Scanning wal directory
+	interval := time.Duration(opts.WalSyncInterval) * time.Millisecond
+	db.log, err = wal.NewWal(Initialization.WalDir(dir), opts.WalSegmentSize, opts.WalSyncMode, interval)
+	if err != nil {
+		db.closeTrees()
+		return nil, err
+	}
+	db.log.SegmentBytes = opts.WalSegmentBytes
+	db.log.MergeOperator = opts.MergeOperator
+	db.log.SkipCorrupted = opts.WalSkipCorrupted
+	db.log.Flushed = make(map[string]uint64, len(db.families))
+	for name, family := range db.families {
+		db.log.Flushed[name] = family.Tree.Flushed()
+	}
+	walSequence, ranges, err := db.log.ScanWal(db.families.Memtables(), func() error {
+		return WritePath.FlushMemtables(db.families)
+	})
+	if err != nil {
+		db.log.Close()
+		db.closeTrees()
+		return nil, err
+	}
+	// The segments holding the records loaded back stay until the memtables are flushed
+	for name, logRange := range ranges {
+		db.families[name].Log = logRange
+	}
+	// Sequence numbers are shared by the families, they continue from the biggest one found in the log or in the SSTables
+	db.seq = walSequence
+	for _, family := range db.families {
+		last, err := family.Tree.LastSequence()
+		if err != nil {
+			db.log.Close()
+			db.closeTrees()
+			return nil, err
+		}
+		if last > db.seq {
+			db.seq = last
+		}
+	}
+	db.startBackground()
+	return &db, nil
+}
+
+func (db *DB) Dir() string {
+	return db.dir
+}
+
+// SkippedRecords : Broken log records that Open skipped since WalSkipCorrupted was set, each one is an ErrCorrupted
+// naming the segment and the offset of the record
+func (db *DB) SkippedRecords() []error {
+	return db.log.Skipped
+}
+
+// ColumnFamily : Handle of the column family, ErrUnknownColumnFamily is returned if it wasn't given in the Options
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	family, found := db.families[name]
+	if !found {
+		return nil, fmt.Errorf("%w %q", ErrUnknownColumnFamily, name)
+	}
+	return &ColumnFamily{db: db, family: family}, nil
+}
+
+// ColumnFamilies : Names of all the column families in sorted order, the default one included
+func (db *DB) ColumnFamilies() []string {
+	names := make([]string, 0, len(db.families))
+	for name := range db.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup : Returns all the information stored about the key, including deleted elements
+func (db *DB) Lookup(key string) (*ReadPath.ElementInfo, error) {
+	return db.def.Lookup(key)
+}
+
+// Get : Returns the value of the key, Errors.ErrNotFound if the key doesn't exist or was deleted
+func (db *DB) Get(key string) ([]byte, error) {
+	return db.def.Get(key)
+}
+
+// MultiGet : Returns the values of the keys in the same order, nil for a key that doesn't exist or was deleted
+// errs[i] holds the error the read of keys[i] failed with, see ColumnFamily.MultiGet
+func (db *DB) MultiGet(keys []string) ([][]byte, []error, error) {
+	return db.def.MultiGet(keys)
+}
+
+// NewIterator : Iterates over the keys in [start, end) in sorted order, an empty end means there is no upper bound
+// The iterator has to be closed when it is no longer needed
+func (db *DB) NewIterator(start, end string) (*Iterator.Iterator, error) {
+	return db.def.NewIterator(start, end)
+}
+
+func (db *DB) Put(key string, value []byte) error {
+	return db.def.Put(key, value)
+}
+
+// PutWithTTL : Writes the value that is treated as absent once the ttl passes, the expiry is kept with a precision of a second
+func (db *DB) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	return db.def.PutWithTTL(key, value, ttl)
+}
+
+func (db *DB) Delete(key string) error {
+	return db.def.Delete(key)
+}
+
+// DeleteRange : Deletes every key in [start, end) with a single range tombstone, an empty end means there is no upper bound
+func (db *DB) DeleteRange(start, end string) error {
+	return db.def.DeleteRange(start, end)
+}
+
+// Merge : Writes the operand that the merge operator of the options applies on top of the current value of the key
+// Operands are kept as they are until a read or a compaction folds them, the operator has to be associative
+func (db *DB) Merge(key string, operand []byte) error {
+	return db.def.Merge(key, operand)
+}
+
+// Write : Applies all the operations of the batch atomically, after a crash either all of them are recovered or none
+// The operations can belong to different column families (see WriteBatch.PutCF), they share the log
+func (db *DB) Write(batch *WriteBatch) error {
+	return db.update(func() error {
+		return db.write(batch)
+	})
+}
+
+// update : Runs the write with the lock held, then waits until its log records are synced as the sync mode asks
+// The wait happens without the lock, the writes that come in the meantime share the same sync of the log
+func (db *DB) update(write func() error) error {
+	db.mu.Lock()
+	if err := db.admit(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	err := write()
+	db.wake()
+	position := db.log.Position()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.log.Sync(position)
+}
+
+// write : Has to be called with the lock held
+func (db *DB) write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	err := WritePath.WriteBatch(db.log, db.families, batch, db.seq+1)
+	db.seq += uint64(batch.Len())
+	return err
+}
+
+// Compact : Flushes the immutable memtables and runs the compactions of every column family
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	defer db.updateStall()
+	// The immutable memtables take part in the compactions as well
+	err := db.flushAll()
+	if err != nil {
+		return err
+	}
+	return db.compactAll(db.ColumnFamilies())
+}
+
+// Allow : Token bucket check, returns false when there were too many requests in the current interval
+func (db *DB) Allow() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.tb.Allow(time.Now().Unix())
+}
+
+// Close : Stops the background work once the immutable memtables are flushed and the running compaction is done
+// Every write is already in the log, the memtables are loaded back from it on the next Open
+// The error that stopped the background work, if any, is returned
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	db.closed = true
+	db.work.Broadcast()
+	db.room.Broadcast()
+	db.mu.Unlock()
+	db.workers.Wait()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// A call of Compact might still be writing its SSTables
+	for db.flushing || db.merging {
+		db.work.Wait()
+	}
+	// The writes still waiting for their records to be synced are released by the last sync
+	logErr := db.log.Close()
+	err := db.closeTrees()
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	if logErr != nil {
+		return logErr
+	}
+	return err
+}
+
+// closeTrees : Closes the manifests of all the families, the first error is returned
+func (db *DB) closeTrees() error {
+	var first error
+	for _, family := range db.families {
+		err := family.Tree.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
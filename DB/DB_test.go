@@ -0,0 +1,240 @@
+package DB
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"project/structures/Configuration"
+	"project/structures/Initialization"
+	"project/structures/LSM"
+	"project/structures/MergeOperator"
+	wal "project/structures/mmap"
+	"testing"
+)
+
+// reopen : Closes the database and opens it again from its directory with the same options
+func reopen(t *testing.T, db *DB) *DB {
+	t.Helper()
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(db.dir, db.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// crashCopy : Copy of the directory of the open database, as a crash would leave it once the synced writes are on the disk
+func crashCopy(t *testing.T, db *DB) string {
+	t.Helper()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	dir := t.TempDir()
+	err := filepath.Walk(db.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, path[len(db.dir):])
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		source, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		copied, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer copied.Close()
+		_, err = io.Copy(copied, source)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestReopenAfterCrash(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WalSegmentSize = 3
+	opts.MemtableCapacity = 10
+	opts.ColumnFamilies = map[string]ColumnFamilyOptions{"rare": {MemtableCapacity: 1000}}
+	db := openTest(t, opts)
+	rare, _ := db.ColumnFamily("rare")
+	db.Put("k0", []byte("v"))
+	rare.Put("r", []byte("x"))
+	for i := 1; i < 95; i++ {
+		db.Put(fmt.Sprint("k", i), []byte("v"))
+	}
+	err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB, when string) {
+		t.Helper()
+		for i := 0; i < 95; i++ {
+			value, err := db.Get(fmt.Sprint("k", i))
+			expectValue(t, fmt.Sprint("k", i, " ", when), value, err, "v")
+		}
+		rare, _ := db.ColumnFamily("rare")
+		value, err := rare.Get("r")
+		expectValue(t, "r "+when, value, err, "x")
+	}
+
+	crashed, err := Open(crashCopy(t, db), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crashed.Close()
+	check(crashed, "after the crash")
+	// The segments whose records are all flushed are removed
+	segments, _ := ioutil.ReadDir(Initialization.WalDir(db.dir))
+	if len(segments) > 4 {
+		t.Fatalf("%d segments were left after the flushes", len(segments))
+	}
+	db = reopen(t, db)
+	check(db, "after the reopen")
+}
+
+func TestOpenWithZeroOptions(t *testing.T) {
+	noCache := DefaultOptions()
+	noCache.LRUCapacity = 0
+	for _, opts := range []Options{{}, noCache, OptionsFromConfig(&Configuration.Configuration{})} {
+		db := openTest(t, opts)
+		if db.opts.WalSegmentSize != wal.DEFAULT_SEGMENT_SIZE || db.opts.LSMMaxLevel != LSM.DEFAULT_MAX_LEVEL {
+			t.Fatalf("options were left at %d appends per segment and %d levels", db.opts.WalSegmentSize, db.opts.LSMMaxLevel)
+		}
+		for i := 0; i < 3; i++ {
+			err := db.Put(fmt.Sprint("k", i), []byte("v"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		value, err := db.Get("k1")
+		expectValue(t, "k1", value, err, "v")
+		db = reopen(t, db)
+		value, err = db.Get("k2")
+		expectValue(t, "k2 after the reopen", value, err, "v")
+		segments, _ := ioutil.ReadDir(Initialization.WalDir(db.dir))
+		if len(segments) != 1 {
+			t.Fatalf("%d log segments for 3 writes", len(segments))
+		}
+	}
+}
+
+func TestReopenAfterReplayFlush(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MergeOperator = MergeOperator.Append{}
+	db := openTest(t, opts)
+	db.Merge("k", []byte("a"))
+	batch := NewWriteBatch()
+	batch.Put("x1", []byte("v"))
+	batch.Put("x2", []byte("v"))
+	db.Write(batch)
+	db.Put("x3", []byte("v"))
+	db.Put("x4", []byte("v"))
+	db.Merge("k", []byte("b"))
+	db.Put("x5", []byte("v"))
+
+	// The memtables fill up while the log is read back, the flushes end in the middle of its segment
+	db.opts.MemtableCapacity = 3
+	var tables []string
+	for i := 0; i < 3; i++ {
+		db = reopen(t, db)
+		value, err := db.Get("k")
+		expectValue(t, fmt.Sprint("k after reopen ", i+1), value, err, "ab")
+		for j := 1; j <= 5; j++ {
+			value, err = db.Get(fmt.Sprint("x", j))
+			expectValue(t, fmt.Sprint("x", j, " after reopen ", i+1), value, err, "v")
+		}
+		db.mu.Lock()
+		reopened, _ := db.def.family.Tree.Tables()
+		db.mu.Unlock()
+		if i > 0 && len(reopened) != len(tables) {
+			t.Fatalf("%d tables after reopen %d, expected %d, the flushed records were flushed again", len(reopened), i+1, len(tables))
+		}
+		tables = reopened
+	}
+}
+
+func TestRejectedMergeOperandIsNotLogged(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MergeOperator = MergeOperator.Counter{}
+	db := openTest(t, opts)
+	db.Put("k", []byte("abc"))
+	err := db.Merge("k", []byte("1"))
+	if !errors.Is(err, MergeOperator.ErrInvalidOperand) {
+		t.Fatalf("merge returned %v, expected the error of the operator", err)
+	}
+	db.Merge("n", []byte("1"))
+
+	db = reopen(t, db)
+	value, err := db.Get("k")
+	expectValue(t, "k", value, err, "abc")
+	value, err = db.Get("n")
+	expectValue(t, "n", value, err, "1")
+}
+
+func TestMergeAfterDeleteRangeInTheSameMemtable(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MergeOperator = MergeOperator.Counter{}
+	opts.MemtableCapacity = 2
+	db := openTest(t, opts)
+	// The memtable is full with the second key, the value of k ends up in an SSTable
+	db.Put("k", []byte("10"))
+	db.Put("zz", []byte("x"))
+	err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteRange("a", "z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Merge("k", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB, when string) {
+		t.Helper()
+		value, err := db.Get("k")
+		expectValue(t, "k "+when, value, err, "1")
+		values, errs, err := db.MultiGet([]string{"k"})
+		if err != nil || errs[0] != nil || string(values[0]) != "1" {
+			t.Fatalf("MultiGet of k %s returned %q (%v, %v)", when, values, errs, err)
+		}
+		snapshot, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err = snapshot.Get("k")
+		snapshot.Release()
+		expectValue(t, "snapshot k "+when, value, err, "1")
+		it, err := db.NewIterator("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		if !it.Valid() || it.Key() != "k" || string(it.Value()) != "1" {
+			t.Fatalf("iterator %s is not on k=1", when)
+		}
+	}
+	check(db, "before the reopen")
+	db = reopen(t, db)
+	check(db, "after the reopen")
+	err = db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db, "after the compaction")
+}
@@ -0,0 +1,183 @@
+package DB
+
+import (
+	"errors"
+	"fmt"
+	"project/structures/Errors"
+	"project/structures/Iterator"
+	"project/structures/LSM"
+	"project/structures/ReadPath"
+	"project/structures/memtable"
+	"time"
+)
+
+var ErrReleased = errors.New("snapshot is released")
+
+// Snapshot : Frozen view of every column family, reads see only the writes made before the snapshot was taken
+// Get, Lookup and NewIterator read the default family, the methods ending in CF read the family they are given
+// The SSTables of the snapshot are pinned, compactions keep them on the disk until the snapshot is released
+// The memtables are read only up to the sequence number of the snapshot, the versions it sees are kept when they are
+// overwritten (see memtable.SkipList.Pinned)
+type Snapshot struct {
+	db       *DB
+	sequence uint64
+	views    map[string]*familyView
+	released bool
+}
+
+// familyView : What the snapshot sees of one column family
+type familyView struct {
+	tree   *LSM.LSM
+	mems   []*memtable.SkipList // Memtable and immutable memtables at the time of the snapshot
+	tables []string
+}
+
+// Snapshot : Takes a snapshot of the current state, it has to be released when it is no longer needed
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	s := &Snapshot{db: db, sequence: db.seq, views: make(map[string]*familyView, len(db.families))}
+	for name, family := range db.families {
+		tables, err := family.Tree.Tables()
+		if err != nil {
+			return nil, err
+		}
+		s.views[name] = &familyView{tree: family.Tree, mems: family.Memtables(), tables: tables}
+	}
+	for _, view := range s.views {
+		view.tree.Pin(view.tables)
+	}
+	db.snapshots[s] = true
+	db.pinMemtable()
+	return s, nil
+}
+
+// pinMemtable : Keeps the versions of the memtables that the newest snapshot sees, has to be called with the lock held
+// Immutable memtables don't change anymore, a memtable made later holds only writes newer than every snapshot
+func (db *DB) pinMemtable() {
+	var pinned uint64 = 0
+	for s := range db.snapshots {
+		if s.sequence > pinned {
+			pinned = s.sequence
+		}
+	}
+	for _, family := range db.families {
+		family.Mem.Pinned = pinned
+	}
+}
+
+// Sequence : Sequence number of the last write seen by the snapshot
+func (s *Snapshot) Sequence() uint64 {
+	return s.sequence
+}
+
+// check : Has to be called with the lock of the database held
+func (s *Snapshot) check() error {
+	if s.db.closed {
+		return ErrClosed
+	}
+	if s.released {
+		return ErrReleased
+	}
+	return nil
+}
+
+// view : What the snapshot sees of the family, has to be called with the lock of the database held
+func (s *Snapshot) view(family string) (*familyView, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	view, found := s.views[family]
+	if !found {
+		return nil, fmt.Errorf("%w %q", ErrUnknownColumnFamily, family)
+	}
+	return view, nil
+}
+
+// resolvedTables : Current paths of the SSTables of the view, some of them might have been retired by a compaction
+func (view *familyView) resolvedTables() []string {
+	tables := make([]string, len(view.tables))
+	for i, table := range view.tables {
+		tables[i] = view.tree.Resolve(table)
+	}
+	return tables
+}
+
+// Lookup : Returns all the information stored about the key at the time of the snapshot, including deleted elements
+func (s *Snapshot) Lookup(key string) (*ReadPath.ElementInfo, error) {
+	return s.LookupCF(DEFAULT_COLUMN_FAMILY, key)
+}
+
+// LookupCF : Lookup of the key in the column family, ErrUnknownColumnFamily if the database has no such family
+func (s *Snapshot) LookupCF(family, key string) (*ReadPath.ElementInfo, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	view, err := s.view(family)
+	if err != nil {
+		return nil, err
+	}
+	elements := ReadPath.CheckMemtablesAt(view.mems, key, s.sequence)
+	var tables []string
+	if len(elements) == 0 || elements[len(elements)-1].Operand {
+		tables = view.resolvedTables()
+	}
+	return ReadPath.Resolve(elements, tables, key, s.db.opts.MergeOperator, time.Now().Unix())
+}
+
+// Get : Returns the value the key had at the time of the snapshot, Errors.ErrNotFound if it didn't exist or was deleted
+func (s *Snapshot) Get(key string) ([]byte, error) {
+	return s.GetCF(DEFAULT_COLUMN_FAMILY, key)
+}
+
+// GetCF : Get of the key in the column family, ErrUnknownColumnFamily if the database has no such family
+func (s *Snapshot) GetCF(family, key string) ([]byte, error) {
+	element, err := s.LookupCF(family, key)
+	if err != nil {
+		return nil, err
+	}
+	if element.Tombstone {
+		return nil, Errors.ErrNotFound
+	}
+	return element.Value, nil
+}
+
+// NewIterator : Iterates over the keys in [start, end) as they were at the time of the snapshot
+// The iterator has to be closed when it is no longer needed, it stays usable after the snapshot is released
+func (s *Snapshot) NewIterator(start, end string) (*Iterator.Iterator, error) {
+	return s.NewIteratorCF(DEFAULT_COLUMN_FAMILY, start, end)
+}
+
+// NewIteratorCF : NewIterator over the keys of the column family
+func (s *Snapshot) NewIteratorCF(family, start, end string) (*Iterator.Iterator, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	view, err := s.view(family)
+	if err != nil {
+		return nil, err
+	}
+	return Iterator.NewIteratorAt(view.mems, view.resolvedTables(), s.db.opts.MergeOperator, start, end, s.sequence)
+}
+
+// Release : Unpins the SSTables of the snapshot, the ones compacted in the meantime are removed
+func (s *Snapshot) Release() error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.released {
+		return ErrReleased
+	}
+	s.released = true
+	delete(s.db.snapshots, s)
+	s.db.pinMemtable()
+	var err error
+	for _, view := range s.views {
+		unpinErr := view.tree.Unpin(view.tables)
+		if err == nil {
+			err = unpinErr
+		}
+	}
+	s.views = nil
+	return err
+}
@@ -0,0 +1,204 @@
+package DB
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"project/structures/Errors"
+	"testing"
+)
+
+// openTest : Opens a database in a temporary directory that is closed when the test ends
+func openTest(t *testing.T, opts Options) *DB {
+	t.Helper()
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// expectValue : Fails the test unless the read returned the value, an empty value stands for ErrNotFound
+func expectValue(t *testing.T, what string, value []byte, err error, expected string) {
+	t.Helper()
+	if expected == "" {
+		if !errors.Is(err, Errors.ErrNotFound) {
+			t.Fatalf("%s is %q (%v), expected it not to be found", what, value, err)
+		}
+		return
+	}
+	if err != nil || string(value) != expected {
+		t.Fatalf("%s is %q (%v), expected %q", what, value, err, expected)
+	}
+}
+
+func TestSnapshotSurvivesFlushAndCompaction(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemtableCapacity = 4
+	opts.WalSegmentSize = 3
+	db := openTest(t, opts)
+	for i := 0; i < 10; i++ {
+		db.Put(fmt.Sprintf("k%02d", i), []byte("v1"))
+	}
+	// Two writes in the same second are ordered by their sequence numbers
+	db.Put("same", []byte("a"))
+	db.Put("same", []byte("b"))
+	err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Put(fmt.Sprintf("k%02d", i), []byte("v2"))
+	}
+	db.Delete("k03")
+	db.Put("new", []byte("x"))
+	db.Put("same", []byte("c"))
+	err = db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		value, err := snapshot.Get(key)
+		expectValue(t, "snapshot "+key, value, err, "v1")
+		value, err = db.Get(key)
+		if i == 3 {
+			expectValue(t, key, value, err, "")
+		} else {
+			expectValue(t, key, value, err, "v2")
+		}
+	}
+	value, err := snapshot.Get("same")
+	expectValue(t, "snapshot same", value, err, "b")
+	value, err = snapshot.Get("new")
+	expectValue(t, "snapshot new", value, err, "")
+
+	retired := filepath.Join(db.Dir(), "Data", "SSTable", DEFAULT_COLUMN_FAMILY, "Retired")
+	entries, _ := os.ReadDir(retired)
+	if len(entries) == 0 {
+		t.Fatal("the compaction removed the tables of the snapshot")
+	}
+	err = snapshot.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = os.ReadDir(retired)
+	if len(entries) != 0 {
+		t.Fatalf("%d retired tables are left after the release", len(entries))
+	}
+	_, err = snapshot.Get("k01")
+	if !errors.Is(err, ErrReleased) {
+		t.Fatalf("read of a released snapshot returned %v", err)
+	}
+}
+
+func TestSnapshotKeepsOverwrittenMemtableVersions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemtableCapacity = 1000
+	db := openTest(t, opts)
+	db.Put("a", []byte("1"))
+	db.Put("b", []byte("1"))
+	db.Put("c", []byte("1"))
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", []byte("2"))
+	db.Put("a", []byte("3"))
+	db.Delete("b")
+	db.DeleteRange("c", "d")
+	db.Put("d", []byte("2"))
+
+	expected := map[string]string{"a": "1", "b": "1", "c": "1", "d": ""}
+	for key, value := range expected {
+		got, err := snapshot.Get(key)
+		expectValue(t, "snapshot "+key, got, err, value)
+	}
+	it, err := snapshot.NewIterator("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key()+"="+string(it.Value()))
+	}
+	it.Close()
+	if fmt.Sprint(keys) != "[a=1 b=1 c=1]" {
+		t.Fatalf("snapshot iterator visited %v", keys)
+	}
+	value, err := db.Get("a")
+	expectValue(t, "a", value, err, "3")
+
+	// Without a snapshot the memtable keeps only the newest version
+	err = snapshot.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.def.family.Mem.Pinned != 0 {
+		t.Fatalf("the memtable is still pinned at %d", db.def.family.Mem.Pinned)
+	}
+	db.Put("a", []byte("4"))
+	if node := db.def.family.Mem.FindNode("a"); node.Older != nil {
+		t.Fatal("a version was kept without a snapshot")
+	}
+}
+
+func TestSnapshotOfColumnFamilies(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemtableCapacity = 4
+	opts.ColumnFamilies = map[string]ColumnFamilyOptions{"other": {}}
+	db := openTest(t, opts)
+	other, _ := db.ColumnFamily("other")
+	for i := 0; i < 6; i++ {
+		other.Put(fmt.Sprintf("k%02d", i), []byte("v1"))
+	}
+	other.Put("mem", []byte("v1"))
+	db.Put("mem", []byte("default"))
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+	for i := 0; i < 6; i++ {
+		other.Put(fmt.Sprintf("k%02d", i), []byte("v2"))
+	}
+	other.Put("mem", []byte("v2"))
+	other.Put("new", []byte("v2"))
+	err = other.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"k00", "k05", "mem"} {
+		value, err := snapshot.GetCF("other", key)
+		expectValue(t, "snapshot "+key, value, err, "v1")
+	}
+	value, err := snapshot.GetCF("other", "new")
+	expectValue(t, "snapshot new", value, err, "")
+	value, err = snapshot.Get("mem")
+	expectValue(t, "snapshot mem of the default family", value, err, "default")
+	it, err := snapshot.NewIteratorCF("other", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	keys := 0
+	for ; it.Valid(); it.Next() {
+		expectValue(t, "iterated "+it.Key(), it.Value(), nil, "v1")
+		keys++
+	}
+	if keys != 7 {
+		t.Fatalf("the iterator went over %d keys, expected 7", keys)
+	}
+	_, err = snapshot.GetCF("missing", "k00")
+	if !errors.Is(err, ErrUnknownColumnFamily) {
+		t.Fatalf("read of a missing family returned %v", err)
+	}
+}
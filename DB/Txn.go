@@ -0,0 +1,109 @@
+package DB
+
+import (
+	"errors"
+	"project/structures/Errors"
+	"project/structures/ReadPath"
+	wal "project/structures/mmap"
+)
+
+var ErrConflict = errors.New("transaction conflict, a key it read was changed by another write")
+var ErrTxnDone = errors.New("transaction is already committed or rolled back")
+
+// Txn : Optimistic transaction on the default column family, reads see it as it was when the transaction began
+// Writes are buffered and written as one batch on Commit, which fails with ErrConflict if any key the
+// transaction read was written after the transaction began
+type Txn struct {
+	db       *DB
+	snapshot *Snapshot
+	batch    *WriteBatch
+	writes   map[string]wal.BatchEntry // Last buffered operation on each key
+	reads    map[string]bool
+	done     bool
+}
+
+// Begin : Starts a transaction, it has to end with Commit or Rollback
+func (db *DB) Begin() (*Txn, error) {
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	txn := Txn{db: db, snapshot: snapshot, batch: NewWriteBatch()}
+	txn.writes = make(map[string]wal.BatchEntry)
+	txn.reads = make(map[string]bool)
+	return &txn, nil
+}
+
+// Get : Returns the value of the key, the transaction sees its own writes
+func (t *Txn) Get(key string) ([]byte, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	entry, found := t.writes[key]
+	if found {
+		if entry.Tombstone {
+			return nil, Errors.ErrNotFound
+		}
+		return entry.Value, nil
+	}
+	t.reads[key] = true
+	return t.snapshot.Get(key)
+}
+
+func (t *Txn) Put(key string, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.batch.Put(key, value)
+	t.writes[key] = wal.BatchEntry{Key: key, Value: value}
+	return nil
+}
+
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.batch.Delete(key)
+	t.writes[key] = wal.BatchEntry{Key: key, Tombstone: true}
+	return nil
+}
+
+// Commit : Checks the keys the transaction read and writes all of its operations as one atomic log record
+// Nothing is written if ErrConflict is returned, the transaction has to be started again
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	err := t.db.commit(t)
+	releaseErr := t.snapshot.Release()
+	if err != nil {
+		return err
+	}
+	return releaseErr
+}
+
+// Rollback : Discards the buffered writes
+func (t *Txn) Rollback() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	return t.snapshot.Release()
+}
+
+func (db *DB) commit(t *Txn) error {
+	return db.update(func() error {
+		for key := range t.reads {
+			// A version that expired or was deleted by now was still written after the transaction began
+			sequence, err := ReadPath.LastSequence(db.def.family.Tree, db.def.family.Memtables(), key)
+			if err != nil {
+				return err
+			}
+			if sequence > t.snapshot.Sequence() {
+				return ErrConflict
+			}
+		}
+		return db.write(t.batch)
+	})
+}
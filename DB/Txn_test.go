@@ -0,0 +1,98 @@
+package DB
+
+import (
+	"errors"
+	"project/structures/WritePath"
+	"testing"
+	"time"
+)
+
+func TestTxnConflict(t *testing.T) {
+	db := openTest(t, DefaultOptions())
+	db.Put("alice", []byte("100"))
+	db.Put("bob", []byte("0"))
+	t1, _ := db.Begin()
+	t2, _ := db.Begin()
+
+	t1.Get("alice")
+	t1.Put("alice", []byte("50"))
+	t1.Put("bob", []byte("50"))
+	value, err := t1.Get("bob")
+	expectValue(t, "own write", value, err, "50")
+	t2.Get("alice")
+	t2.Put("alice", []byte("90"))
+
+	err = t1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = t2.Commit()
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("commit returned %v, expected a conflict", err)
+	}
+	value, err = db.Get("alice")
+	expectValue(t, "alice", value, err, "50")
+
+	// A key that was only written is not checked
+	t3, _ := db.Begin()
+	t3.Put("carol", []byte("1"))
+	db.Put("carol", []byte("2"))
+	err = t3.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.Get("carol")
+	expectValue(t, "carol", value, err, "1")
+
+	t4, _ := db.Begin()
+	t4.Delete("carol")
+	t4.Rollback()
+	err = t4.Commit()
+	if !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("commit after rollback returned %v", err)
+	}
+}
+
+func TestTxnConflictWithExpiredWrite(t *testing.T) {
+	db := openTest(t, DefaultOptions())
+	txn, _ := db.Begin()
+	_, err := txn.Get("k")
+	expectValue(t, "k", nil, err, "")
+	txn.Put("k", []byte("txn"))
+
+	// Written after the transaction began with an expiry that passed before the commit
+	err = db.update(func() error {
+		db.seq++
+		return WritePath.WritePath(db.log, db.families, db.def.family, "k", []byte("v"), db.seq, time.Now().Unix()-1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Get("k")
+	expectValue(t, "k", nil, err, "")
+	err = txn.Commit()
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("commit returned %v, expected a conflict", err)
+	}
+}
+
+func TestTxnConflictWithFlushedWrite(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemtableCapacity = 2
+	db := openTest(t, opts)
+	db.Put("k", []byte("1"))
+	txn, _ := db.Begin()
+	txn.Get("k")
+	txn.Put("k", []byte("txn"))
+	db.Delete("k")
+	db.Put("x", []byte("1"))
+	db.Put("y", []byte("1"))
+	err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Commit()
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("commit returned %v, expected a conflict", err)
+	}
+}
@@ -0,0 +1,65 @@
+package Errors
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned on the read and write path
+// Callers compare with errors.Is, the detailed types below match the sentinel of their kind
+var (
+	ErrNotFound  = errors.New("key not found")
+	ErrCorrupted = errors.New("data corrupted")
+	ErrIO        = errors.New("input/output error")
+)
+
+// CorruptedError : Content of a file doesn't match what was expected at the given offset
+type CorruptedError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("%s: %s (file %s, offset %d)", ErrCorrupted, e.Reason, e.File, e.Offset)
+}
+
+func (e *CorruptedError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+// IOError : Operation Op on the file failed with Err
+type IOError struct {
+	Op   string
+	File string
+	Err  error
+}
+
+func (e *IOError) Error() string {
+	return fmt.Sprintf("%s: %s %s: %v", ErrIO, e.Op, e.File, e.Err)
+}
+
+func (e *IOError) Is(target error) bool {
+	return target == ErrIO
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// Corrupted : Creates a CorruptedError
+func Corrupted(file string, offset int64, reason string) error {
+	return &CorruptedError{File: file, Offset: offset, Reason: reason}
+}
+
+// IO : Wraps err in to an IOError, nil is returned if there is no error
+// Errors that are already typed are returned as they are
+func IO(op, file string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrIO) || errors.Is(err, ErrCorrupted) || errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return &IOError{Op: op, File: file, Err: err}
+}
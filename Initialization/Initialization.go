@@ -2,65 +2,35 @@ package Initialization
 
 import (
 	"os"
-	bloom_filter "project/structures/Bloom_Filter"
-	"project/structures/Configuration"
-	"project/structures/LSM"
-	"project/structures/TokenBucket"
-	"project/structures/lru"
-	"project/structures/memtable"
-	wal "project/structures/mmap"
-	"strconv"
+	"path/filepath"
+	"project/structures/SSTable"
 )
 
-func CreateDataFiles() {
-	// Creates the original directories where data will be stored
-	// Function is only called once when the system starts
-	if _, err := os.Stat("./Data"); os.IsNotExist(err) {
-		err := os.Mkdir("./Data", 0755)
-		if err != nil {
-			panic(err.Error())
-		}
-		if _, err := os.Stat("./Data/SSTable"); os.IsNotExist(err) {
-			err := os.Mkdir("./Data/SSTable", 0755)
+// SSTableDir : Directory holding the column families of the database stored in dir
+func SSTableDir(dir string) string {
+	return filepath.Join(dir, "Data", "SSTable")
+}
+
+// FamilyDir : Directory holding the levels of SSTables of one column family
+func FamilyDir(dir, family string) string {
+	return filepath.Join(SSTableDir(dir), family)
+}
+
+// WalDir : Directory holding the log segments of the database stored in dir
+func WalDir(dir string) string {
+	return filepath.Join(dir, "Wal")
+}
+
+func CreateDataFiles(dir string, families map[string]int) error {
+	// Creates the directories where data will be stored inside dir, families maps each column family to its max level
+	// Function is called every time a database is opened, existing directories are left as they are
+	for family, maxLevel := range families {
+		for i := 1; i <= maxLevel; i++ {
+			err := os.MkdirAll(SSTable.LevelDir(FamilyDir(dir, family), i), 0755)
 			if err != nil {
-				panic(err.Error())
+				return err
 			}
-			for i := 1; i <= LSM.MAX_LEVEL; i++ {
-				if _, err := os.Stat("./Data/SSTable/Level" + strconv.Itoa(i)); os.IsNotExist(err) {
-					err := os.Mkdir("./Data/SSTable/Level"+strconv.Itoa(i), 0755)
-					if err != nil {
-						panic(err.Error())
-					}
-				}
-			}
-		}
-	}
-	if _, err := os.Stat("./Wal") ; os.IsNotExist(err) {
-		err := os.Mkdir("./Wal", 0755)
-		if err != nil {
-			panic(err.Error())
 		}
 	}
-}
-
-func Configure() {
-	config := Configuration.LoadConfig()
-	// Extract configuration values
-	if config != nil {
-		wal.SEGMENT_SIZE = config.WalSegmentSize
-		memtable.CAPACITY = config.MemtableCapacity
-		memtable.MAX_HEIGHT = config.MemtableMaxHeight
-		bloom_filter.FALSE_POSITIVE_RATE = config.BloomFalsePositiveRate
-		lru.CAPACITY = config.LRUCapacity
-		LSM.MAX_LEVEL = config.LSMMaxLevel
-		TokenBucket.MAX_REQ = config.MaxRequestPerInterval
-		TokenBucket.INTERVAL = config.Interval
-	} else {	// Configuration file is non-existent, resort to default values
-		wal.SetDefaultParam()
-		memtable.SetDefaultParam()
-		bloom_filter.SetDefaultParam()
-		lru.SetDefaultParam()
-		LSM.SetDefaultParam()
-		TokenBucket.SetDefaultParam()
-	}
+	return os.MkdirAll(WalDir(dir), 0755)
 }
@@ -0,0 +1,415 @@
+package Iterator
+
+import (
+	"encoding/binary"
+	"math"
+	"project/structures/MergeOperator"
+	"project/structures/SSTable"
+	"project/structures/memtable"
+	"sort"
+	"time"
+)
+
+// source : One sorted input of the iterator, either the memtable or a Data file
+// Next can only follow Seek and Prev can only follow SeekBefore
+type source interface {
+	Seek(key string) error
+	Next() error
+	SeekBefore(key string) error
+	Prev() error
+	Element() *SSTable.Element
+	Close() error
+}
+
+// memtableSource : Copy of the memtable elements taken when the iterator was created
+// Later writes to the memtable are not seen by the iterator, neither are the versions newer than the sequence number
+type memtableSource struct {
+	elements []*SSTable.Element
+	position int
+}
+
+func newMemtableSource(mem *memtable.SkipList, start, end string, sequence uint64) *memtableSource {
+	ms := memtableSource{}
+	for next := mem.Seek(start); next != nil && (end == "" || next.Key < end); next = next.Next[0] {
+		node := next.Version(sequence)
+		if node == nil {
+			continue
+		}
+		element := SSTable.Element{}
+		element.Key = node.Key
+		element.Value = node.Value
+		element.Timestamp = binary.LittleEndian.Uint64(node.TimeStamp)
+		element.Sequence = node.Sequence()
+		element.Tombstone = node.Tombstone
+		element.Expiry = node.Expiry
+		element.Operand = node.Operand
+		ms.elements = append(ms.elements, &element)
+	}
+	return &ms
+}
+
+func (ms *memtableSource) Seek(key string) error {
+	ms.position = sort.Search(len(ms.elements), func(i int) bool { return ms.elements[i].Key >= key })
+	return nil
+}
+
+func (ms *memtableSource) Next() error {
+	ms.position++
+	return nil
+}
+
+func (ms *memtableSource) SeekBefore(key string) error {
+	if key == "" {
+		ms.position = len(ms.elements) - 1
+	} else {
+		ms.position = sort.Search(len(ms.elements), func(i int) bool { return ms.elements[i].Key >= key }) - 1
+	}
+	return nil
+}
+
+func (ms *memtableSource) Prev() error {
+	if ms.position >= 0 {
+		ms.position--
+	}
+	return nil
+}
+
+func (ms *memtableSource) Element() *SSTable.Element {
+	if ms.position >= 0 && ms.position < len(ms.elements) {
+		return ms.elements[ms.position]
+	}
+	return nil
+}
+
+func (ms *memtableSource) Close() error {
+	return nil
+}
+
+// Iterator : Goes through the keys of the memtable and all the SSTables in sorted order
+// When a key is found in several places the newest element is used, deleted and expired keys are skipped
+// Merge operands are applied on top of the older elements of the key before the key is visited
+// Keys deleted by a range tombstone of the memtable or of an SSTable are skipped as well
+// Only keys in [start, end) are visited, an empty end means there is no upper bound
+// The iterator can go forward (Seek, Next) and backward (SeekToLast, SeekForPrev, Prev)
+type Iterator struct {
+	start, end string
+	// Sources are ordered from the newest to the oldest, on equal versions the newer source wins
+	sources []source
+	current *SSTable.Element
+	reverse bool
+	now     int64 // Elements that expired by the time the iterator was created are skipped
+	op      MergeOperator.MergeOperator
+	// Range tombstones of all the sources, read when the iterator was created
+	tombstones []memtable.RangeTombstone
+	err        error
+}
+
+// PrefixEnd : Smallest key that is bigger than every key starting with the prefix, used as the end of a prefix range
+// An empty string is returned when there is no such key (the prefix is empty or made of 0xff bytes)
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] += 1
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// NewIterator : Creates an iterator positioned on the first key of the range
+// memtables and tables (the path prefixes of the SSTables, see LSM.Tables) are ordered from the newest to the oldest
+// op folds the merge operands, it can be nil if no merge operand was ever written
+func NewIterator(memtables []*memtable.SkipList, tables []string, op MergeOperator.MergeOperator, start, end string) (*Iterator, error) {
+	return NewIteratorAt(memtables, tables, op, start, end, math.MaxUint64)
+}
+
+// NewIteratorAt : Creates an iterator that sees only the writes of the memtables with a sequence number up to the given one
+// Used by snapshots, the SSTables have to be the ones the snapshot pinned
+func NewIteratorAt(memtables []*memtable.SkipList, tables []string, op MergeOperator.MergeOperator, start, end string, sequence uint64) (*Iterator, error) {
+	it := Iterator{start: start, end: end, now: time.Now().Unix(), op: op}
+	for _, mem := range memtables {
+		it.sources = append(it.sources, newMemtableSource(mem, start, end, sequence))
+		for _, tombstone := range mem.RangeTombstones {
+			if tombstone.Sequence() <= sequence {
+				it.tombstones = append(it.tombstones, tombstone)
+			}
+		}
+	}
+	for _, table := range tables {
+		dataIterator, err := SSTable.OpenDataIterator(table + "-Data.db")
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.sources = append(it.sources, dataIterator)
+		tombstones, err := SSTable.ReadRangeTombstones(table + "-RangeDel.db")
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.tombstones = append(it.tombstones, tombstones...)
+	}
+	it.Seek(start)
+	if it.err != nil {
+		err := it.err
+		it.Close()
+		return nil, err
+	}
+	return &it, nil
+}
+
+// Seek : Positions the iterator on the first visible key greater than or equal to the key
+func (it *Iterator) Seek(key string) {
+	if key < it.start {
+		key = it.start
+	}
+	it.err = nil
+	it.reverse = false
+	for _, s := range it.sources {
+		err := s.Seek(key)
+		if err != nil {
+			it.err = err
+			it.current = nil
+			return
+		}
+	}
+	it.findNext()
+}
+
+// Next : Moves to the next visible key
+func (it *Iterator) Next() {
+	if it.current == nil {
+		return
+	}
+	if it.reverse {
+		// Sources are positioned behind the current key, they are moved in front of it first
+		key := it.current.Key
+		it.Seek(key)
+		if it.current == nil || it.current.Key != key {
+			return
+		}
+	}
+	it.advancePast(it.current.Key)
+	it.findNext()
+}
+
+// SeekToLast : Positions the iterator on the last visible key of the range
+func (it *Iterator) SeekToLast() {
+	it.seekBefore(it.end)
+}
+
+// SeekForPrev : Positions the iterator on the last visible key less than or equal to the key
+func (it *Iterator) SeekForPrev(key string) {
+	if it.end != "" && key >= it.end {
+		it.seekBefore(it.end)
+		return
+	}
+	// key + "\x00" is the smallest key bigger than key
+	it.seekBefore(key + "\x00")
+}
+
+// Prev : Moves to the previous visible key
+func (it *Iterator) Prev() {
+	if it.current == nil {
+		return
+	}
+	if !it.reverse {
+		it.seekBefore(it.current.Key)
+		return
+	}
+	it.retreatPast(it.current.Key)
+	it.findPrev()
+}
+
+func (it *Iterator) seekBefore(key string) {
+	it.err = nil
+	it.reverse = true
+	for _, s := range it.sources {
+		err := s.SeekBefore(key)
+		if err != nil {
+			it.err = err
+			it.current = nil
+			return
+		}
+	}
+	it.findPrev()
+}
+
+// findPrev : Merges the sources backwards until an element that isn't deleted or expired is found
+func (it *Iterator) findPrev() {
+	it.current = nil
+	for it.err == nil {
+		var newest *SSTable.Element
+		for _, s := range it.sources {
+			element := s.Element()
+			if element == nil {
+				continue
+			}
+			if newest == nil || element.Key > newest.Key || (element.Key == newest.Key && element.NewerThan(newest)) {
+				newest = element
+			}
+		}
+		if newest == nil || newest.Key < it.start {
+			return
+		}
+		newest = it.fold(newest)
+		if it.err != nil {
+			return
+		}
+		if it.visible(newest) && (it.end == "" || newest.Key < it.end) {
+			it.current = newest
+			return
+		}
+		it.retreatPast(newest.Key)
+	}
+}
+
+// retreatPast : Moves every source that is positioned on the key to its previous element
+func (it *Iterator) retreatPast(key string) {
+	for _, s := range it.sources {
+		for s.Element() != nil && s.Element().Key == key {
+			err := s.Prev()
+			if err != nil {
+				it.err = err
+				it.current = nil
+				return
+			}
+		}
+	}
+}
+
+// findNext : Merges the sources until an element that isn't deleted or expired is found
+func (it *Iterator) findNext() {
+	it.current = nil
+	for it.err == nil {
+		var newest *SSTable.Element
+		for _, s := range it.sources {
+			element := s.Element()
+			if element == nil {
+				continue
+			}
+			if newest == nil || element.Key < newest.Key || (element.Key == newest.Key && element.NewerThan(newest)) {
+				newest = element
+			}
+		}
+		if newest == nil || (it.end != "" && newest.Key >= it.end) {
+			return
+		}
+		newest = it.fold(newest)
+		if it.err != nil {
+			return
+		}
+		if it.visible(newest) {
+			it.current = newest
+			return
+		}
+		it.advancePast(newest.Key)
+	}
+}
+
+// visible : Reports whether the element isn't deleted, expired or deleted by a range tombstone
+func (it *Iterator) visible(element *SSTable.Element) bool {
+	return !element.Tombstone && !element.Expired(it.now) && !it.rangeDeleted(element)
+}
+
+// rangeDeleted : Reports whether one of the range tombstones is newer than the element and covers its key
+func (it *Iterator) rangeDeleted(element *SSTable.Element) bool {
+	for i := range it.tombstones {
+		if it.tombstones[i].Deletes(element.Key, element.Sequence, element.Timestamp) {
+			return true
+		}
+	}
+	return false
+}
+
+// fold : Applies the merge operands of the newest element's key on top of the older element the sources hold for it
+// Every source is positioned on its element of the key, if it has one
+func (it *Iterator) fold(newest *SSTable.Element) *SSTable.Element {
+	if !newest.Operand || it.rangeDeleted(newest) {
+		return newest
+	}
+	var versions []*SSTable.Element
+	for _, s := range it.sources {
+		element := s.Element()
+		if element != nil && element.Key == newest.Key {
+			versions = append(versions, element)
+		}
+	}
+	// Sources are ordered from the newest, on equal versions the newer source stays in front
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].NewerThan(versions[j]) })
+
+	var existing []byte = nil
+	var operands [][]byte
+	for _, version := range versions {
+		if it.rangeDeleted(version) {
+			// The key had no value before the operands
+			break
+		}
+		if !version.Operand {
+			// Deleted or expired elements leave the key without a value
+			if !version.Tombstone && !version.Expired(it.now) {
+				existing = version.Value
+			}
+			break
+		}
+		// Operands are applied from the oldest
+		operands = append([][]byte{version.Value}, operands...)
+	}
+	value, err := MergeOperator.Apply(it.op, newest.Key, existing, operands)
+	if err != nil {
+		it.err = err
+		it.current = nil
+		return nil
+	}
+	folded := *newest
+	folded.Operand = false
+	folded.Value = value
+	return &folded
+}
+
+// advancePast : Moves every source that is positioned on the key to its next element
+func (it *Iterator) advancePast(key string) {
+	for _, s := range it.sources {
+		for s.Element() != nil && s.Element().Key == key {
+			err := s.Next()
+			if err != nil {
+				it.err = err
+				it.current = nil
+				return
+			}
+		}
+	}
+}
+
+// Valid : Returns false once the iterator went past the last key of the range or an error occurred
+func (it *Iterator) Valid() bool {
+	return it.current != nil
+}
+
+func (it *Iterator) Key() string {
+	return it.current.Key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.current.Value
+}
+
+// Err : Error that stopped the iteration, nil if the iterator simply reached the end
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close : Closes all the opened Data files
+func (it *Iterator) Close() error {
+	var first error
+	for _, s := range it.sources {
+		err := s.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	it.sources = nil
+	it.current = nil
+	return first
+}
@@ -0,0 +1,216 @@
+package LSM
+
+import (
+	"os"
+	"project/structures/Errors"
+	"project/structures/SSTable"
+	"sort"
+)
+
+const (
+	DEFAULT_LEVEL1_TABLES    = 4
+	DEFAULT_LEVEL_BASE_BYTES = 1 << 20
+	DEFAULT_LEVEL_FAN_OUT    = 10
+)
+
+// tableInfo : One SSTable of a level with the keys it covers and the size of its Data file
+type tableInfo struct {
+	name   string
+	prefix string
+	first  string
+	last   string
+	open   bool // A range tombstone without an end covers every key after first
+	empty  bool // No keys and no range tombstones
+	size   int64
+}
+
+// overlaps : Reports whether the key ranges of the two tables share a key
+func (t *tableInfo) overlaps(other *tableInfo) bool {
+	if t.empty || other.empty {
+		return false
+	}
+	return (other.open || t.first <= other.last) && (t.open || other.first <= t.last)
+}
+
+// extend : Widens the key range so it also covers the other table
+func (t *tableInfo) extend(other *tableInfo) {
+	if other.empty {
+		return
+	}
+	if t.empty {
+		t.first, t.last, t.open, t.empty = other.first, other.last, other.open, false
+		return
+	}
+	if other.first < t.first {
+		t.first = other.first
+	}
+	if other.last > t.last {
+		t.last = other.last
+	}
+	t.open = t.open || other.open
+}
+
+// levelTables : Tables of the level ordered by their first key
+func (lsm *LSM) levelTables(level int) []*tableInfo {
+	tables := append([]*tableInfo{}, lsm.levels[level]...)
+	sort.SliceStable(tables, func(i, j int) bool { return tables[i].first < tables[j].first })
+	return tables
+}
+
+// readTableInfo : Key range and size of one table of the level
+func (lsm *LSM) readTableInfo(level int, name string) (*tableInfo, error) {
+	table := tableInfo{name: name, prefix: SSTable.TablePrefix(lsm.Dir, level, name)}
+	summary, err := SSTable.ReadSummaryHeader(table.prefix + "-Summary.db")
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(table.prefix + "-Data.db")
+	if err != nil {
+		return nil, Errors.IO("stat", table.prefix+"-Data.db", err)
+	}
+	table.size = fileInfo.Size()
+	table.empty = table.size == 0
+	table.first, table.last = summary.FirstKey, summary.LastKey
+	// Range tombstones delete keys of the lower levels, their ranges belong to the table as well
+	tombstones, err := SSTable.ReadRangeTombstones(table.prefix + "-RangeDel.db")
+	if err != nil {
+		return nil, err
+	}
+	for _, tombstone := range tombstones {
+		covered := tableInfo{first: tombstone.Start, last: tombstone.End, open: tombstone.End == ""}
+		table.extend(&covered)
+	}
+	return &table, nil
+}
+
+// overlapsOutside : Reports whether a table on the level or below it, other than the given ones, overlaps them
+func (lsm *LSM) overlapsOutside(tables []levelTable, level int) bool {
+	return len(lsm.outside(tables, level)) > 0
+}
+
+// outside : Tables on the level or below it, other than the given ones, that overlap them
+func (lsm *LSM) outside(tables []levelTable, level int) []levelTable {
+	covered := tableInfo{empty: true}
+	inputs := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		covered.extend(table.tableInfo)
+		inputs[table.prefix] = true
+	}
+	var overlapping []levelTable
+	for ; level <= lsm.MaxLevel; level++ {
+		for _, table := range lsm.levels[level] {
+			if !inputs[table.prefix] && table.overlaps(&covered) {
+				overlapping = append(overlapping, levelTable{level, table})
+			}
+		}
+	}
+	return overlapping
+}
+
+// Leveled : Level1 receives the flushed memtables and its tables overlap each other, it is compacted once it holds
+// Level1Tables tables
+// From Level2 on the tables of a level cover key ranges that don't overlap, and every level has a target size that
+// grows by FanOut from one level to the next, the last level has no target
+// A compaction merges the tables picked on one level with the tables of the next level that overlap them
+type Leveled struct {
+	Level1Tables int            // Number of tables on Level1 that triggers its compaction
+	BaseBytes    int64          // Target size of the Data files on Level2
+	FanOut       int            // Every level below Level2 is this many times bigger than the one above it
+	pointer      map[int]string // Last key of the table compacted last on each level
+}
+
+func NewLeveled(level1Tables int, baseBytes int64, fanOut int) *Leveled {
+	return &Leveled{Level1Tables: level1Tables, BaseBytes: baseBytes, FanOut: fanOut, pointer: make(map[int]string)}
+}
+
+// levelTarget : Size the Data files of the level may reach before the level is compacted, 0 for the last level
+func (l *Leveled) levelTarget(lsm *LSM, level int) int64 {
+	if level >= lsm.MaxLevel {
+		return 0
+	}
+	target := l.BaseBytes
+	for i := 2; i < level; i++ {
+		target *= int64(l.FanOut)
+	}
+	return target
+}
+
+// pickLevel : Level that is the furthest over its limit, 0 if none of them needs a compaction
+func (l *Leveled) pickLevel(lsm *LSM) (int, []*tableInfo) {
+	best, bestScore := 0, 1.0
+	var bestTables []*tableInfo
+	for level := 1; level < lsm.MaxLevel; level++ {
+		tables := lsm.levelTables(level)
+		var score float64
+		if level == 1 {
+			score = float64(len(tables)) / float64(l.Level1Tables)
+		} else {
+			var size int64 = 0
+			for _, table := range tables {
+				size += table.size
+			}
+			score = float64(size) / float64(l.levelTarget(lsm, level))
+		}
+		if score >= bestScore && len(tables) > 0 {
+			best, bestScore, bestTables = level, score, tables
+		}
+	}
+	return best, bestTables
+}
+
+// Compact : Compacts the level that is the furthest over its limit
+func (l *Leveled) Compact(lsm *LSM) (bool, error) {
+	level, tables := l.pickLevel(lsm)
+	if level == 0 {
+		return false, nil
+	}
+	return true, l.compactLevel(lsm, level, tables)
+}
+
+// compactLevel : Merges tables of the level with the overlapping tables of the next level in to the next level
+// All the tables of Level1 are merged at once since they overlap, on the other levels one table is picked in turn
+func (l *Leveled) compactLevel(lsm *LSM, level int, tables []*tableInfo) error {
+	var inputs []*tableInfo
+	if level == 1 {
+		// The newer tables come first, they win on equal versions
+		for i := len(lsm.levels[1]) - 1; i >= 0; i-- {
+			inputs = append(inputs, lsm.levels[1][i])
+		}
+	} else {
+		// The table after the one compacted last, so all the key ranges get their turn
+		picked := tables[0]
+		for _, table := range tables {
+			if table.first > l.pointer[level] {
+				picked = table
+				break
+			}
+		}
+		l.pointer[level] = picked.last
+		inputs = []*tableInfo{picked}
+	}
+	covered := tableInfo{empty: true}
+	for _, table := range inputs {
+		covered.extend(table)
+	}
+	var overlapping []*tableInfo
+	for _, table := range lsm.levelTables(level + 1) {
+		if table.overlaps(&covered) {
+			overlapping = append(overlapping, table)
+		}
+	}
+
+	return lsm.compact(level, inputs, overlapping)
+}
+
+// compact : Merges the tables of the level and the tables of the next level in to new SSTables on the next level
+// The levels below hold older versions than the inputs, without them overlapping the tombstones have nothing to delete
+func (lsm *LSM) compact(level int, tables []*tableInfo, nextTables []*tableInfo) error {
+	var inputs []levelTable
+	for _, table := range tables {
+		inputs = append(inputs, levelTable{level, table})
+	}
+	for _, table := range nextTables {
+		inputs = append(inputs, levelTable{level + 1, table})
+	}
+	return lsm.compactTables(inputs, level+1, !lsm.overlapsOutside(inputs, level+2), nil)
+}
@@ -1,299 +1,255 @@
 package LSM
 
 import (
-	"bufio"
-	"encoding/binary"
-	"io/ioutil"
 	"os"
-	bloom_filter "project/structures/Bloom_Filter"
+	"path/filepath"
+	"project/structures/Errors"
+	"project/structures/MergeOperator"
 	"project/structures/SSTable"
-	"project/structures/merkle"
+	"project/structures/memtable"
 	"strconv"
+	"sync"
 )
 
 const DEFAULT_MAX_LEVEL = 5
-var MAX_LEVEL int
 
-func SetDefaultParam() {
-	MAX_LEVEL = DEFAULT_MAX_LEVEL
-}
-
-func Panic(err error) {
-	if err != nil {
-		panic(err.Error())
-	}
-}
+// DEFAULT_TARGET_FILE_SIZE : Size of the Data file at which a compaction starts its next SSTable
+const DEFAULT_TARGET_FILE_SIZE = 256 << 10
 
+// LSM : Describes one tree of SSTables on the disk
+// Dir holds the Level1..LevelN directories, e.g. "Data/SSTable"
 type LSM struct {
+	Dir               string
+	MaxLevel          int
+	FalsePositiveRate float64
+	MergeOperator     MergeOperator.MergeOperator // Applies the merge operands of the same key when SSTables are merged
+	Strategy          CompactionStrategy          // Picks the SSTables merged by Compactions
+	TargetFileSize    int64                       // Compactions split their output in to SSTables of about this size
+	// Lock the user of the tree holds around every call, nil if the tree isn't shared
+	// Flush and the compactions release it while they write the SSTables, the new tables are installed with it held
+	Locker sync.Locker
+	// Live tables of every level from the oldest, as recorded in the manifest, see Load
+	levels     map[int][]*tableInfo
+	nextNumber int
+	numbers    sync.Mutex // Guards nextNumber, a compaction names its tables with the Locker released
+	manifest   *Manifest
+	// Sequence of the newest write the flushes brought to the tree, the flushes go in the order of the writes so every
+	// write of the tree up to it is in the SSTables
+	flushed uint64
+	// SSTables still read by snapshots, a compaction moves them to the Retired directory instead of removing them
+	pins     map[string]int
+	retired  map[string]string // Path prefix of the SSTable -> path prefix inside the Retired directory
+	nRetired int
 }
 
-func Compactions() {
-	// We run through all the levels of the lsm tree
-	// We start with merging the lowest levels and move our way up the tree
-	for i := 1; i < MAX_LEVEL; i++ {
-		// If MAX_LEVEL = 5, the files we can merge are in the folders: Level1, Level2, Level3, Level4
-		files, err := ioutil.ReadDir("./Data/SSTable/Level" + strconv.Itoa(i))
-		Panic(err)
-		if len(files) <= 1 {
-			// If there are no files to be merged than we exit the loop
-			break
-		}
-		// We go through all the pairs found in the level directory
-		x := 0 //  we pick the first two files than the next two and so on
-		y := 1
-		for j := 0; j < (len(files) / 2); j++ {
-			filepath1 := "./Data/SSTable/Level" + strconv.Itoa(i) + "/" + files[x].Name() + "/usertable-" + strconv.Itoa(i) + "-Data.db"
-			// We only need their Data file
-			filepath2 := "./Data/SSTable/Level" + strconv.Itoa(i) + "/" + files[y].Name() + "/usertable-" + strconv.Itoa(i) + "-Data.db"
-			// Starting the process of merging
-			Merge(filepath1, filepath2, i+1)
-			// When finished we discard the lower level files we no longer need
-			err = os.RemoveAll("./Data/SSTable/Level" + strconv.Itoa(i) + "/" + files[x].Name())
-			Panic(err)
-			err = os.RemoveAll("./Data/SSTable/Level" + strconv.Itoa(i) + "/" + files[y].Name())
-			Panic(err)
-			x += 2
-			y += 2
-		}
-	}
-
+func NewLSM(dir string, maxLevel int, falsePositiveRate float64) *LSM {
+	return &LSM{Dir: dir, MaxLevel: maxLevel, FalsePositiveRate: falsePositiveRate,
+		Strategy:       NewLeveled(DEFAULT_LEVEL1_TABLES, DEFAULT_LEVEL_BASE_BYTES, DEFAULT_LEVEL_FAN_OUT),
+		TargetFileSize: DEFAULT_TARGET_FILE_SIZE,
+		levels:         make(map[int][]*tableInfo),
+		nextNumber:     1,
+		pins:           make(map[string]int),
+		retired:        make(map[string]string)}
 }
 
-func Merge(sstable1Path string, sstable2Path string, level int) {
-	// Opens the necessary files
-	sstable1, err := os.OpenFile(sstable1Path, os.O_RDONLY, 0700)
-	Panic(err)
-	defer sstable1.Close()
-	sstable2, err := os.OpenFile(sstable2Path, os.O_RDONLY, 0700)
-	Panic(err)
-	defer sstable2.Close()
-	// Create the new files
-	newSSTableName := SSTable.CreateSSTable(level)
-	data, index, TOC, filter, metaData, summary := SSTable.CreateFilesOfSSTable(newSSTableName, level)
-	defer data.Close()
-	defer index.Close()
-	defer TOC.Close()
-	defer filter.Close()
-	defer metaData.Close()
-	defer summary.Close()
-	SSTable.CreateTOC(level, TOC)
-
-	// We approximate the number of keys found in the new file.
-	// Each key in the Data file also has +37 bytes of additional info disregarding the size of the key and value
-	// We divide the sum of number of bytes in each file and divide it by 37 resulting in an approximation of the maximal number of keys
-	fileInfo1, err := sstable1.Stat()
-	Panic(err)
-	fileInfo2, err := sstable2.Stat()
-	Panic(err)
-	approximatedSize := (fileInfo1.Size()+fileInfo2.Size())/37 + 1
-
-	// Creating the bloom filter
-	bloomFilter := bloom_filter.BloomFilter{}
-	bloomFilter.InitializeBloomFilter(int(approximatedSize), bloom_filter.FALSE_POSITIVE_RATE)
-
-	// Creating an array of hashes to be put in the merkle tree
-	hashVal := make([][20]byte, approximatedSize)
-
-	// Creating the summary structure to be written in the summary file
-	summaryStruct := SSTable.Summary{}
-	summaryStruct.Elements = make(map[string]int)
-
-	offsetData := 0
-	offsetIndex := 0
-
-	sstable1.Seek(0, 0)
-	br1 := bufio.NewReader(sstable1)
-	sstable2.Seek(0, 0)
-	br2 := bufio.NewReader(sstable2)
-
-	// We go through all the elements of Data1 and Data2 file
-	IterateElements(br1, br2, data, index, &bloomFilter, &hashVal, &summaryStruct, &offsetData, &offsetIndex)
-	// When all the files are created we check what the first key of the Data file is so we can put it in the Summary
-	data.Seek(0, 0)
-	br3 := bufio.NewReader(data)
-	_, _, _, _, _, key, _ := ReadElement(br3)
-	summaryStruct.FirstKey = string(key)
-
-	Root := merkle.BuildTreeLeaf(hashVal)
-	merkleTree := merkle.MerkleRoot{Root: Root}
-	merkle.PreorderRecursive(merkleTree.Root, metaData)
-
-	bloom_filter.WriteBloomFilter(&bloomFilter, "", filter) // Writing the bloom filter
-	SSTable.WriteSummary(&summaryStruct, summary)           // Writing the summary
+// RetiredDir : Directory holding the compacted SSTables that live snapshots still read
+func (lsm *LSM) RetiredDir() string {
+	return filepath.Join(lsm.Dir, "Retired")
 }
 
-func IterateElements(br1, br2 *bufio.Reader, data, index *os.File, bloomFilter *bloom_filter.BloomFilter, hashVal *[][20]byte, summaryStruct *SSTable.Summary, offsetData, offsetIndex *int) {
-	i := 0
-	var err error
-	var crc1, timeStamp1, tombStone1, keySize1, valueSize1, key1, value1 []byte
-	var crc2, timeStamp2, tombStone2, keySize2, valueSize2, key2, value2 []byte
-	var safeKey string
-
-	// The first initial elements to be compared
-	crc1, timeStamp1, tombStone1, keySize1, valueSize1, key1, value1 = ReadElement(br1)
-	crc2, timeStamp2, tombStone2, keySize2, valueSize2, key2, value2 = ReadElement(br2)
-	for err == nil {
-		if string(key1) < string(key2) {
-			WriteElement(crc1, timeStamp1, tombStone1, keySize1, valueSize1, key1, value1, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i)
-			i++
-			// advancing in the file
-			crc1, timeStamp1, tombStone1, keySize1, valueSize1, key1, value1 = ReadElement(br1)
-			// If we have reached the end of Data1 file we write the rest of the contents of Data2
-			if crc1 == nil {
-				WriteElement(crc2, timeStamp2, tombStone2, keySize2, valueSize2, key2, value2, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i)
-				i++
-
-				Finish(br2, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i, string(key2))
-				break
-			}
-		} else if string(key1) > string(key2) {
-			// If element of Data2 is smaller than element of Data1 than that element is written and Data2 is advanced while Data1 remains same
-			WriteElement(crc2, timeStamp2, tombStone2, keySize2, valueSize2, key2, value2, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i)
-			i++
+// RemoveRetired : Removes the SSTables retired before the database was last closed, no snapshot can read them anymore
+func (lsm *LSM) RemoveRetired() error {
+	err := os.RemoveAll(lsm.RetiredDir())
+	if err != nil {
+		return Errors.IO("remove", lsm.RetiredDir(), err)
+	}
+	return nil
+}
 
-			crc2, timeStamp2, tombStone2, keySize2, valueSize2, key2, value2 = ReadElement(br2)
-			if crc2 == nil {
-				if tombStone1[0] == 0 {
-					WriteElement(crc1, timeStamp1, tombStone1, keySize1, valueSize1, key1, value1, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i)
-					i++
-				}
-				Finish(br1, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i, string(key1))
-				break
-			}
-		} else {
-			// if current element of Data1 and Data 2 have the same key, the element with the bigger timestamp is chosen and written
-			if binary.LittleEndian.Uint32(timeStamp1) > binary.LittleEndian.Uint32(timeStamp2) {
-				if tombStone1[0] == 0 {
-					WriteElement(crc1, timeStamp1, tombStone1, keySize1, valueSize1, key1, value1, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i)
-					safeKey = string(key1)
-					i++
-				}
-			} else {
-				if tombStone2[0] == 0 {
-					WriteElement(crc2, timeStamp2, tombStone2, keySize2, valueSize2, key2, value2, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i)
-					safeKey = string(key2)
-					i++
-				}
-			}
-			// Both files are advanced
-			crc1, timeStamp1, tombStone1, keySize1, valueSize1, key1, value1 = ReadElement(br1)
-			crc2, timeStamp2, tombStone2, keySize2, valueSize2, key2, value2 = ReadElement(br2)
-			if crc1 == nil && crc2 != nil {
-				// If we reached the end of Data1 file, rest of Data2 file is written
-				if tombStone2[0] == 0 {
-					WriteElement(crc2, timeStamp2, tombStone2, keySize2, valueSize2, key2, value2, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i)
-					i++
-				}
-				Finish(br2, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i, string(key2))
-				break
-			} else if crc1 != nil && crc2 == nil {
-				// If we reached the end of Data2 file, rest of Data1 file is written
-				if tombStone1[0] == 0 {
-					WriteElement(crc1, timeStamp1, tombStone1, keySize1, valueSize1, key1, value1, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i)
-					i++
-				}
-				Finish(br1, data, index, bloomFilter, hashVal, summaryStruct, offsetData, offsetIndex, i, string(key1))
-				break
-			} else if crc1 == nil && crc2 == nil {
-				// If we reached the end of Data1 file AND the end of Data2 file, the loop is finished and the last
-				// element to be written in stored in the summary (safeKey)
-				summaryStruct.LastKey = safeKey
-				break
-			}
+// Tables : Path prefixes of all the SSTables, from the newest to the oldest
+// Level 1 comes first, on each level the tables added later come first
+func (lsm *LSM) Tables() ([]string, error) {
+	var tables []string
+	for i := 1; i <= lsm.MaxLevel; i++ {
+		for j := len(lsm.levels[i]) - 1; j >= 0; j-- {
+			tables = append(tables, lsm.levels[i][j].prefix)
 		}
 	}
+	return tables, nil
 }
 
-func WriteElement(crc, timeStamp, tombStone, keySize, valueSize, key, value []byte, data, index *os.File, bloomFilter *bloom_filter.BloomFilter, hashVal *[][20]byte, summary *SSTable.Summary, dataOffset, indexOffset *int, i int) {
-	// Write the element inside the Data file
-	binData := CollectElement(crc, timeStamp, tombStone, keySize, valueSize, key, value)
-	_, err := data.Write(binData)
-	Panic(err)
-	//Write the element inside the Index file
-	binIndex := SSTable.IndexSegmentToBinary(string(key), *dataOffset)
-	_, err = index.Write(binIndex)
-	Panic(err)
-	// Increase the dataOffset
-	*dataOffset += len(binData)
-	// Write the element in the Summary
-	summary.Elements[string(key)] = *indexOffset
-	// Increase the indexOffset
-	*indexOffset += len(binIndex)
-	(*hashVal)[i] = merkle.Hash(value)
-	bloomFilter.AddElementBF(string(key))
+// TableCount : Number of the live tables on the level
+func (lsm *LSM) TableCount(level int) int {
+	return len(lsm.levels[level])
+}
 
+// Flushed : Sequence of the newest write the flushes brought to the tree, the log records of the tree up to it don't
+// have to be replayed
+func (lsm *LSM) Flushed() uint64 {
+	return lsm.flushed
 }
 
-func Finish(br *bufio.Reader, data, index *os.File, bloomFilter *bloom_filter.BloomFilter, hashVal *[][20]byte, summary *SSTable.Summary, dataOffset, indexOffset *int, i int, lasKey string) {
-	var err error
-	_, err = br.Peek(4)
+// LastSequence : Biggest sequence number written to the SSTables
+func (lsm *LSM) LastSequence() (uint64, error) {
+	tables, err := lsm.Tables()
 	if err != nil {
-		summary.LastKey = lasKey
+		return 0, err
 	}
+	var last uint64 = 0
+	for _, table := range tables {
+		sequence, err := SSTable.ReadMaxSequence(table + "-Summary.db")
+		if err != nil {
+			return 0, err
+		}
+		if sequence > last {
+			last = sequence
+		}
+	}
+	return last, nil
+}
+
+// Pin : The SSTables stay readable through Resolve until they are unpinned, even if they are compacted meanwhile
+func (lsm *LSM) Pin(tables []string) {
+	for _, table := range tables {
+		lsm.pins[table]++
+	}
+}
 
-	for err == nil {
-		crc, timeStamp, tombStone, keySize, valueSize, key, value := ReadElement(br)
-		// When we reach the end of the file we break the loop
-		if crc == nil {
-			break
+// Unpin : Releases the SSTables, the ones that were compacted while pinned are removed
+func (lsm *LSM) Unpin(tables []string) error {
+	for _, table := range tables {
+		lsm.pins[table]--
+		if lsm.pins[table] > 0 {
+			continue
 		}
-		WriteElement(crc, timeStamp, tombStone, keySize, valueSize, key, value, data, index, bloomFilter, hashVal, summary, dataOffset, indexOffset, i)
-		// We check if we reached the end of the file, if so we store the last key written in the summary
-		_, err := br.Peek(4)
+		delete(lsm.pins, table)
+		retired, found := lsm.retired[table]
+		if !found {
+			continue
+		}
+		delete(lsm.retired, table)
+		err := os.RemoveAll(filepath.Dir(retired))
 		if err != nil {
-			summary.LastKey = string(key)
+			return Errors.IO("remove", filepath.Dir(retired), err)
 		}
 	}
+	return nil
 }
 
-func CollectElement(crc, timeStamp, tombStone, keySize, valueSize, key, value []byte) []byte {
-	size := binary.LittleEndian.Uint64(keySize) + binary.LittleEndian.Uint64(valueSize) + 37
-	element := make([]byte, 0, size)
-	element = append(element, crc...)
-	element = append(element, timeStamp...)
-	element = append(element, tombStone...)
-	element = append(element, keySize...)
-	element = append(element, valueSize...)
-	element = append(element, key...)
-	element = append(element, value...)
-	return element
+// Resolve : Current path prefix of a pinned SSTable, it is different from the original one once the SSTable is retired
+func (lsm *LSM) Resolve(table string) string {
+	retired, found := lsm.retired[table]
+	if found {
+		return retired
+	}
+	return table
 }
 
-func ReadElement(br *bufio.Reader) ([]byte, []byte, []byte, []byte, []byte, []byte, []byte) {
-	crc := make([]byte, 4)
-	_, err := br.Read(crc)
-	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil
+// remove : Removes a compacted SSTable, if it is pinned it is moved to the Retired directory instead
+func (lsm *LSM) remove(level int, name string) error {
+	dir := filepath.Join(lsm.LevelDir(level), name)
+	table := SSTable.TablePrefix(lsm.Dir, level, name)
+	if lsm.pins[table] == 0 {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return Errors.IO("remove", dir, err)
+		}
+		return nil
 	}
-	timeStamp := make([]byte, 16)
-	_, err = br.Read(timeStamp)
+	err := os.MkdirAll(lsm.RetiredDir(), 0755)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil
+		return Errors.IO("create directory", lsm.RetiredDir(), err)
 	}
-	tombStone := make([]byte, 1)
-	_, err = br.Read(tombStone)
+	// Retired tables are numbered in the order they are retired, apart from the table numbers, which are never reused
+	lsm.nRetired++
+	retiredDir := filepath.Join(lsm.RetiredDir(), "SSTable"+strconv.Itoa(lsm.nRetired))
+	err = os.Rename(dir, retiredDir)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil
+		return Errors.IO("rename", dir, err)
 	}
-	keySize := make([]byte, 8)
-	_, err = br.Read(keySize)
-	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil
+	lsm.retired[table] = filepath.Join(retiredDir, filepath.Base(table))
+	return nil
+}
+
+// LevelDir : Path to the directory of the given level
+func (lsm *LSM) LevelDir(level int) string {
+	return SSTable.LevelDir(lsm.Dir, level)
+}
+
+// Flush : Writes the memtable as a new SSTable on the first level, it is live once the manifest records it
+// The memtable isn't written to while the Locker is released
+func (lsm *LSM) Flush(s *memtable.SkipList) error {
+	name := lsm.newTableName()
+	var table *tableInfo
+	var sequence uint64
+	err := lsm.unlocked(func() error {
+		err := SSTable.Flush(lsm.Dir, name, s, lsm.FalsePositiveRate)
+		if err != nil {
+			return err
+		}
+		table, err = lsm.readTableInfo(1, name)
+		if err != nil {
+			return err
+		}
+		sequence, err = SSTable.ReadMaxSequence(table.prefix + "-Summary.db")
+		return err
+	})
+	if err == nil {
+		return lsm.apply(&versionEdit{added: []levelTable{{1, table}}, flushed: sequence})
 	}
-	valueSize := make([]byte, 8)
-	_, err = br.Read(valueSize)
-	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil
+	// The unfinished table would be removed on the next Load anyway
+	os.RemoveAll(filepath.Join(lsm.LevelDir(1), name))
+	return err
+}
+
+// unlocked : Runs the work with the Locker released, the work must not read or change the live tables
+func (lsm *LSM) unlocked(work func() error) error {
+	locker := lsm.Locker
+	if locker == nil {
+		return work()
 	}
-	key := make([]byte, binary.LittleEndian.Uint64(keySize))
-	_, err = br.Read(key)
+	locker.Unlock()
+	defer locker.Lock()
+	return work()
+}
+
+// install : Replaces the merged tables with the tables the merge wrote
+// The manifest records the change first, the merged tables are removed afterwards
+func (lsm *LSM) install(inputs []levelTable, outputs []levelTable) error {
+	err := lsm.apply(&versionEdit{added: outputs, removed: inputs})
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil
+		return err
 	}
-	value := make([]byte, binary.LittleEndian.Uint64(valueSize))
-	_, err = br.Read(value)
-	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil
+	for _, table := range inputs {
+		err = lsm.remove(table.level, table.name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compactions : Runs the compactions the strategy picks until it has nothing left to merge
+func (lsm *LSM) Compactions() error {
+	for {
+		done, err := lsm.CompactOnce()
+		if err != nil || !done {
+			return err
+		}
+	}
+}
+
+// CompactOnce : Runs one compaction the strategy picks, false is returned if there was nothing to merge
+func (lsm *LSM) CompactOnce() (bool, error) {
+	return lsm.Strategy.Compact(lsm)
+}
+
+// rangeDeleted : Reports whether one of the range tombstones deletes the version of the key
+func rangeDeleted(tombstones []memtable.RangeTombstone, key string, sequence, written uint64) bool {
+	for i := range tombstones {
+		if tombstones[i].Deletes(key, sequence, written) {
+			return true
+		}
 	}
-	return crc, timeStamp, tombStone, keySize, valueSize, key, value
+	return false
 }
@@ -0,0 +1,491 @@
+package LSM
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"project/structures/Errors"
+	"project/structures/SSTable"
+	"strconv"
+	"strings"
+)
+
+//=====================================================================================================================
+// Manifest
+
+// CURRENT_FILE : File in the directory of the tree that holds the name of the manifest in use
+const CURRENT_FILE = "CURRENT"
+
+const MANIFEST_PREFIX = "MANIFEST-"
+
+// Kinds of the entries of a version edit
+const (
+	EDIT_ADD     = 1
+	EDIT_REMOVE  = 2
+	EDIT_FLUSHED = 3
+)
+
+// Manifest : Append-only log of the changes to the live tables of the tree, the CURRENT file names the one in use
+// Only the tables the manifest lists are read, a table directory it doesn't list was left behind by a flush or a
+// compaction that didn't finish and is removed when the tree is loaded
+type Manifest struct {
+	file *os.File
+	size int64 // Bytes of the complete records, a record that fails to be written is cut off
+}
+
+// levelTable : Table of the tree together with its level
+type levelTable struct {
+	level int
+	*tableInfo
+}
+
+// versionEdit : Changes to the live tables that take effect together, written to the manifest as one record
+type versionEdit struct {
+	added      []levelTable
+	removed    []levelTable
+	nextNumber int    // Number of the next table, table numbers are never reused
+	flushed    uint64 // Sequence of the newest write a flush brought to the tree, 0 if the edit doesn't change it
+}
+
+func (edit *versionEdit) toBinary() []byte {
+	//+----------+---------------------+------------+-------------+
+	//| CRC (4B) | Payload Size (8B)   | Next (8B)  | Count (8B)  | Entries...
+	//+----------+---------------------+------------+-------------+
+	// Entry: Kind (1B) | Level (8B) | Name Size (8B) | Name (?B), followed for an added table by
+	// First Size (8B) | First (?B) | Last Size (8B) | Last (?B) | Open (1B) | Empty (1B) | Data Size (8B)
+	// The flushed sequence is an entry of its own: Kind (1B) | Sequence (8B)
+	// CRC is computed over the payload, everything after the payload size
+	count := len(edit.added) + len(edit.removed)
+	if edit.flushed > 0 {
+		count++
+	}
+	payload := appendUint64(nil, uint64(edit.nextNumber))
+	payload = appendUint64(payload, uint64(count))
+	if edit.flushed > 0 {
+		payload = append(payload, EDIT_FLUSHED)
+		payload = appendUint64(payload, edit.flushed)
+	}
+	for _, table := range edit.added {
+		payload = append(payload, EDIT_ADD)
+		payload = appendUint64(payload, uint64(table.level))
+		payload = appendString(payload, table.name)
+		payload = appendString(payload, table.first)
+		payload = appendString(payload, table.last)
+		payload = append(payload, boolByte(table.open), boolByte(table.empty))
+		payload = appendUint64(payload, uint64(table.size))
+	}
+	for _, table := range edit.removed {
+		payload = append(payload, EDIT_REMOVE)
+		payload = appendUint64(payload, uint64(table.level))
+		payload = appendString(payload, table.name)
+	}
+	record := make([]byte, 12, 12+len(payload))
+	binary.LittleEndian.PutUint32(record[0:], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint64(record[4:], uint64(len(payload)))
+	return append(record, payload...)
+}
+
+func appendUint64(data []byte, value uint64) []byte {
+	field := make([]byte, 8)
+	binary.LittleEndian.PutUint64(field, value)
+	return append(data, field...)
+}
+
+func appendString(data []byte, value string) []byte {
+	return append(appendUint64(data, uint64(len(value))), value...)
+}
+
+func boolByte(value bool) byte {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// payloadReader : Reads the fields of a record payload, ok turns false once a field goes past its end
+type payloadReader struct {
+	data []byte
+	ok   bool
+}
+
+func (r *payloadReader) bytes(n uint64) []byte {
+	if !r.ok || n > uint64(len(r.data)) {
+		r.ok = false
+		return nil
+	}
+	field := r.data[:n]
+	r.data = r.data[n:]
+	return field
+}
+
+func (r *payloadReader) uint64() uint64 {
+	field := r.bytes(8)
+	if field == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(field)
+}
+
+func (r *payloadReader) byte() byte {
+	field := r.bytes(1)
+	if field == nil {
+		return 0
+	}
+	return field[0]
+}
+
+func (r *payloadReader) string() string {
+	return string(r.bytes(r.uint64()))
+}
+
+// parseEdit : Version edit held by the payload of a record, false if the payload doesn't hold one
+func (lsm *LSM) parseEdit(payload []byte) (*versionEdit, bool) {
+	r := payloadReader{data: payload, ok: true}
+	edit := versionEdit{nextNumber: int(r.uint64())}
+	count := r.uint64()
+	for i := uint64(0); i < count && r.ok; i++ {
+		kind := r.byte()
+		if kind == EDIT_FLUSHED {
+			edit.flushed = r.uint64()
+			continue
+		}
+		table := levelTable{level: int(r.uint64()), tableInfo: &tableInfo{name: r.string()}}
+		table.prefix = SSTable.TablePrefix(lsm.Dir, table.level, table.name)
+		switch kind {
+		case EDIT_ADD:
+			table.first = r.string()
+			table.last = r.string()
+			table.open = r.byte() == 1
+			table.empty = r.byte() == 1
+			table.size = int64(r.uint64())
+			edit.added = append(edit.added, table)
+		case EDIT_REMOVE:
+			edit.removed = append(edit.removed, table)
+		default:
+			return nil, false
+		}
+	}
+	return &edit, r.ok && len(r.data) == 0
+}
+
+// readManifest : Replays the records of the manifest, the live tables of every level are returned from the oldest,
+// along with the number of the next table and the flushed sequence
+// A record cut short at the end of the file was being written when the process stopped, it never took effect
+// The first record was on the disk before CURRENT named the manifest, it has to be whole
+func (lsm *LSM) readManifest(path string) (map[int][]*tableInfo, int, uint64, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
+	if err != nil {
+		return nil, 0, 0, Errors.IO("open", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, 0, Errors.IO("stat", path, err)
+	}
+	br := bufio.NewReader(file)
+
+	levels := make(map[int][]*tableInfo)
+	nextNumber := 1
+	var flushed uint64 = 0
+	var offset int64 = 0
+	for {
+		header := make([]byte, 12)
+		_, err = io.ReadFull(br, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if offset > 0 {
+				return levels, nextNumber, flushed, nil
+			}
+			return nil, 0, 0, Errors.Corrupted(path, offset, "manifest record cut short")
+		} else if err != nil {
+			return nil, 0, 0, Errors.IO("read", path, err)
+		}
+		size := binary.LittleEndian.Uint64(header[4:])
+		if size > uint64(info.Size()-offset-12) {
+			if offset > 0 {
+				// The process stopped while the last record was being written
+				return levels, nextNumber, flushed, nil
+			}
+			return nil, 0, 0, Errors.Corrupted(path, offset, "manifest record cut short")
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(br, payload)
+		if err != nil {
+			return nil, 0, 0, Errors.IO("read", path, err)
+		}
+		end := offset + 12 + int64(size)
+		edit, ok := lsm.parseEdit(payload)
+		if binary.LittleEndian.Uint32(header) != crc32.ChecksumIEEE(payload) || !ok {
+			if end == info.Size() && offset > 0 {
+				// The last record didn't make it to the disk whole
+				return levels, nextNumber, flushed, nil
+			}
+			return nil, 0, 0, Errors.Corrupted(path, offset, "invalid manifest record")
+		}
+		applyEdit(levels, edit)
+		if edit.nextNumber > nextNumber {
+			nextNumber = edit.nextNumber
+		}
+		if edit.flushed > flushed {
+			flushed = edit.flushed
+		}
+		offset = end
+	}
+}
+
+// applyEdit : Removes the tables the edit removes and adds the ones it adds
+func applyEdit(levels map[int][]*tableInfo, edit *versionEdit) {
+	for _, removed := range edit.removed {
+		tables := levels[removed.level]
+		for i, table := range tables {
+			if table.name == removed.name {
+				levels[removed.level] = append(tables[:i:i], tables[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, added := range edit.added {
+		levels[added.level] = append(levels[added.level], added.tableInfo)
+	}
+}
+
+// readCurrent : Name of the manifest in use, empty if the tree has no CURRENT file yet
+func readCurrent(dir string) (string, error) {
+	path := filepath.Join(dir, CURRENT_FILE)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", Errors.IO("read", path, err)
+	}
+	name := strings.TrimSpace(string(content))
+	if _, ok := manifestNumber(name); !ok {
+		return "", Errors.Corrupted(path, 0, "invalid manifest name")
+	}
+	return name, nil
+}
+
+// manifestNumber : Number of the manifest from its file name "MANIFEST-<N>", false if the name isn't of that form
+func manifestNumber(name string) (int, bool) {
+	if !strings.HasPrefix(name, MANIFEST_PREFIX) {
+		return 0, false
+	}
+	number, err := strconv.Atoi(name[len(MANIFEST_PREFIX):])
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+// Load : Reads the live tables from the manifest CURRENT names and removes the table directories it doesn't list
+// A tree written before the manifest existed has no CURRENT file, its complete tables are taken over as they are
+// A new manifest that starts with the live tables is written every time and CURRENT is switched to it at once
+func (lsm *LSM) Load() error {
+	current, err := readCurrent(lsm.Dir)
+	if err != nil {
+		return err
+	}
+	number := 0
+	if current != "" {
+		number, _ = manifestNumber(current)
+		lsm.levels, lsm.nextNumber, lsm.flushed, err = lsm.readManifest(filepath.Join(lsm.Dir, current))
+		if err != nil {
+			return err
+		}
+		for _, tables := range lsm.levels {
+			for _, table := range tables {
+				_, err = os.Stat(table.prefix + "-Data.db")
+				if err != nil {
+					return Errors.Corrupted(filepath.Join(lsm.Dir, current), 0, "live table "+table.prefix+" is missing")
+				}
+			}
+		}
+	} else {
+		err = lsm.adoptTables()
+		if err != nil {
+			return err
+		}
+	}
+	for _, tables := range lsm.levels {
+		for _, table := range tables {
+			if tableNumber, ok := SSTable.TableNumber(table.name); ok && tableNumber >= lsm.nextNumber {
+				lsm.nextNumber = tableNumber + 1
+			}
+		}
+	}
+	if lsm.flushed == 0 {
+		// The manifests written before the flushed sequence was recorded, the newest table tells it
+		lsm.flushed, err = lsm.LastSequence()
+		if err != nil {
+			return err
+		}
+	}
+	err = lsm.collectGarbage()
+	if err != nil {
+		return err
+	}
+	return lsm.switchManifest(number + 1)
+}
+
+// adoptTables : Takes over the tables found in the level directories
+// Tables that can't be read were left behind by a merge that didn't finish, they are removed with the other orphans
+func (lsm *LSM) adoptTables() error {
+	lsm.levels = make(map[int][]*tableInfo)
+	lsm.nextNumber = 1
+	for level := 1; level <= lsm.MaxLevel; level++ {
+		names, err := SSTable.ListTables(lsm.Dir, level)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			table, err := lsm.readTableInfo(level, name)
+			if err != nil {
+				continue
+			}
+			lsm.levels[level] = append(lsm.levels[level], table)
+		}
+	}
+	return nil
+}
+
+// collectGarbage : Removes the table directories the manifest doesn't list and the tables that were being written
+func (lsm *LSM) collectGarbage() error {
+	for level := 1; level <= lsm.MaxLevel; level++ {
+		err := SSTable.RemoveTemporary(lsm.Dir, level)
+		if err != nil {
+			return err
+		}
+		live := make(map[string]bool)
+		for _, table := range lsm.levels[level] {
+			live[table.name] = true
+		}
+		names, err := SSTable.ListTables(lsm.Dir, level)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if live[name] {
+				continue
+			}
+			dir := filepath.Join(lsm.LevelDir(level), name)
+			err = os.RemoveAll(dir)
+			if err != nil {
+				return Errors.IO("remove", dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// switchManifest : Writes a new manifest holding the live tables and points CURRENT to it, the old ones are removed
+func (lsm *LSM) switchManifest(number int) error {
+	name := MANIFEST_PREFIX + strconv.Itoa(number)
+	path := filepath.Join(lsm.Dir, name)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return Errors.IO("create", path, err)
+	}
+	manifest := Manifest{file: file}
+	snapshot := versionEdit{nextNumber: lsm.nextNumber, flushed: lsm.flushed}
+	for level, tables := range lsm.levels {
+		for _, table := range tables {
+			snapshot.added = append(snapshot.added, levelTable{level, table})
+		}
+	}
+	err = manifest.append(&snapshot)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// CURRENT is replaced by a rename, it names either the old manifest or the new one
+	tmpPath := filepath.Join(lsm.Dir, CURRENT_FILE+".tmp")
+	err = ioutil.WriteFile(tmpPath, []byte(name+"\n"), 0644)
+	if err != nil {
+		file.Close()
+		return Errors.IO("write", tmpPath, err)
+	}
+	err = SSTable.SyncPath(tmpPath)
+	if err == nil {
+		err = Errors.IO("rename", tmpPath, os.Rename(tmpPath, filepath.Join(lsm.Dir, CURRENT_FILE)))
+	}
+	if err == nil {
+		err = SSTable.SyncPath(lsm.Dir)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if lsm.manifest != nil {
+		lsm.manifest.file.Close()
+	}
+	lsm.manifest = &manifest
+
+	files, err := ioutil.ReadDir(lsm.Dir)
+	if err != nil {
+		return Errors.IO("read directory", lsm.Dir, err)
+	}
+	for _, file := range files {
+		if old, ok := manifestNumber(file.Name()); ok && old != number {
+			err = os.Remove(filepath.Join(lsm.Dir, file.Name()))
+			if err != nil {
+				return Errors.IO("remove", file.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// append : Writes the edit to the end of the manifest and waits for it to reach the disk
+func (m *Manifest) append(edit *versionEdit) error {
+	record := edit.toBinary()
+	_, err := m.file.WriteAt(record, m.size)
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		// A partial record would end up in the middle of the manifest once the next one is written
+		m.file.Truncate(m.size)
+		return Errors.IO("write", m.file.Name(), err)
+	}
+	m.size += int64(len(record))
+	return nil
+}
+
+// apply : Records the edit in the manifest, the live tables change only once it is on the disk
+func (lsm *LSM) apply(edit *versionEdit) error {
+	lsm.numbers.Lock()
+	edit.nextNumber = lsm.nextNumber
+	lsm.numbers.Unlock()
+	err := lsm.manifest.append(edit)
+	if err != nil {
+		return err
+	}
+	applyEdit(lsm.levels, edit)
+	if edit.flushed > lsm.flushed {
+		lsm.flushed = edit.flushed
+	}
+	return nil
+}
+
+// newTableName : Name of the next table of the tree
+func (lsm *LSM) newTableName() string {
+	lsm.numbers.Lock()
+	defer lsm.numbers.Unlock()
+	name := SSTable.TableName(lsm.nextNumber)
+	lsm.nextNumber++
+	return name
+}
+
+// Close : Closes the manifest
+func (lsm *LSM) Close() error {
+	if lsm.manifest == nil {
+		return nil
+	}
+	file := lsm.manifest.file
+	lsm.manifest = nil
+	return Errors.IO("close", file.Name(), file.Close())
+}
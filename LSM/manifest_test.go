@@ -0,0 +1,141 @@
+package LSM
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"project/structures/Errors"
+	"project/structures/SSTable"
+	"project/structures/memtable"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTree : Tree in the directory with the level directories created, loaded from its manifest
+func loadTree(t *testing.T, dir string) *LSM {
+	t.Helper()
+	for level := 1; level <= DEFAULT_MAX_LEVEL; level++ {
+		err := os.MkdirAll(SSTable.LevelDir(dir, level), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lsm := NewLSM(dir, DEFAULT_MAX_LEVEL, 0.01)
+	lsm.Strategy = NewLeveled(2, DEFAULT_LEVEL_BASE_BYTES, DEFAULT_LEVEL_FAN_OUT)
+	err := lsm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lsm.Close() })
+	return lsm
+}
+
+// flushKeys : Flushes a memtable holding the keys to a new table of the tree
+func flushKeys(t *testing.T, lsm *LSM, sequence uint64, keys ...string) {
+	t.Helper()
+	mem := memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0)
+	for _, key := range keys {
+		mem.Insert(key, []byte("v"), 1, sequence)
+		sequence++
+	}
+	err := lsm.Flush(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// currentManifest : Path to the manifest CURRENT names
+func currentManifest(t *testing.T, dir string) string {
+	t.Helper()
+	name, err := readCurrent(dir)
+	if err != nil || name == "" {
+		t.Fatalf("CURRENT names %q (%v)", name, err)
+	}
+	return filepath.Join(dir, name)
+}
+
+func TestManifestReplay(t *testing.T) {
+	dir := t.TempDir()
+	lsm := loadTree(t, dir)
+	flushKeys(t, lsm, 1, "a", "b")
+	flushKeys(t, lsm, 3, "c", "d")
+	err := lsm.Compactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushKeys(t, lsm, 5, "e")
+	live, _ := lsm.Tables()
+	lsm.Close()
+
+	// A table a merge didn't finish, it was never recorded
+	err = SSTable.Flush(dir, SSTable.TableName(100), memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0), 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record the process was writing when it stopped
+	file, err := os.OpenFile(currentManifest(t, dir), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{1, 2, 3, 4, 100, 0, 0})
+	file.Close()
+
+	lsm = loadTree(t, dir)
+	tables, _ := lsm.Tables()
+	if !reflect.DeepEqual(tables, live) {
+		t.Fatalf("tables after the replay are %v, expected %v", tables, live)
+	}
+	if lsm.TableCount(1) != 1 || lsm.TableCount(2) != 1 {
+		t.Fatalf("levels hold %d and %d tables, expected one on each", lsm.TableCount(1), lsm.TableCount(2))
+	}
+	_, err = os.Stat(SSTable.TablePrefix(dir, 1, SSTable.TableName(100)) + "-Data.db")
+	if !os.IsNotExist(err) {
+		t.Fatal("the unrecorded table was not removed")
+	}
+	// Table numbers aren't reused
+	flushKeys(t, lsm, 6, "f")
+	tables, _ = lsm.Tables()
+	for _, table := range live {
+		if table == tables[0] {
+			t.Fatalf("the new table reused the name of %s", table)
+		}
+	}
+	manifests := 0
+	files, _ := os.ReadDir(dir)
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), MANIFEST_PREFIX) {
+			manifests++
+		}
+	}
+	if manifests != 1 {
+		t.Fatalf("%d manifests were left, expected the current one only", manifests)
+	}
+}
+
+func TestManifestRecordBeforeTheEnd(t *testing.T) {
+	dir := t.TempDir()
+	lsm := loadTree(t, dir)
+	flushKeys(t, lsm, 1, "a")
+	flushKeys(t, lsm, 2, "b")
+	lsm.Close()
+
+	path := currentManifest(t, dir)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The payload of the second record, the first flush, doesn't match its checksum anymore
+	first := 12 + int(binary.LittleEndian.Uint64(content[4:]))
+	content[first+12] ^= 0xff
+	err = os.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm = NewLSM(dir, DEFAULT_MAX_LEVEL, 0.01)
+	err = lsm.Load()
+	if !errors.Is(err, Errors.ErrCorrupted) {
+		t.Fatalf("load returned %v, expected the broken record", err)
+	}
+}
@@ -0,0 +1,409 @@
+package LSM
+
+import (
+	"container/heap"
+	"errors"
+	"os"
+	"path/filepath"
+	"project/structures/MergeOperator"
+	"project/structures/SSTable"
+	"project/structures/memtable"
+	"sort"
+	"time"
+)
+
+//=====================================================================================================================
+// Merge
+
+// errInterleaved : A table outside the merge holds a version of a key between the versions the merge would fold
+var errInterleaved = errors.New("a version outside the merge falls between the merged versions")
+
+// mergeSource : Data file of one merged table, order is its position among the inputs
+type mergeSource struct {
+	it    *SSTable.DataIterator
+	order int
+}
+
+// mergeHeap : Sources ordered by the key they are positioned on, the newest version of a key comes first
+// On equal versions the source that comes first among the inputs wins
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int {
+	return len(h)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].it.Element(), h[j].it.Element()
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	if a.NewerThan(b) {
+		return true
+	}
+	if b.NewerThan(a) {
+		return false
+	}
+	return h[i].order < h[j].order
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*mergeSource))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	source := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return source
+}
+
+// mergeTables : Merges any number of tables in to new SSTables on the level, the new tables are returned
+// They aren't live until LSM.install records them in the manifest
+// For every key only the newest version is kept, merge operands are applied on top of the older versions
+// The output is split in to several SSTables, the next one is started once a Data file reaches TargetFileSize
+// At the bottom no older version of the keys is left outside the inputs, the tombstones, the range tombstones and the
+// expired elements are dropped there since there is nothing left for them to delete
+// outside are the overlapping tables whose versions might be newer than some of the inputs and older than others,
+// errInterleaved is returned if folding the operands of a key would skip one of their versions
+func (lsm *LSM) mergeTables(tables []levelTable, level int, bottom bool, outside []levelTable) ([]levelTable, error) {
+	now := time.Now().Unix()
+	var tombstones []memtable.RangeTombstone
+	var totalSize int64 = 0
+	h := make(mergeHeap, 0, len(tables))
+	defer func() {
+		for _, source := range h {
+			source.it.Close()
+		}
+	}()
+	for i, table := range tables {
+		found, err := SSTable.ReadRangeTombstones(table.prefix + "-RangeDel.db")
+		if err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, found...)
+		totalSize += table.size
+		it, err := SSTable.OpenDataIterator(table.prefix + "-Data.db")
+		if err != nil {
+			return nil, err
+		}
+		if it.Element() == nil {
+			it.Close()
+			continue
+		}
+		h = append(h, &mergeSource{it: it, order: i})
+	}
+	heap.Init(&h)
+
+	out := mergeOutput{lsm: lsm, level: level, target: lsm.TargetFileSize}
+	if out.target <= 0 {
+		out.target = DEFAULT_TARGET_FILE_SIZE
+	}
+	// Each element takes at least DATA_HEADER_SIZE bytes, which bounds the number of keys of one output table
+	out.expected = int(totalSize/SSTable.DATA_HEADER_SIZE) + 1
+	if limit := int(out.target/SSTable.DATA_HEADER_SIZE) + 1; limit < out.expected {
+		out.expected = limit
+	}
+	if !bottom {
+		out.tombstones = tombstones
+	}
+	interleaved := outsideTables{tables: outside}
+	defer interleaved.close()
+	err := lsm.mergeElements(&h, &out, tombstones, now, bottom, &interleaved)
+	if err == nil {
+		err = out.close()
+	}
+	var outputs []levelTable
+	for _, writer := range out.finished {
+		if err != nil {
+			break
+		}
+		var table *tableInfo
+		table, err = lsm.readTableInfo(level, writer.Name)
+		outputs = append(outputs, levelTable{level, table})
+	}
+	if err != nil {
+		out.abort()
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// compactTables : Merges the tables in to the level and replaces them with the merged ones
+// The merge runs with the Locker released, only one compaction of the tree may run at a time
+func (lsm *LSM) compactTables(inputs []levelTable, level int, bottom bool, outside []levelTable) error {
+	var outputs []levelTable
+	err := lsm.unlocked(func() error {
+		var err error
+		outputs, err = lsm.mergeTables(inputs, level, bottom, outside)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = lsm.install(inputs, outputs)
+	if err != nil {
+		for _, table := range outputs {
+			os.RemoveAll(filepath.Dir(table.prefix))
+		}
+	}
+	return err
+}
+
+// mergeElements : Writes one element for every key the sources hold, taking the smallest key off the heap each time
+func (lsm *LSM) mergeElements(h *mergeHeap, out *mergeOutput, tombstones []memtable.RangeTombstone, now int64, bottom bool, outside *outsideTables) error {
+	for h.Len() > 0 {
+		key := (*h)[0].it.Element().Key
+		var versions []*SSTable.Element
+		for h.Len() > 0 && (*h)[0].it.Element().Key == key {
+			source := (*h)[0]
+			versions = append(versions, source.it.Element())
+			err := source.it.Next()
+			if err != nil {
+				return err
+			}
+			if source.it.Element() == nil {
+				heap.Pop(h)
+				source.it.Close()
+			} else {
+				heap.Fix(h, 0)
+			}
+		}
+		element, err := collapse(versions, lsm.MergeOperator, tombstones, now, bottom, outside)
+		if err != nil {
+			return err
+		}
+		if element != nil {
+			err = out.add(element)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeOutput : SSTables written by one merge, each one covers the keys from its first key up to the first key of
+// the next one
+type mergeOutput struct {
+	lsm        *LSM
+	level      int
+	target     int64
+	expected   int
+	tombstones []memtable.RangeTombstone
+	writer     *SSTable.Writer
+	low        string // First key covered by the current table, empty for the first one
+	finished   []*SSTable.Writer
+}
+
+// add : Writes the element to the current table, the next table is started if the current one is full
+func (out *mergeOutput) add(element *SSTable.Element) error {
+	if out.writer != nil && out.writer.Size() >= out.target {
+		err := out.finish(element.Key)
+		if err != nil {
+			return err
+		}
+		out.low = element.Key
+	}
+	if out.writer == nil {
+		writer, err := SSTable.NewWriter(out.lsm.Dir, out.level, out.lsm.newTableName(), out.expected, out.lsm.FalsePositiveRate)
+		if err != nil {
+			return err
+		}
+		out.writer = writer
+	}
+	return out.writer.Add(element)
+}
+
+// finish : Finishes the current table with the parts of the range tombstones that fall in to its keys
+func (out *mergeOutput) finish(high string) error {
+	writer := out.writer
+	out.writer = nil
+	err := writer.Finish(clipTombstones(out.tombstones, out.low, high))
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	out.finished = append(out.finished, writer)
+	return nil
+}
+
+// close : Finishes the last table, a table is written for the range tombstones alone if there were no elements
+func (out *mergeOutput) close() error {
+	if out.writer == nil && len(out.finished) == 0 && len(out.tombstones) > 0 {
+		writer, err := SSTable.NewWriter(out.lsm.Dir, out.level, out.lsm.newTableName(), 1, out.lsm.FalsePositiveRate)
+		if err != nil {
+			return err
+		}
+		out.writer = writer
+	}
+	if out.writer == nil {
+		return nil
+	}
+	return out.finish("")
+}
+
+// abort : Removes every table the merge wrote, the inputs still hold all the data
+func (out *mergeOutput) abort() {
+	if out.writer != nil {
+		out.writer.Abort()
+		out.writer = nil
+	}
+	for _, writer := range out.finished {
+		writer.Abort()
+	}
+	out.finished = nil
+}
+
+// clipTombstones : Parts of the range tombstones that fall in to [low, high), an empty high means there is no bound
+func clipTombstones(tombstones []memtable.RangeTombstone, low, high string) []memtable.RangeTombstone {
+	var clipped []memtable.RangeTombstone
+	for _, tombstone := range tombstones {
+		if tombstone.Start < low {
+			tombstone.Start = low
+		}
+		if high != "" && (tombstone.End == "" || tombstone.End > high) {
+			tombstone.End = high
+		}
+		if tombstone.End != "" && tombstone.Start >= tombstone.End {
+			continue
+		}
+		clipped = append(clipped, tombstone)
+	}
+	return clipped
+}
+
+// collapse : The one element that stands for all the versions of a key, nil if nothing of the key has to be kept
+// Above the bottom tombstones are kept since older versions of the key might be left on the lower levels, an expired
+// element becomes a tombstone for the same reason
+func collapse(versions []*SSTable.Element, op MergeOperator.MergeOperator, tombstones []memtable.RangeTombstone, now int64, bottom bool, outside *outsideTables) (*SSTable.Element, error) {
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].NewerThan(versions[j]) })
+	live := versions[:0]
+	for _, version := range versions {
+		// The versions deleted by a range tombstone are dropped, the tombstone stands for them
+		if !rangeDeleted(tombstones, version.Key, version.Sequence, version.Timestamp) {
+			live = append(live, version)
+		}
+	}
+	if len(live) == 0 {
+		return nil, nil
+	}
+	rangeDeletedAny := len(live) != len(versions)
+	newest := *live[0]
+	if newest.Operand {
+		var existing []byte = nil
+		var operands [][]byte
+		base := false
+		oldest := live[0]
+		for _, version := range live {
+			oldest = version
+			if !version.Operand {
+				if !version.Tombstone && !version.Expired(now) {
+					existing = version.Value
+				}
+				base = true
+				break
+			}
+			// Operands are applied from the oldest
+			operands = append([][]byte{version.Value}, operands...)
+		}
+		if !bottom && (base || rangeDeletedAny || len(operands) > 1) {
+			// Without a base the versions the range tombstones don't delete are the ones the operands are applied to
+			if !base && rangeDeletedAny {
+				oldest = nil
+			}
+			err := outside.check(newest.Key, oldest, live[0], tombstones)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !base && !rangeDeletedAny && !bottom {
+			// The key might have an older value on the lower levels, the operands are combined in to one operand
+			if len(operands) > 1 {
+				value, err := MergeOperator.Apply(op, newest.Key, operands[0], operands[1:])
+				if err != nil {
+					return nil, err
+				}
+				newest.Value = value
+			}
+		} else {
+			value, err := MergeOperator.Apply(op, newest.Key, existing, operands)
+			if err != nil {
+				return nil, err
+			}
+			newest.Operand = false
+			newest.Value = value
+		}
+	}
+	if !newest.Tombstone && newest.Expired(now) {
+		newest.Tombstone = true
+		newest.Operand = false
+		newest.Value = []byte{}
+		newest.Expiry = 0
+	}
+	if bottom && newest.Tombstone {
+		return nil, nil
+	}
+	return &newest, nil
+}
+
+// outsideTables : Tables that overlap a merge without taking part in it, their versions might be of any age
+// They are opened only once the operands of a key are folded
+type outsideTables struct {
+	tables  []levelTable
+	readers []*SSTable.Reader
+	opened  bool
+}
+
+// check : errInterleaved if a table holds a version of the key, or a range tombstone over it, that is older than newest
+// and newer than oldest, the operands folded from newest down to oldest would skip it
+// A nil oldest stands for every version the range tombstones of the merge don't delete
+func (o *outsideTables) check(key string, oldest, newest *SSTable.Element, tombstones []memtable.RangeTombstone) error {
+	if len(o.tables) == 0 {
+		return nil
+	}
+	if !o.opened {
+		o.opened = true
+		for _, table := range o.tables {
+			reader, err := SSTable.OpenReader(table.prefix)
+			if err != nil {
+				return err
+			}
+			o.readers = append(o.readers, reader)
+		}
+	}
+	between := func(sequence, timestamp uint64) bool {
+		if !SSTable.NewerVersion(newest.Sequence, newest.Timestamp, sequence, timestamp) {
+			return false
+		}
+		if oldest == nil {
+			return !rangeDeleted(tombstones, key, sequence, timestamp)
+		}
+		return SSTable.NewerVersion(sequence, timestamp, oldest.Sequence, oldest.Timestamp)
+	}
+	for _, reader := range o.readers {
+		element, err := reader.Get(key)
+		if err != nil {
+			return err
+		}
+		if element != nil && between(element.Sequence, element.Timestamp) {
+			return errInterleaved
+		}
+		for i := range reader.Tombstones {
+			tombstone := &reader.Tombstones[i]
+			if tombstone.Covers(key) && between(tombstone.Sequence(), tombstone.Time()) {
+				return errInterleaved
+			}
+		}
+	}
+	return nil
+}
+
+func (o *outsideTables) close() {
+	for _, reader := range o.readers {
+		reader.Close()
+	}
+}
@@ -0,0 +1,188 @@
+package LSM
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrUnknownStrategy = errors.New("unknown compaction strategy")
+
+// Names of the compaction strategies in the configuration
+const (
+	PAIRWISE    = "pairwise"
+	LEVELED     = "leveled"
+	SIZE_TIERED = "size-tiered"
+)
+
+const DEFAULT_TIER_THRESHOLD = 4
+
+// BUCKET_HIGH : A table up to this many times bigger than the average table of a bucket still belongs to the bucket
+const BUCKET_HIGH = 1.5
+
+// CompactionStrategy : Policy that decides which SSTables of the tree are merged together
+type CompactionStrategy interface {
+	// Compact : Runs one compaction, false is returned if there was nothing to merge
+	Compact(lsm *LSM) (bool, error)
+}
+
+// StrategyOptions : Parameters of all the strategies, each one uses its own
+type StrategyOptions struct {
+	Level1Tables   int
+	LevelBaseBytes int64
+	LevelFanOut    int
+	TierThreshold  int
+}
+
+// NewStrategy : Strategy with the given name, ErrUnknownStrategy if there is no such strategy
+// Parameters left at zero take their default values
+func NewStrategy(name string, options StrategyOptions) (CompactionStrategy, error) {
+	if options.Level1Tables <= 0 {
+		options.Level1Tables = DEFAULT_LEVEL1_TABLES
+	}
+	if options.LevelBaseBytes <= 0 {
+		options.LevelBaseBytes = DEFAULT_LEVEL_BASE_BYTES
+	}
+	if options.LevelFanOut <= 0 {
+		options.LevelFanOut = DEFAULT_LEVEL_FAN_OUT
+	}
+	// A bucket of one table would be merged in to one table over and over
+	if options.TierThreshold < 2 {
+		options.TierThreshold = DEFAULT_TIER_THRESHOLD
+	}
+	switch name {
+	case PAIRWISE:
+		return Pairwise{}, nil
+	case LEVELED:
+		return NewLeveled(options.Level1Tables, options.LevelBaseBytes, options.LevelFanOut), nil
+	case SIZE_TIERED:
+		return SizeTiered{Threshold: options.TierThreshold}, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownStrategy, name)
+}
+
+//=====================================================================================================================
+// Pairwise
+
+// Pairwise : Merges the tables of a level two at a time in to the next level, regardless of their size
+// The first level that holds at least two tables is compacted, an odd table stays where it is
+type Pairwise struct{}
+
+func (Pairwise) Compact(lsm *LSM) (bool, error) {
+	// If MaxLevel = 5, the files we can merge are in the folders: Level1, Level2, Level3, Level4
+	for i := 1; i < lsm.MaxLevel; i++ {
+		tables := lsm.levels[i]
+		if len(tables) <= 1 {
+			continue
+		}
+		// The two oldest tables, the newer one comes first so it wins on equal versions
+		inputs := []levelTable{{i, tables[1]}, {i, tables[0]}}
+		err := lsm.compactOutside(inputs, i+1)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+//=====================================================================================================================
+// Size tiered
+
+// SizeTiered : Groups the tables of similar size in to buckets, a bucket is merged once it holds Threshold tables
+// The merged table goes one level below the deepest of its inputs, the last level keeps its own merges
+// The tables of a bucket aren't next to each other in age, a table left out of it can hold a version in between them
+type SizeTiered struct {
+	Threshold int
+}
+
+func (st SizeTiered) Compact(lsm *LSM) (bool, error) {
+	var tables []levelTable
+	for level := 1; level <= lsm.MaxLevel; level++ {
+		for _, table := range lsm.levelTables(level) {
+			tables = append(tables, levelTable{level, table})
+		}
+	}
+	sort.SliceStable(tables, func(i, j int) bool { return tables[i].size < tables[j].size })
+
+	// Buckets are made going from the smallest table, so the smallest tables are merged first
+	var buckets [][]levelTable
+	var bucketSize int64 = 0
+	for _, table := range tables {
+		last := len(buckets) - 1
+		if last < 0 || float64(table.size) > float64(bucketSize)/float64(len(buckets[last]))*BUCKET_HIGH {
+			// The table is too big for the bucket, it starts a new one
+			buckets = append(buckets, nil)
+			bucketSize = 0
+			last++
+		}
+		buckets[last] = append(buckets[last], table)
+		bucketSize += table.size
+	}
+	var bucket []levelTable
+	for _, candidate := range buckets {
+		if len(candidate) >= st.Threshold && !sortedRun(lsm, candidate) {
+			bucket = candidate
+			break
+		}
+	}
+	if bucket == nil {
+		return false, nil
+	}
+
+	output := 1
+	for _, table := range bucket {
+		if table.level+1 > output {
+			output = table.level + 1
+		}
+	}
+	if output > lsm.MaxLevel {
+		output = lsm.MaxLevel
+	}
+	err := lsm.compactUnordered(bucket, output)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sortedRun : Reports whether the tables are all on the last level and none of them overlap
+// A merge splits its output in to tables of the same size, merging them again would only write them once more
+func sortedRun(lsm *LSM, tables []levelTable) bool {
+	for i, table := range tables {
+		if table.level != lsm.MaxLevel {
+			return false
+		}
+		for _, other := range tables[:i] {
+			if table.overlaps(other.tableInfo) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compactOutside : Merges the tables in to the level, tombstones are dropped if no other table of the tree overlaps them
+// The strategy doesn't keep the older versions on the lower levels, the tables of every level might hold them
+func (lsm *LSM) compactOutside(tables []levelTable, level int) error {
+	return lsm.compactTables(tables, level, !lsm.overlapsOutside(tables, 1), nil)
+}
+
+// compactUnordered : Merges the tables in to the level when the tables outside them might hold versions of any age
+// The operands of a key aren't folded past a version left outside, the overlapping tables join the merge instead and
+// the merge is run again, the output goes one level below the deepest of them
+func (lsm *LSM) compactUnordered(tables []levelTable, level int) error {
+	for {
+		outside := lsm.outside(tables, 1)
+		err := lsm.compactTables(tables, level, len(outside) == 0, outside)
+		if err != errInterleaved {
+			return err
+		}
+		for _, table := range outside {
+			if table.level+1 > level && table.level < lsm.MaxLevel {
+				level = table.level + 1
+			}
+		}
+		tables = append(tables, outside...)
+	}
+}
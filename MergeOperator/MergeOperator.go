@@ -0,0 +1,65 @@
+package MergeOperator
+
+import (
+	"errors"
+	"strconv"
+)
+
+var ErrNoMergeOperator = errors.New("no merge operator is registered")
+var ErrInvalidOperand = errors.New("invalid merge operand")
+
+// MergeOperator : Combines the merge operands written with DB.Merge with the value of the key
+// existing is nil when the key doesn't exist, was deleted or expired
+// Operands written before the value of the key is known are combined with each other by the same call,
+// so Merge(Merge(a, b), c) has to give the same result as Merge(a, Merge(b, c))
+type MergeOperator interface {
+	Merge(key string, existing, operand []byte) ([]byte, error)
+}
+
+// Apply : Applies the operands on top of the existing value, the operands are ordered from the oldest to the newest
+func Apply(op MergeOperator, key string, existing []byte, operands [][]byte) ([]byte, error) {
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+	var err error
+	for _, operand := range operands {
+		existing, err = op.Merge(key, existing, operand)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+// Counter : Values and operands are integers written as decimal text, the operands are added to the value
+type Counter struct{}
+
+func (Counter) Merge(key string, existing, operand []byte) ([]byte, error) {
+	delta, err := strconv.ParseInt(string(operand), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidOperand
+	}
+	var number int64 = 0
+	if existing != nil {
+		number, err = strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, ErrInvalidOperand
+		}
+	}
+	return []byte(strconv.FormatInt(number+delta, 10)), nil
+}
+
+// Append : The operands are appended to the value, separated by the delimiter
+type Append struct {
+	Delimiter string
+}
+
+func (a Append) Merge(key string, existing, operand []byte) ([]byte, error) {
+	if existing == nil {
+		return operand, nil
+	}
+	value := make([]byte, 0, len(existing)+len(a.Delimiter)+len(operand))
+	value = append(value, existing...)
+	value = append(value, a.Delimiter...)
+	return append(value, operand...), nil
+}
@@ -0,0 +1,158 @@
+package ReadPath
+
+import (
+	"errors"
+	"hash/crc32"
+	"project/structures/Errors"
+	"project/structures/LSM"
+	"project/structures/SSTable"
+	"project/structures/lru"
+	"project/structures/memtable"
+	"sort"
+	"time"
+)
+
+// MultiGet : Reads many keys at once, the results are in the order of the keys
+// A key that doesn't exist or whose newest element expired gets nil, a deleted key gets its tombstone like in ReadPath
+// Any other error the read of a key fails with is returned in errs under the index of the key, its element is nil
+// Keys that the memtable and the cache don't answer are sorted and every SSTable is opened once for all of them
+func MultiGet(tree *LSM.LSM, memtables []*memtable.SkipList, cache *lru.Cache, keys []string) ([]*ElementInfo, []error) {
+	now := time.Now().Unix()
+	found := make(map[string]*ElementInfo, len(keys))
+	failed := make(map[string]error)
+	memElements := make(map[string][]*ElementInfo)
+	var pending []string
+	// resolved : Keeps the element the read of the key sees, a key that doesn't exist is kept as nil
+	resolved := func(key string, element *ElementInfo, err error) {
+		if errors.Is(err, Errors.ErrNotFound) {
+			found[key] = nil
+		} else if err != nil {
+			failed[key] = err
+		} else {
+			found[key] = element
+			cache.Add(key, cacheInformation(element))
+		}
+	}
+	for _, key := range keys {
+		if _, seen := found[key]; seen {
+			continue
+		}
+		if _, seen := failed[key]; seen {
+			continue
+		}
+		if _, seen := memElements[key]; seen {
+			continue
+		}
+		foundMemtables := CheckMemtables(memtables, key)
+		if len(foundMemtables) == 0 {
+			if cached := CheckCache(cache, key); cached != nil {
+				found[key] = cached
+				continue
+			}
+		} else if !foundMemtables[len(foundMemtables)-1].Operand {
+			element, err := resolveVersions(foundMemtables, nil, tree.MergeOperator, now)
+			resolved(key, element, err)
+			continue
+		}
+		// Merge operands in the memtables have to be applied on the SSTables
+		memElements[key] = foundMemtables
+		pending = append(pending, key)
+	}
+
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		tables, err := tree.Tables()
+		var versions map[string][]*ElementInfo
+		tableErrs := make(map[string]error)
+		if err == nil {
+			versions, tableErrs = CheckTablesMany(tables, pending)
+		}
+		for _, key := range pending {
+			if err != nil {
+				// None of the keys left could be read from the SSTables
+				failed[key] = err
+				continue
+			}
+			if tableErrs[key] != nil {
+				failed[key] = tableErrs[key]
+				continue
+			}
+			element, keyErr := resolveVersions(memElements[key], versions[key], tree.MergeOperator, now)
+			resolved(key, element, keyErr)
+		}
+	}
+
+	results := make([]*ElementInfo, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		results[i] = found[key]
+		errs[i] = failed[key]
+	}
+	return results, errs
+}
+
+// CheckTablesMany : Returns the elements of every key in the given SSTables, ordered from the newest like CheckTables
+// The keys have to be sorted, every SSTable is opened once and its filter, summary and range tombstones are read once
+// The error the read of a key failed with is returned under the key, the other keys are still read
+// A table that can't be opened fails every key that didn't fail yet, as CheckTables would for each of them
+func CheckTablesMany(tables []string, keys []string) (map[string][]*ElementInfo, map[string]error) {
+	versions := make(map[string][]*ElementInfo, len(keys))
+	errs := make(map[string]error)
+	for _, table := range tables {
+		reader, err := SSTable.OpenReader(table)
+		if err == nil {
+			checkReader(reader, keys, versions, errs)
+			err = reader.Close()
+		}
+		if err != nil {
+			for _, key := range keys {
+				if errs[key] == nil {
+					errs[key] = err
+				}
+			}
+		}
+	}
+	for _, key := range keys {
+		sortVersions(versions[key])
+	}
+	return versions, errs
+}
+
+// checkReader : Adds the elements of the keys found in one SSTable, range tombstones included, to the versions
+// The keys that already failed are left out, a key whose element can't be read gets its error in errs
+func checkReader(reader *SSTable.Reader, keys []string, versions map[string][]*ElementInfo, errs map[string]error) {
+	for _, key := range keys {
+		if errs[key] != nil {
+			continue
+		}
+		element, err := reader.Get(key)
+		if err != nil {
+			errs[key] = err
+			continue
+		}
+		if element != nil {
+			versions[key] = append(versions[key], elementInfo(element))
+		}
+		for i := range reader.Tombstones {
+			if reader.Tombstones[i].Covers(key) {
+				versions[key] = append(versions[key], rangeDeleted(key, &reader.Tombstones[i]))
+			}
+		}
+	}
+}
+
+// elementInfo : ElementInfo of an element read from a Data file
+func elementInfo(element *SSTable.Element) *ElementInfo {
+	EI := ElementInfo{}
+	EI.CRC = crc32.ChecksumIEEE(element.Value)
+	EI.Timestamp = element.Timestamp
+	EI.Sequence = element.Sequence
+	EI.Tombstone = element.Tombstone
+	EI.Operand = element.Operand
+	EI.KeySize = uint64(len([]byte(element.Key)))
+	EI.ValueSize = uint64(len(element.Value))
+	EI.Key = element.Key
+	EI.Value = element.Value
+	EI.Expiry = element.Expiry
+	return &EI
+}
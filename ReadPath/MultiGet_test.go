@@ -0,0 +1,130 @@
+package ReadPath
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"project/structures/Errors"
+	"project/structures/LSM"
+	"project/structures/MergeOperator"
+	"project/structures/SSTable"
+	"project/structures/lru"
+	"project/structures/memtable"
+	"testing"
+)
+
+// openTree : Tree in a temporary directory with the merge operator, closed when the test ends
+func openTree(t *testing.T, op MergeOperator.MergeOperator) *LSM.LSM {
+	t.Helper()
+	dir := t.TempDir()
+	for level := 1; level <= LSM.DEFAULT_MAX_LEVEL; level++ {
+		err := os.MkdirAll(SSTable.LevelDir(dir, level), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree := LSM.NewLSM(dir, LSM.DEFAULT_MAX_LEVEL, 0.01)
+	tree.MergeOperator = op
+	err := tree.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tree.Close() })
+	return tree
+}
+
+func TestMultiGetReturnsTheErrorOfEachKey(t *testing.T) {
+	tree := openTree(t, MergeOperator.Counter{})
+	flushed := memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0)
+	flushed.Insert("bad", []byte("abc"), 1, 1)
+	flushed.Insert("good", []byte("10"), 1, 2)
+	err := tree.Flush(flushed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0)
+	older.Insert("mem-bad", []byte("abc"), 1, 3)
+	// The counter can't add the operands to a value that isn't a number
+	mem := memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0)
+	for i, key := range []string{"bad", "good", "mem-bad"} {
+		_, err = mem.Merge(key, []byte("1"), 1, uint64(4+i), tree.MergeOperator)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mem.Insert("mem", []byte("v"), 1, 7)
+	memtables := []*memtable.SkipList{mem, older}
+	keys := []string{"good", "bad", "missing", "mem", "mem-bad"}
+
+	elements, errs := MultiGet(tree, memtables, lru.NewCache(lru.DEFAULT_CAPACITY), keys)
+	for i, key := range keys {
+		_, err := ReadPath(tree, memtables, lru.NewCache(lru.DEFAULT_CAPACITY), key)
+		if errors.Is(err, Errors.ErrNotFound) {
+			err = nil
+		}
+		if !errors.Is(errs[i], err) || (err == nil) != (errs[i] == nil) {
+			t.Fatalf("%s failed with %v, ReadPath fails with %v", key, errs[i], err)
+		}
+	}
+	for _, i := range []int{1, 4} {
+		if !errors.Is(errs[i], MergeOperator.ErrInvalidOperand) || elements[i] != nil {
+			t.Fatalf("%s returned %v (%v), expected the error of the merge operator", keys[i], elements[i], errs[i])
+		}
+	}
+	expected := map[string]string{"good": "11", "mem": "v"}
+	for i, key := range keys {
+		if value, found := expected[key]; found {
+			if elements[i] == nil || string(elements[i].Value) != value {
+				t.Fatalf("%s is %v, expected %q", key, elements[i], value)
+			}
+		} else if errs[i] == nil && elements[i] != nil {
+			t.Fatalf("%s is %q, expected it not to be found", key, elements[i].Value)
+		}
+	}
+}
+
+func TestMultiGetReadsTheOtherKeysOfABrokenTable(t *testing.T) {
+	tree := openTree(t, nil)
+	older := memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0)
+	older.Insert("a", []byte("old"), 1, 1)
+	older.Insert("z", []byte("old"), 1, 2)
+	err := tree.Flush(older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0)
+	newer.Insert("m", []byte("broken"), 1, 3)
+	newer.Insert("n", []byte("new"), 1, 4)
+	err = tree.Flush(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The value of m doesn't match its checksum anymore
+	tables, _ := tree.Tables()
+	path := tables[0] + "-Data.db"
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := bytes.Index(data, []byte("broken"))
+	if at < 0 {
+		t.Fatal("the value of m is not in the Data file of the newest table")
+	}
+	data[at] ^= 0xff
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"a", "m", "n", "z"}
+	elements, errs := MultiGet(tree, nil, lru.NewCache(lru.DEFAULT_CAPACITY), keys)
+	if !errors.Is(errs[1], Errors.ErrCorrupted) || elements[1] != nil {
+		t.Fatalf("m returned %v (%v), expected the corruption", elements[1], errs[1])
+	}
+	expected := map[string]string{"a": "old", "n": "new", "z": "old"}
+	for i, key := range keys {
+		if value, found := expected[key]; found && (errs[i] != nil || elements[i] == nil || string(elements[i].Value) != value) {
+			t.Fatalf("%s returned %v (%v), expected %q", key, elements[i], errs[i], value)
+		}
+	}
+}
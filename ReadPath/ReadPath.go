@@ -2,33 +2,40 @@ package ReadPath
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
-	"io/ioutil"
+	"math"
 	"project/structures/Bloom_Filter"
+	"project/structures/Errors"
 	"project/structures/LSM"
+	"project/structures/MergeOperator"
 	"project/structures/SSTable"
 	"project/structures/lru"
 	"project/structures/memtable"
+	"sort"
 	"strconv"
+	"time"
 )
 
-func Panic(err error) {
-	if err != nil {
-		panic(err.Error())
-	}
-}
-
 // If key is found ElementInfo will be returned from ReadPath call
 
 type ElementInfo struct {
 	CRC       uint32
 	Timestamp uint64
+	Sequence  uint64
 	Tombstone bool
 	KeySize   uint64
 	ValueSize uint64
 	Key       string
 	Value     []byte
+	Expiry    int64
+	Operand   bool // Merge operand that still has to be applied, never returned by ReadPath
+}
+
+// Expired : Reports whether the element expired by the given time in seconds
+func (element *ElementInfo) Expired(now int64) bool {
+	return element.Expiry != 0 && element.Expiry <= now
 }
 
 func PrintElement(element *ElementInfo) {
@@ -38,6 +45,7 @@ func PrintElement(element *ElementInfo) {
 	}
 	fmt.Print("CRC: " + strconv.Itoa(int(element.CRC)))
 	fmt.Print("; Timestamp: " + strconv.Itoa(int(element.Timestamp)))
+	fmt.Print("; Sequence: " + strconv.FormatUint(element.Sequence, 10))
 	if element.Tombstone == true {
 		fmt.Print("; Tombstone: true")
 	} else {
@@ -45,23 +53,37 @@ func PrintElement(element *ElementInfo) {
 	}
 	fmt.Print("; Key Size: " + strconv.Itoa(int(element.KeySize)))
 	fmt.Print("; Value Size: " + strconv.Itoa(int(element.ValueSize)))
+	if element.Expiry != 0 {
+		fmt.Print("; Expiry: " + strconv.FormatInt(element.Expiry, 10))
+	}
 	fmt.Print("; Key: " + element.Key)
 	fmt.Print("; Value: " + string(element.Value) + "\n")
 
 }
 
 func CheckMemtable(sl *memtable.SkipList, key string) (*ElementInfo, *lru.Information) {
+	return CheckMemtableAt(sl, key, math.MaxUint64)
+}
+
+// CheckMemtableAt : Looks for the version of the key that a snapshot with the given sequence number sees
+func CheckMemtableAt(sl *memtable.SkipList, key string, sequence uint64) (*ElementInfo, *lru.Information) {
 
 	node := sl.FindNode(key)
+	if node != nil {
+		node = node.Version(sequence)
+	}
 	if node != nil {
 		// If key found in memtable Element info is created to be returned to the user
 		EI := ElementInfo{}
 		EI.Timestamp = binary.LittleEndian.Uint64(node.TimeStamp)
+		EI.Sequence = node.Sequence()
 		EI.Tombstone = node.Tombstone
 		EI.KeySize = uint64(len([]byte(key)))
 		EI.Key = key
 		EI.ValueSize = uint64(len(node.Value))
 		EI.Value = node.Value
+		EI.Expiry = node.Expiry
+		EI.Operand = node.Operand
 
 		// Cache info is being created so it can be written inside the cache
 		cacheInfo := lru.Information{}
@@ -69,12 +91,34 @@ func CheckMemtable(sl *memtable.SkipList, key string) (*ElementInfo, *lru.Inform
 		cacheInfo.Value = node.Value
 		cacheInfo.Tombstone = node.Tombstone
 		cacheInfo.Timestamp = binary.LittleEndian.Uint64(node.TimeStamp)
+		cacheInfo.Sequence = node.Sequence()
+		cacheInfo.Expiry = node.Expiry
 
 		return &EI, &cacheInfo
 	}
+	// A range tombstone in the memtable is newer than everything in the SSTables
+	tombstone := sl.CoveringTombstoneAt(key, sequence)
+	if tombstone != nil {
+		EI := rangeDeleted(key, tombstone)
+		cacheInfo := cacheInformation(EI)
+		return EI, &cacheInfo
+	}
 	return nil, nil
 }
 
+// rangeDeleted : Deleted element of the key that the range tombstone stands for
+func rangeDeleted(key string, tombstone *memtable.RangeTombstone) *ElementInfo {
+	EI := ElementInfo{}
+	EI.Timestamp = tombstone.Time()
+	EI.Sequence = tombstone.Sequence()
+	EI.Tombstone = true
+	EI.KeySize = uint64(len([]byte(key)))
+	EI.Key = key
+	EI.Value = []byte("")
+	EI.CRC = crc32.ChecksumIEEE(EI.Value)
+	return &EI
+}
+
 func CheckCache(c *lru.Cache, key string) *ElementInfo {
 	element, found := c.Find(key)
 	if found {
@@ -83,119 +127,290 @@ func CheckCache(c *lru.Cache, key string) *ElementInfo {
 		// ElementInfo object is created based on information from the cache
 		EI := ElementInfo{}
 		EI.Timestamp = uint64(int64(element.Timestamp))
+		EI.Sequence = element.Sequence
 		EI.Tombstone = element.Tombstone
 		EI.KeySize = uint64(len([]byte(key)))
 		EI.Key = key
 		EI.ValueSize = uint64(len(element.Value))
 		EI.Value = element.Value
+		EI.Expiry = element.Expiry
 		return &EI
 	}
 	return nil
 }
 
-func CheckBloomFilter(path, key string) bool {
-	bf := bloom_filter.ReadBloomFilter(path)
-	return bf.Contains(key)
+func CheckBloomFilter(path, key string) (bool, error) {
+	bf, err := bloom_filter.ReadBloomFilter(path)
+	if err != nil {
+		return false, err
+	}
+	return bf.Contains(key), nil
 }
 
-func CheckSummary(path, key string) (bool, int64) {
-	offset := SSTable.ReadSummary(path, key)
-	if offset != -1 {
-		return true, offset
-	} else {
-		return false, offset
+func CheckSummary(path, key string) (bool, int64, error) {
+	offset, err := SSTable.ReadSummary(path, key)
+	if err != nil {
+		return false, -1, err
 	}
+	return offset != -1, offset, nil
 }
 
-func CheckIndex(path, key string, offset int64) (bool, int64) {
-	offset2 := SSTable.ReadIndex(path, key, offset)
-	if offset2 != -1 {
-		return true, offset2
-	} else {
-		return false, offset2
+func CheckIndex(path, key string, offset int64) (bool, int64, error) {
+	offset2, err := SSTable.ReadIndex(path, key, offset)
+	if err != nil {
+		return false, -1, err
 	}
+	return offset2 != -1, offset2, nil
 }
 
-func CheckData(path, key string, offset int64) (*ElementInfo, *lru.Information) {
-	crc, timeStamp, tombStone, keySize, valueSize, currentKey, value := SSTable.ReadData(path, key, offset)
+func CheckData(path, key string, offset int64) (*ElementInfo, *lru.Information, error) {
+	crc, timeStamp, tombStone, expiry, keySize, valueSize, currentKey, value, err := SSTable.ReadData(path, key, offset)
+	if err != nil {
+		return nil, nil, err
+	}
 	if binary.LittleEndian.Uint32(crc) != crc32.ChecksumIEEE(value) {
-		// If Checksum doesn't add up error is raised
-		panic("Data corrupted")
+		// If Checksum doesn't add up error is returned
+		return nil, nil, Errors.Corrupted(path, offset, "checksum mismatch")
+	}
+	EI := ElementInfo{}
+	EI.CRC = binary.LittleEndian.Uint32(crc)
+	EI.Timestamp = binary.LittleEndian.Uint64(timeStamp)
+	EI.Sequence = binary.LittleEndian.Uint64(timeStamp[8:])
+	var ts bool
+	EI.Operand = tombStone[0] == SSTable.OPERAND
+	if tombStone[0] == SSTable.TOMBSTONE {
+		ts = true
 	} else {
-		EI := ElementInfo{}
-		EI.CRC = binary.LittleEndian.Uint32(crc)
-		EI.Timestamp = binary.LittleEndian.Uint64(timeStamp)
-		var ts bool
-		if tombStone[0] == 1 {
-			ts = true
-		} else {
-			ts = false
+		ts = false
+	}
+	EI.Tombstone = ts
+	EI.KeySize = binary.LittleEndian.Uint64(keySize)
+	EI.ValueSize = binary.LittleEndian.Uint64(valueSize)
+	EI.Key = string(currentKey)
+	EI.Value = value
+	EI.Expiry = int64(binary.LittleEndian.Uint64(expiry))
+
+	// Cache info is being created, so it can be written inside the cache
+	cacheInfo := lru.Information{}
+	cacheInfo.Key = key
+	cacheInfo.Value = value
+	cacheInfo.Tombstone = ts
+	cacheInfo.Timestamp = binary.LittleEndian.Uint64(timeStamp)
+	cacheInfo.Sequence = EI.Sequence
+	cacheInfo.Expiry = EI.Expiry
+	return &EI, &cacheInfo, nil
+}
+
+// CheckSSTable : Looks for the key in one SSTable, nil is returned if the SSTable doesn't contain it
+func CheckSSTable(prefix, key string) (*ElementInfo, *lru.Information, error) {
+	// First we load the BloomFilter and check if it MIGHT contain the key
+	found, err := CheckBloomFilter(prefix+"-Filter.db", key)
+	if err != nil || !found {
+		return nil, nil, err
+	}
+	// If it does, we then check the Summary of the SSTable
+	found, offsetIndex, err := CheckSummary(prefix+"-Summary.db", key)
+	if err != nil || !found {
+		return nil, nil, err
+	}
+	// If the key is inside the Summary we find the offset in the index file and the data file
+	found, offsetData, err := CheckIndex(prefix+"-Index.db", key, offsetIndex)
+	if err != nil || !found {
+		return nil, nil, err
+	}
+	// Finaly we read the key value from the Data file
+	return CheckData(prefix+"-Data.db", key, offsetData)
+}
+
+// ReadPath : Returns the newest element stored under the key, deleted elements are returned with the tombstone set
+// Merge operands are applied on top of the value of the key before it is returned
+// ErrNotFound is returned if the key was never written or its newest element expired
+func ReadPath(tree *LSM.LSM, memtables []*memtable.SkipList, cache *lru.Cache, key string) (*ElementInfo, error) {
+
+	// First we check the MemTables, from the newest
+	foundMemtables := CheckMemtables(memtables, key)
+	var tables []string
+	if len(foundMemtables) == 0 || foundMemtables[len(foundMemtables)-1].Operand {
+		// If it's not in the Memtables we check the Cache
+		// A merge operand in a memtable is newer than anything in the Cache, it has to be applied on the SSTables
+		if len(foundMemtables) == 0 {
+			foundCache := CheckCache(cache, key)
+			if foundCache != nil {
+				return foundCache, nil
+			}
 		}
-		EI.Tombstone = ts
-		EI.KeySize = binary.LittleEndian.Uint64(keySize)
-		EI.ValueSize = binary.LittleEndian.Uint64(valueSize)
-		EI.Key = string(currentKey)
-		EI.Value = value
+		// If key is not found in the memory we check the SSTables on the disk
+		// A list of all SSTables is created
+		var err error
+		tables, err = tree.Tables()
+		if err != nil {
+			return nil, err
+		}
+	}
+	foundElement, err := Resolve(foundMemtables, tables, key, tree.MergeOperator, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	// The element is sent to the user and pushed in the cache
+	cache.Add(key, cacheInformation(foundElement))
+	return foundElement, nil
 
-		// Cache info is being created, so it can be written inside the cache
-		cacheInfo := lru.Information{}
-		cacheInfo.Key = key
-		cacheInfo.Value = value
-		cacheInfo.Tombstone = ts
-		cacheInfo.Timestamp = binary.LittleEndian.Uint64(timeStamp)
-		return &EI, &cacheInfo
+}
+
+// LastSequence : Sequence number of the newest version of the key, deleted and expired versions included
+// 0 is returned if the key was never written
+func LastSequence(tree *LSM.LSM, memtables []*memtable.SkipList, key string) (uint64, error) {
+	elements := CheckMemtables(memtables, key)
+	if len(elements) > 0 {
+		return elements[0].Sequence, nil
+	}
+	tables, err := tree.Tables()
+	if err != nil {
+		return 0, err
+	}
+	found, err := CheckTables(tables, key)
+	if errors.Is(err, Errors.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return found[0].Sequence, nil
+}
+
+// CheckMemtables : Returns the elements of the key found in the memtables, which are ordered from the newest
+// The memtables older than the first element that isn't a merge operand are not checked, it hides their elements
+func CheckMemtables(memtables []*memtable.SkipList, key string) []*ElementInfo {
+	return CheckMemtablesAt(memtables, key, math.MaxUint64)
+}
+
+// CheckMemtablesAt : Returns the elements of the key that a snapshot with the given sequence number sees in the memtables
+func CheckMemtablesAt(memtables []*memtable.SkipList, key string, sequence uint64) []*ElementInfo {
+	var found []*ElementInfo
+	for _, sl := range memtables {
+		element, _ := CheckMemtableAt(sl, key, sequence)
+		if element == nil {
+			continue
+		}
+		found = append(found, element)
+		if !element.Operand {
+			break
+		}
+	}
+	return found
+}
+
+// Resolve : Returns the element a read sees, memElements are the elements found in the memtables (see CheckMemtables)
+// The SSTables are checked only if the memtables don't have the key or hold only merge operands
+// ErrNotFound is returned if the key doesn't exist or its newest element expired by now
+func Resolve(memElements []*ElementInfo, tables []string, key string, op MergeOperator.MergeOperator, now int64) (*ElementInfo, error) {
+	var found []*ElementInfo
+	if len(memElements) == 0 || memElements[len(memElements)-1].Operand {
+		var err error
+		found, err = CheckTables(tables, key)
+		if err != nil && (len(memElements) == 0 || !errors.Is(err, Errors.ErrNotFound)) {
+			return nil, err
+		}
 	}
+	return resolveVersions(memElements, found, op, now)
 }
 
-func ReadPath(memtable *memtable.SkipList, cache *lru.Cache, key string) *ElementInfo {
-
-	// First we check the MemTable
-	foundMemtable, cacheInfo := CheckMemtable(memtable, key)
-	if foundMemtable != nil {
-		// If key is found in Memtable, it is written at the front of the Cache
-		cache.Add(key, *cacheInfo)
-		return foundMemtable
-	}
-	// If it's not in the Memtable we check the Cache
-	foundCache := CheckCache(cache, key)
-	if foundCache != nil {
-		return foundCache
-	}
-	// If key is not found in the memory we check the SSTables on the disk
-	// A list of all SSTables is created
-	var foundElement *ElementInfo = nil
-	var cacheElement *lru.Information = nil
-	for i := 1; i <= LSM.MAX_LEVEL; i++ {
-		files, err := ioutil.ReadDir("./Data/SSTable/Level" + strconv.Itoa(i))
-		Panic(err)
-		// We go through the list of SSTables
-		for _, file := range files {
-			fileNum := file.Name()[7:] // Get the number of the SSTable
-			// First we load the BloomFilter and check if it MIGHT contain the key
-			prefix := "Data/SSTable/Level" + strconv.Itoa(i) + "/SSTable" + fileNum + "/usertable-" + strconv.Itoa(i)
-			if CheckBloomFilter(prefix+"-Filter.db", key) {
-				// If it does, we then check the Summary of the SSTable
-				foundSummary, offsetIndex := CheckSummary(prefix+"-Summary.db", key)
-				// If the key is inside the Summary we find the offset in the index file and the data file
-				if foundSummary {
-					foundIndex, offsetData := CheckIndex(prefix+"-Index.db", key, offsetIndex)
-					if foundIndex {
-						// Finaly we read the key value from the Data file, send it to the user and push it in the cache
-						EI, c := CheckData(prefix+"-Data.db", key, offsetData)
-						if foundElement == nil || foundElement.Timestamp <= EI.Timestamp {
-							foundElement = EI
-							cacheElement = c
-						}
-					}
-				}
+// resolveVersions : Returns the element a read sees from the memtable elements and the SSTable elements of one key
+// Both are ordered from the newest, ErrNotFound is returned if there are no versions or the newest one expired
+func resolveVersions(memElements []*ElementInfo, found []*ElementInfo, op MergeOperator.MergeOperator, now int64) (*ElementInfo, error) {
+	versions := append(append([]*ElementInfo{}, memElements...), found...)
+	if len(versions) == 0 {
+		return nil, Errors.ErrNotFound
+	}
+	element, err := Fold(versions, op, now)
+	if err != nil {
+		return nil, err
+	}
+	if element.Expired(now) {
+		return nil, Errors.ErrNotFound
+	}
+	return element, nil
+}
+
+// Fold : Returns the element a read sees from the versions of one key ordered from the newest
+// If the newest versions are merge operands they are applied on top of the newest version below them
+func Fold(versions []*ElementInfo, op MergeOperator.MergeOperator, now int64) (*ElementInfo, error) {
+	newest := versions[0]
+	if !newest.Operand {
+		return newest, nil
+	}
+	var existing []byte = nil
+	var operands [][]byte
+	for _, version := range versions {
+		if !version.Operand {
+			// Deleted or expired elements leave the key without a value
+			if !version.Tombstone && !version.Expired(now) {
+				existing = version.Value
 			}
+			break
 		}
+		// Operands are applied from the oldest
+		operands = append([][]byte{version.Value}, operands...)
 	}
+	value, err := MergeOperator.Apply(op, newest.Key, existing, operands)
+	if err != nil {
+		return nil, err
+	}
+	folded := *newest
+	folded.Operand = false
+	folded.CRC = crc32.ChecksumIEEE(value)
+	folded.ValueSize = uint64(len(value))
+	folded.Value = value
+	return &folded, nil
+}
 
-	// If the element is not found in ANY SSTable we return nil
-	if foundElement != nil {
-		cache.Add(key, *cacheElement)
+// CheckTables : Returns all the elements stored under the key in the given SSTables, ordered from the newest
+// A range tombstone that covers the key is returned as a deleted element of the key
+// ErrNotFound is returned if none of them contains the key
+func CheckTables(tables []string, key string) ([]*ElementInfo, error) {
+	var versions []*ElementInfo
+	// We go through the list of SSTables
+	for _, table := range tables {
+		EI, _, err := CheckSSTable(table, key)
+		if err != nil {
+			return nil, err
+		}
+		if EI != nil {
+			versions = append(versions, EI)
+		}
+		tombstones, err := SSTable.ReadRangeTombstones(table + "-RangeDel.db")
+		if err != nil {
+			return nil, err
+		}
+		for i := range tombstones {
+			if tombstones[i].Covers(key) {
+				versions = append(versions, rangeDeleted(key, &tombstones[i]))
+			}
+		}
 	}
-	return foundElement
+	// If the element is not found in ANY SSTable ErrNotFound is returned
+	if len(versions) == 0 {
+		return nil, Errors.ErrNotFound
+	}
+	sortVersions(versions)
+	return versions, nil
+}
+
+// sortVersions : Orders the elements of one key from the newest
+// Tables are ordered from the newest, on equal versions the element found first is kept
+func sortVersions(versions []*ElementInfo) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return SSTable.NewerVersion(versions[i].Sequence, versions[i].Timestamp, versions[j].Sequence, versions[j].Timestamp)
+	})
+}
 
+// cacheInformation : Information about the element that is kept in the cache
+func cacheInformation(element *ElementInfo) lru.Information {
+	info := lru.Information{}
+	info.Key = element.Key
+	info.Value = element.Value
+	info.Timestamp = element.Timestamp
+	info.Sequence = element.Sequence
+	info.Tombstone = element.Tombstone
+	info.Expiry = element.Expiry
+	return info
 }
@@ -5,24 +5,41 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"math"
 	"os"
+	"project/structures/Errors"
 	"project/structures/memtable"
+	"sort"
+	"strings"
 )
 
 //=====================================================================================================================
 // Data
 
+// DATA_HEADER_SIZE : Size of the fields in front of the key and the value of each record
+// Expiry is the time in seconds after which the element is treated as absent, 0 if it never expires
+const DATA_HEADER_SIZE = 45
+
+// Values of the tombstone byte, a merge operand still has to be applied on top of the older value of the key
+const (
+	TOMBSTONE = 1
+	OPERAND   = 2
+)
+
 // Write
 
 func DataSegmentToBinary(node *memtable.Node) []byte {
-	//+---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
-	//|    CRC (4B)   | Timestamp (16B) | Tombstone(1B) | Key Size (8B) | Value Size (8B) | Key | Value |
-	//+---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
+	//+---------------+-----------------+---------------+-------------+---------------+-----------------+-...-+--...--+
+	//|    CRC (4B)   | Timestamp (16B) | Tombstone(1B) | Expiry (8B) | Key Size (8B) | Value Size (8B) | Key | Value |
+	//+---------------+-----------------+---------------+-------------+---------------+-----------------+-...-+--...--+
 
 	// Attributes that are not binary are changed to be byte arrays
 	tombStone := []byte{0}
 	if node.Tombstone {
-		tombStone[0] = 1
+		tombStone[0] = TOMBSTONE
+	} else if node.Operand {
+		tombStone[0] = OPERAND
 	}
 	key := []byte(node.Key)
 
@@ -32,7 +49,10 @@ func DataSegmentToBinary(node *memtable.Node) []byte {
 	valueSize := make([]byte, 8)
 	binary.LittleEndian.PutUint64(valueSize, uint64(len(node.Value)))
 
-	size := binary.LittleEndian.Uint64(keySize) + binary.LittleEndian.Uint64(valueSize) + 37
+	expiry := make([]byte, 8)
+	binary.LittleEndian.PutUint64(expiry, uint64(node.Expiry))
+
+	size := binary.LittleEndian.Uint64(keySize) + binary.LittleEndian.Uint64(valueSize) + DATA_HEADER_SIZE
 	element := make([]byte, 0, size)
 
 	crc := make([]byte, 4)
@@ -42,6 +62,7 @@ func DataSegmentToBinary(node *memtable.Node) []byte {
 	element = append(element, crc...)
 	element = append(element, node.TimeStamp...)
 	element = append(element, tombStone...)
+	element = append(element, expiry...)
 	element = append(element, keySize...)
 	element = append(element, valueSize...)
 	element = append(element, key...)
@@ -52,55 +73,88 @@ func DataSegmentToBinary(node *memtable.Node) []byte {
 
 // Read
 
-func ReadData(path string, key string, offset int64) ([]byte, []byte, []byte, []byte, []byte, []byte, []byte) {
-	//+---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
-	//|    CRC (4B)   | Timestamp (16B) | Tombstone(1B) | Key Size (8B) | Value Size (8B) | Key | Value |
-	//+---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
+// readField : Fills the buffer from the reader, a record cut short is reported as corrupted
+func readField(br *bufio.Reader, buffer []byte, path string, offset int64) error {
+	_, err := io.ReadFull(br, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Errors.Corrupted(path, offset, "record is cut short")
+	}
+	return Errors.IO("read", path, err)
+}
+
+// checkSizes : Checks that the key and the value of the record starting at the offset fit in the file
+// The sizes are read from the disk and are checked before anything is allocated
+func checkSizes(path string, offset, fileSize int64, keySize, valueSize []byte) error {
+	remaining := fileSize - offset - DATA_HEADER_SIZE
+	key, value := binary.LittleEndian.Uint64(keySize), binary.LittleEndian.Uint64(valueSize)
+	if remaining < 0 || key > uint64(remaining) || value > uint64(remaining)-key {
+		return Errors.Corrupted(path, offset, "record is cut short")
+	}
+	return nil
+}
+
+func ReadData(path string, key string, offset int64) ([]byte, []byte, []byte, []byte, []byte, []byte, []byte, []byte, error) {
+	//+---------------+-----------------+---------------+-------------+---------------+-----------------+-...-+--...--+
+	//|    CRC (4B)   | Timestamp (16B) | Tombstone(1B) | Expiry (8B) | Key Size (8B) | Value Size (8B) | Key | Value |
+	//+---------------+-----------------+---------------+-------------+---------------+-----------------+-...-+--...--+
 
 	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
-	Panic(err)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, nil, Errors.IO("open", path, err)
+	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, nil, Errors.IO("stat", path, err)
+	}
 	_, err = file.Seek(offset, 0)
-	Panic(err)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, nil, Errors.IO("seek", path, err)
+	}
 	br := bufio.NewReader(file)
 
 	crc := make([]byte, 4)
-	_, err = br.Read(crc)
-	Panic(err)
 	timeStamp := make([]byte, 16)
-	_, err = br.Read(timeStamp)
-	Panic(err)
 	tombStone := make([]byte, 1)
-	_, err = br.Read(tombStone)
-	Panic(err)
+	expiry := make([]byte, 8)
 	keySize := make([]byte, 8)
-	_, err = br.Read(keySize)
-	Panic(err)
 	valueSize := make([]byte, 8)
-	_, err = br.Read(valueSize)
-	Panic(err)
+	for _, field := range [][]byte{crc, timeStamp, tombStone, expiry, keySize, valueSize} {
+		err = readField(br, field, path, offset)
+		if err != nil {
+			return nil, nil, nil, nil, nil, nil, nil, nil, err
+		}
+	}
+	err = checkSizes(path, offset, info.Size(), keySize, valueSize)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, nil, err
+	}
 
 	currentKey := make([]byte, binary.LittleEndian.Uint64(keySize))
-	_, err = br.Read(currentKey)
-	Panic(err)
-	// If the key is not where we expected it to be an error is raised
-	if key == string(currentKey) {
-		value := make([]byte, binary.LittleEndian.Uint64(valueSize))
-		_, err = br.Read(value)
-		return crc, timeStamp, tombStone, keySize, valueSize, currentKey, value
-	} else {
-		panic("Error: Key not found in estimated position")
+	err = readField(br, currentKey, path, offset)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, nil, err
+	}
+	// If the key is not where we expected it to be an error is returned
+	if key != string(currentKey) {
+		return nil, nil, nil, nil, nil, nil, nil, nil, Errors.Corrupted(path, offset, "key not found in estimated position")
 	}
+	value := make([]byte, binary.LittleEndian.Uint64(valueSize))
+	err = readField(br, value, path, offset)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, nil, err
+	}
+	return crc, timeStamp, tombStone, expiry, keySize, valueSize, currentKey, value, nil
 }
 
 // PrintData : Used for debugging, prints the contents of the Data file
-func PrintData(path string) {
+func PrintData(path string) error {
 
 	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
-	Panic(err)
+	if err != nil {
+		return Errors.IO("open", path, err)
+	}
 	defer file.Close()
-	_, err = file.Seek(0, 0)
-	Panic(err)
 	br := bufio.NewReader(file)
 
 	i := 1
@@ -120,6 +174,11 @@ func PrintData(path string) {
 		if err != nil {
 			break
 		}
+		expiry := make([]byte, 8)
+		_, err = br.Read(expiry)
+		if err != nil {
+			break
+		}
 		keySize := make([]byte, 8)
 		_, err = br.Read(keySize)
 		if err != nil {
@@ -139,19 +198,315 @@ func PrintData(path string) {
 		_, err = br.Read(value)
 
 		var ts string
-		if tombStone[0] == 1 {
+		if tombStone[0] == TOMBSTONE {
 			ts = "True"
+		} else if tombStone[0] == OPERAND {
+			ts = "Merge operand"
 		} else {
 			ts = "False"
 		}
 
 		fmt.Println(i, ". CRC: ", binary.LittleEndian.Uint32(crc),
 			"; Timestamp: ", binary.LittleEndian.Uint32(timeStamp),
+			"; Sequence: ", binary.LittleEndian.Uint64(timeStamp[8:]),
 			"; Tombstone: ", ts,
+			"; Expiry: ", int64(binary.LittleEndian.Uint64(expiry)),
 			"; Key size: ", binary.LittleEndian.Uint64(keySize),
 			"; Value Size: ", binary.LittleEndian.Uint64(valueSize),
 			"; Key: ", string(currentKey),
 			"; Value:", string(value))
 		i++
 	}
+	return nil
+}
+
+//=====================================================================================================================
+// Iterating
+
+// Element : One record of the Data file
+type Element struct {
+	Key       string
+	Value     []byte
+	Timestamp uint64
+	Sequence  uint64
+	Tombstone bool
+	Expiry    int64
+	Operand   bool
+}
+
+// Expired : Reports whether the element expired by the given time in seconds
+func (e *Element) Expired(now int64) bool {
+	return e.Expiry != 0 && e.Expiry <= now
+}
+
+// NewerThan : Reports whether the element was written after the other one
+func (e *Element) NewerThan(other *Element) bool {
+	return NewerVersion(e.Sequence, e.Timestamp, other.Sequence, other.Timestamp)
+}
+
+// NewerVersion : Versions are ordered by their sequence number, the time is compared only for records written before
+// sequence numbers existed (their sequence is 0)
+func NewerVersion(sequence1, timestamp1, sequence2, timestamp2 uint64) bool {
+	if sequence1 != sequence2 {
+		return sequence1 > sequence2
+	}
+	return timestamp1 > timestamp2
+}
+
+// CompareTimeStamps : Compares two binary 16B timestamps, returns 1 if the first one is newer, -1 if it is older, 0 if equal
+func CompareTimeStamps(timeStamp1, timeStamp2 []byte) int {
+	sequence1, sequence2 := binary.LittleEndian.Uint64(timeStamp1[8:]), binary.LittleEndian.Uint64(timeStamp2[8:])
+	time1, time2 := binary.LittleEndian.Uint64(timeStamp1[:8]), binary.LittleEndian.Uint64(timeStamp2[:8])
+	if NewerVersion(sequence1, time1, sequence2, time2) {
+		return 1
+	}
+	if NewerVersion(sequence2, time2, sequence1, time1) {
+		return -1
+	}
+	return 0
+}
+
+// ReadElement : Reads the record starting at the offset, nil is returned at the end of the file
+// The checksum of the value is verified, the second return value is the size of the record in bytes
+// fileSize is the length of the Data file, sizes of the key and the value that run past it are reported as corrupted
+func ReadElement(br *bufio.Reader, path string, offset int64, fileSize int64) (*Element, int64, error) {
+	_, err := br.Peek(1)
+	if err == io.EOF {
+		return nil, 0, nil
+	}
+	crc := make([]byte, 4)
+	timeStamp := make([]byte, 16)
+	tombStone := make([]byte, 1)
+	expiry := make([]byte, 8)
+	keySize := make([]byte, 8)
+	valueSize := make([]byte, 8)
+	for _, field := range [][]byte{crc, timeStamp, tombStone, expiry, keySize, valueSize} {
+		err = readField(br, field, path, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	err = checkSizes(path, offset, fileSize, keySize, valueSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	key := make([]byte, binary.LittleEndian.Uint64(keySize))
+	err = readField(br, key, path, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	value := make([]byte, binary.LittleEndian.Uint64(valueSize))
+	err = readField(br, value, path, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(crc) != crc32.ChecksumIEEE(value) {
+		return nil, 0, Errors.Corrupted(path, offset, "checksum mismatch")
+	}
+	element := Element{}
+	element.Key = string(key)
+	element.Value = value
+	element.Timestamp = binary.LittleEndian.Uint64(timeStamp)
+	element.Sequence = binary.LittleEndian.Uint64(timeStamp[8:])
+	element.Tombstone = tombStone[0] == TOMBSTONE
+	element.Operand = tombStone[0] == OPERAND
+	element.Expiry = int64(binary.LittleEndian.Uint64(expiry))
+	return &element, int64(DATA_HEADER_SIZE + len(key) + len(value)), nil
+}
+
+// DataIterator : Goes through the elements of one Data file in the order of their keys
+// Forward iteration reads the Data file sequentially, backward iteration walks the Index file through the entry sizes
+// Seeking looks the key up in the Summary and goes straight to its entry in the Index file
+type DataIterator struct {
+	path    string
+	file    *os.File
+	size    int64 // Length of the Data file
+	br      *bufio.Reader
+	offset  int64
+	current *Element
+	// Used when iterating backwards
+	reverse       bool
+	index         *os.File
+	indexPosition int64 // Position in the Index file where the entry of the current element starts
+	// Used when seeking, the Summary is read on the first seek to a key
+	summary *os.File
+	keys    []string       // Keys of the Summary in sorted order
+	offsets map[string]int // Offsets of the keys in the Index file
+}
+
+// OpenDataIterator : Opens the Data file, the Index file and the Summary file of the SSTable
+// They are opened right away so the iterator keeps working if the SSTable is removed by a compaction
+func OpenDataIterator(path string) (*DataIterator, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
+	if err != nil {
+		return nil, Errors.IO("open", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, Errors.IO("stat", path, err)
+	}
+	prefix := strings.TrimSuffix(path, "-Data.db")
+	index, err := os.OpenFile(prefix+"-Index.db", os.O_RDONLY, 0700)
+	if err != nil {
+		file.Close()
+		return nil, Errors.IO("open", prefix+"-Index.db", err)
+	}
+	summary, err := os.OpenFile(prefix+"-Summary.db", os.O_RDONLY, 0700)
+	if err != nil {
+		file.Close()
+		index.Close()
+		return nil, Errors.IO("open", prefix+"-Summary.db", err)
+	}
+	it := DataIterator{path: path, file: file, size: info.Size(), index: index, summary: summary}
+	err = it.Seek("")
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	return &it, nil
+}
+
+// loadSummary : Reads the keys of the Summary and sorts them, it is done once
+func (it *DataIterator) loadSummary() error {
+	if it.offsets != nil {
+		return nil
+	}
+	summary, err := readSummary(it.summary)
+	if err != nil {
+		return err
+	}
+	it.keys = make([]string, 0, len(summary.Elements))
+	for key := range summary.Elements {
+		it.keys = append(it.keys, key)
+	}
+	sort.Strings(it.keys)
+	it.offsets = summary.Elements
+	return nil
+}
+
+// Seek : Positions the iterator on the first element whose key is greater than or equal to the key
+func (it *DataIterator) Seek(key string) error {
+	it.reverse = false
+	var dataOffset int64
+	if key != "" {
+		err := it.loadSummary()
+		if err != nil {
+			it.current = nil
+			return err
+		}
+		i := sort.SearchStrings(it.keys, key)
+		if i == len(it.keys) {
+			it.current = nil
+			return nil
+		}
+		key = it.keys[i]
+		dataOffset, err = readIndexEntry(it.index, key, int64(it.offsets[key]))
+		if err != nil {
+			it.current = nil
+			return err
+		}
+	}
+	_, err := it.file.Seek(dataOffset, 0)
+	if err != nil {
+		it.current = nil
+		return Errors.IO("seek", it.path, err)
+	}
+	it.br = bufio.NewReader(it.file)
+	it.offset = dataOffset
+	err = it.Next()
+	if err != nil {
+		return err
+	}
+	if key != "" && (it.current == nil || it.current.Key != key) {
+		it.current = nil
+		return Errors.Corrupted(it.path, dataOffset, "key not found in estimated position")
+	}
+	return nil
+}
+
+// Next : Moves to the next element, Element returns nil once the end of the file is reached
+// Can only be called after Seek
+func (it *DataIterator) Next() error {
+	element, size, err := ReadElement(it.br, it.path, it.offset, it.size)
+	if err != nil {
+		it.current = nil
+		return err
+	}
+	it.current = element
+	it.offset += size
+	return nil
+}
+
+// SeekBefore : Positions the iterator on the last element whose key is less than the key
+// With an empty key the iterator is positioned on the last element of the file
+func (it *DataIterator) SeekBefore(key string) error {
+	it.reverse = true
+	if key == "" {
+		// Stepping back starts from the end of the Index file
+		info, err := it.index.Stat()
+		if err != nil {
+			it.current = nil
+			return Errors.IO("stat", it.index.Name(), err)
+		}
+		it.indexPosition = info.Size()
+		return it.Prev()
+	}
+	err := it.loadSummary()
+	if err != nil {
+		it.current = nil
+		return err
+	}
+	i := sort.SearchStrings(it.keys, key)
+	if i == 0 {
+		it.current = nil
+		it.indexPosition = 0
+		return nil
+	}
+	// Stepping back starts from the end of the entry of the last key before the given one
+	key = it.keys[i-1]
+	it.indexPosition = int64(it.offsets[key] + len(IndexEntryToBinary(key, 0)))
+	err = it.Prev()
+	if err == nil && (it.current == nil || it.current.Key != key) {
+		it.current = nil
+		return Errors.Corrupted(it.index.Name(), int64(it.offsets[key]), "key not found in estimated position")
+	}
+	return err
+}
+
+// Prev : Moves to the previous element, Element returns nil once the beginning of the file is reached
+// Can only be called after SeekBefore
+func (it *DataIterator) Prev() error {
+	if it.indexPosition <= 0 {
+		it.current = nil
+		return nil
+	}
+	key, dataOffset, start, err := ReadIndexBefore(it.index, it.indexPosition)
+	if err != nil {
+		it.current = nil
+		return err
+	}
+	br := bufio.NewReader(io.NewSectionReader(it.file, dataOffset, math.MaxInt64-dataOffset))
+	element, _, err := ReadElement(br, it.path, dataOffset, it.size)
+	if err != nil {
+		it.current = nil
+		return err
+	}
+	if element == nil || element.Key != key {
+		it.current = nil
+		return Errors.Corrupted(it.path, dataOffset, "key not found in estimated position")
+	}
+	it.current = element
+	it.indexPosition = start
+	return nil
+}
+
+func (it *DataIterator) Element() *Element {
+	return it.current
+}
+
+func (it *DataIterator) Close() error {
+	it.index.Close()
+	it.summary.Close()
+	return Errors.IO("close", it.path, it.file.Close())
 }
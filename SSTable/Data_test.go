@@ -0,0 +1,198 @@
+package SSTable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"project/structures/Errors"
+	"project/structures/memtable"
+	"testing"
+)
+
+// flushTable : Writes the keys with their values as the SSTable "table" on the first level and returns its prefix
+func flushTable(t *testing.T, keys ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	err := os.Mkdir(LevelDir(dir, 1), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0)
+	for i, key := range keys {
+		s.Insert(key, []byte("value-"+key), 1, uint64(i+1))
+	}
+	err = Flush(dir, "table", s, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return TablePrefix(dir, 1, "table")
+}
+
+// corruptKeySize : Overwrites the key size of the first record of the Data file
+func corruptKeySize(t *testing.T, prefix string, size uint64) {
+	t.Helper()
+	file, err := os.OpenFile(prefix+"-Data.db", os.O_WRONLY, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	field := make([]byte, 8)
+	binary.LittleEndian.PutUint64(field, size)
+	// The key size follows the CRC, the timestamp, the tombstone byte and the expiry
+	_, err = file.WriteAt(field, 4+16+1+8)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadElementRejectsSizePastEOF(t *testing.T) {
+	for _, size := range []uint64{1 << 40, 1<<64 - 1} {
+		prefix := flushTable(t, "a", "b", "c")
+		corruptKeySize(t, prefix, size)
+
+		_, err := OpenDataIterator(prefix + "-Data.db")
+		if !errors.Is(err, Errors.ErrCorrupted) {
+			t.Fatalf("key size %d: iterator returned %v, expected a corruption", size, err)
+		}
+		r, err := OpenReader(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Get("a")
+		r.Close()
+		if !errors.Is(err, Errors.ErrCorrupted) {
+			t.Fatalf("key size %d: reader returned %v, expected a corruption", size, err)
+		}
+		_, _, _, _, _, _, _, _, err = ReadData(prefix+"-Data.db", "a", 0)
+		if !errors.Is(err, Errors.ErrCorrupted) {
+			t.Fatalf("key size %d: ReadData returned %v, expected a corruption", size, err)
+		}
+	}
+}
+
+func TestDataIterator(t *testing.T) {
+	var keys []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("k%03d", i*2))
+	}
+	prefix := flushTable(t, keys...)
+	it, err := OpenDataIterator(prefix + "-Data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var got []string
+	for ; it.Element() != nil; err = it.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, it.Element().Key)
+	}
+	if len(got) != len(keys) {
+		t.Fatalf("iterated over %d keys, expected %d", len(got), len(keys))
+	}
+	for i := range keys {
+		if got[i] != keys[i] {
+			t.Fatalf("key %d is %s, expected %s", i, got[i], keys[i])
+		}
+	}
+
+	seeks := []struct{ key, forward, backward string }{
+		{"", "k000", "k098"},
+		{"k000", "k000", ""},
+		{"k001", "k002", "k000"},
+		{"k050", "k050", "k048"},
+		{"k097", "k098", "k096"},
+		{"k099", "", "k098"},
+	}
+	for _, seek := range seeks {
+		err = it.Seek(seek.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := keyOf(it.Element()); key != seek.forward {
+			t.Fatalf("Seek(%q) is on %q, expected %q", seek.key, key, seek.forward)
+		}
+		err = it.SeekBefore(seek.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := keyOf(it.Element()); key != seek.backward {
+			t.Fatalf("SeekBefore(%q) is on %q, expected %q", seek.key, key, seek.backward)
+		}
+	}
+}
+
+func keyOf(element *Element) string {
+	if element == nil {
+		return ""
+	}
+	return element.Key
+}
+
+// breakChecksum : Overwrites the checksum of the record with the given number, the records have to be of the same size
+func breakChecksum(t *testing.T, prefix string, record int) {
+	t.Helper()
+	file, err := os.OpenFile(prefix+"-Data.db", os.O_WRONLY, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.WriteAt([]byte{0, 0, 0, 0}, int64(record)*(DATA_HEADER_SIZE+int64(len("a")+len("value-a"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeekGoesStraightToTheKey(t *testing.T) {
+	prefix := flushTable(t, "a", "b", "c")
+	breakChecksum(t, prefix, 1)
+
+	it, err := OpenDataIterator(prefix + "-Data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	err = it.Seek("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := keyOf(it.Element()); key != "c" {
+		t.Fatalf("Seek(\"c\") is on %q", key)
+	}
+	err = it.Seek("b")
+	if !errors.Is(err, Errors.ErrCorrupted) {
+		t.Fatalf("Seek(\"b\") returned %v, expected a corruption", err)
+	}
+}
+
+func TestSeekBeforeGoesStraightToTheKey(t *testing.T) {
+	prefix := flushTable(t, "a", "b", "c")
+	breakChecksum(t, prefix, 2)
+
+	it, err := OpenDataIterator(prefix + "-Data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	err = it.SeekBefore("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := keyOf(it.Element()); key != "b" {
+		t.Fatalf("SeekBefore(\"c\") is on %q", key)
+	}
+	err = it.Prev()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := keyOf(it.Element()); key != "a" {
+		t.Fatalf("Prev is on %q", key)
+	}
+	err = it.SeekBefore("")
+	if !errors.Is(err, Errors.ErrCorrupted) {
+		t.Fatalf("SeekBefore(\"\") returned %v, expected a corruption", err)
+	}
+}
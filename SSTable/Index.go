@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"project/structures/Errors"
 )
 
 //=====================================================================================================================
@@ -35,41 +38,63 @@ func IndexSegmentToBinary(key string, offset int) []byte {
 	return element
 }
 
+// IndexEntryToBinary : Entry of the Index file, the index segment is followed by its own size
+// The size at the end of every entry allows the Index file to be read backwards
+func IndexEntryToBinary(key string, offset int) []byte {
+	//+---------------+----------+------------+-----------------+
+	//| Key Size (8B) | Key (?B) | Offset(8B) | Entry Size (8B) |
+	//+---------------+------ ---+------------+-----------------+
+	element := IndexSegmentToBinary(key, offset)
+	entrySize := make([]byte, 8)
+	binary.LittleEndian.PutUint64(entrySize, uint64(len(element)+8))
+	return append(element, entrySize...)
+}
+
 // Read
 
-func ReadIndex(path string, key string, offset int64) int64 {
+func ReadIndex(path string, key string, offset int64) (int64, error) {
 	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
-	Panic(err)
+	if err != nil {
+		return -1, Errors.IO("open", path, err)
+	}
 	defer file.Close()
-	_, err = file.Seek(offset, 0)
-	Panic(err)
-	br := bufio.NewReader(file)
+	return readIndexEntry(file, key, offset)
+}
+
+// readIndexEntry : Returns the offset in the Data file kept in the entry of the opened Index file at the offset
+// The entry has to belong to the key, the file can be shared by several lookups
+func readIndexEntry(file *os.File, key string, offset int64) (int64, error) {
+	path := file.Name()
+	br := bufio.NewReader(io.NewSectionReader(file, offset, math.MaxInt64-offset))
 
 	keySize := make([]byte, 8)
-	_, err = br.Read(keySize)
-	Panic(err)
+	err := readField(br, keySize, path, offset)
+	if err != nil {
+		return -1, err
+	}
 	currentKey := make([]byte, binary.LittleEndian.Uint64(keySize))
-	_, err = br.Read(currentKey)
-	Panic(err)
-	a := string(currentKey)
-	if key == a {
-		dataOffset := make([]byte, 8)
-		_, err = br.Read(dataOffset)
-		Panic(err)
-		return int64(binary.LittleEndian.Uint64(dataOffset))
-	} else {
-		panic("Error: Key not found in estimated position")
+	err = readField(br, currentKey, path, offset)
+	if err != nil {
+		return -1, err
 	}
-
+	if key != string(currentKey) {
+		return -1, Errors.Corrupted(path, offset, "key not found in estimated position")
+	}
+	dataOffset := make([]byte, 8)
+	err = readField(br, dataOffset, path, offset)
+	if err != nil {
+		return -1, err
+	}
+	return int64(binary.LittleEndian.Uint64(dataOffset)), nil
 }
 
 //PrintIndex used for debugging
-func PrintIndex(path string) {
+func PrintIndex(path string) error {
 	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
-	Panic(err)
+	if err != nil {
+		return Errors.IO("open", path, err)
+	}
 	defer file.Close()
-	_, err = file.Seek(0, 0)
-	Panic(err)
 	br := bufio.NewReader(file)
 
 	i := 1
@@ -90,9 +115,41 @@ func PrintIndex(path string) {
 		if err != nil {
 			break
 		}
+		entrySize := make([]byte, 8)
+		_, err = br.Read(entrySize)
+		if err != nil {
+			break
+		}
 		fmt.Println(i, ". Key size: ", binary.LittleEndian.Uint64(keySize),
 			"; Key: ", string(currentKey),
 			"; Offset in Data file: ", binary.LittleEndian.Uint64(dataOffset))
+		i++
+	}
+	return nil
+}
+
+// ReadIndexBefore : Reads the entry of the Index file that ends at the given position
+// Returns the key, the offset in the Data file and the position where the entry starts
+func ReadIndexBefore(file *os.File, end int64) (string, int64, int64, error) {
+	entrySize := make([]byte, 8)
+	_, err := file.ReadAt(entrySize, end-8)
+	if err != nil {
+		return "", -1, -1, Errors.IO("read", file.Name(), err)
+	}
+	start := end - int64(binary.LittleEndian.Uint64(entrySize))
+	if start < 0 || end-start < 24 {
+		return "", -1, -1, Errors.Corrupted(file.Name(), end-8, "invalid index entry size")
+	}
+	entry := make([]byte, end-8-start)
+	_, err = file.ReadAt(entry, start)
+	if err != nil {
+		return "", -1, -1, Errors.IO("read", file.Name(), err)
+	}
+	keySize := int64(binary.LittleEndian.Uint64(entry[:8]))
+	if keySize != int64(len(entry))-16 {
+		return "", -1, -1, Errors.Corrupted(file.Name(), start, "invalid index entry key size")
 	}
-	i++
+	key := string(entry[8 : 8+keySize])
+	dataOffset := int64(binary.LittleEndian.Uint64(entry[8+keySize:]))
+	return key, dataOffset, start, nil
 }
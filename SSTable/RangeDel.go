@@ -0,0 +1,110 @@
+package SSTable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"project/structures/Errors"
+	"project/structures/memtable"
+)
+
+//=====================================================================================================================
+// Range tombstones
+
+// Write
+
+func RangeTombstoneToBinary(tombstone *memtable.RangeTombstone) []byte {
+	//+---------------+-----------------+-----------------+---------------+------------+----------+
+	//|    CRC (4B)   | Timestamp (16B) | Start Size (8B) | End Size (8B) | Start (?B) | End (?B) |
+	//+---------------+-----------------+-----------------+---------------+------------+----------+
+	// CRC is computed over the start and the end of the range
+	binStart := []byte(tombstone.Start)
+	binEnd := []byte(tombstone.End)
+
+	sizes := make([]byte, 16)
+	binary.LittleEndian.PutUint64(sizes[:8], uint64(len(binStart)))
+	binary.LittleEndian.PutUint64(sizes[8:], uint64(len(binEnd)))
+
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(append(append([]byte{}, binStart...), binEnd...)))
+
+	element := make([]byte, 0, 36+len(binStart)+len(binEnd))
+	element = append(element, crc...)
+	element = append(element, tombstone.TimeStamp...)
+	element = append(element, sizes...)
+	element = append(element, binStart...)
+	element = append(element, binEnd...)
+	return element
+}
+
+// WriteRangeTombstones : Writes the range tombstones of the SSTable to its RangeDel file
+func WriteRangeTombstones(tombstones []memtable.RangeTombstone, file *os.File) error {
+	for i := range tombstones {
+		_, err := file.Write(RangeTombstoneToBinary(&tombstones[i]))
+		if err != nil {
+			return Errors.IO("write", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Read
+
+// ReadRangeTombstones : Returns the range tombstones of the SSTable in the order they were written
+// SSTables written before range deletes existed have no RangeDel file, they have no range tombstones
+func ReadRangeTombstones(path string) ([]memtable.RangeTombstone, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, Errors.IO("open", path, err)
+	}
+	defer file.Close()
+	br := bufio.NewReader(file)
+
+	var tombstones []memtable.RangeTombstone
+	var offset int64 = 0
+	for {
+		_, err = br.Peek(1)
+		if err == io.EOF {
+			return tombstones, nil
+		}
+		crc := make([]byte, 4)
+		timeStamp := make([]byte, 16)
+		sizes := make([]byte, 16)
+		for _, field := range [][]byte{crc, timeStamp, sizes} {
+			err = readField(br, field, path, offset)
+			if err != nil {
+				return nil, err
+			}
+		}
+		bounds := make([]byte, binary.LittleEndian.Uint64(sizes[:8])+binary.LittleEndian.Uint64(sizes[8:]))
+		err = readField(br, bounds, path, offset)
+		if err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(crc) != crc32.ChecksumIEEE(bounds) {
+			return nil, Errors.Corrupted(path, offset, "checksum mismatch")
+		}
+		startSize := binary.LittleEndian.Uint64(sizes[:8])
+		tombstone := memtable.RangeTombstone{TimeStamp: timeStamp}
+		tombstone.Start = string(bounds[:startSize])
+		tombstone.End = string(bounds[startSize:])
+		tombstones = append(tombstones, tombstone)
+		offset += int64(36 + len(bounds))
+	}
+}
+
+func PrintRangeTombstones(path string) error {
+	tombstones, err := ReadRangeTombstones(path)
+	if err != nil {
+		return err
+	}
+	for i, tombstone := range tombstones {
+		fmt.Println(i+1, ". Start: ", tombstone.Start, " End: ", tombstone.End, " Sequence: ", tombstone.Sequence())
+	}
+	return nil
+}
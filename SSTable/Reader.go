@@ -0,0 +1,94 @@
+package SSTable
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"os"
+	bloom_filter "project/structures/Bloom_Filter"
+	"project/structures/Errors"
+	"project/structures/memtable"
+)
+
+//=====================================================================================================================
+// Reader
+
+// Reader : One SSTable opened for many lookups
+// The filter, the summary and the range tombstones are read once, the Index and Data files stay open until Close
+type Reader struct {
+	prefix     string
+	filter     *bloom_filter.BloomFilter
+	summary    *Summary
+	index      *os.File
+	data       *os.File
+	dataSize   int64
+	Tombstones []memtable.RangeTombstone
+}
+
+// OpenReader : Opens the SSTable with the given path prefix (see TablePrefix)
+func OpenReader(prefix string) (*Reader, error) {
+	r := Reader{prefix: prefix}
+	var err error
+	r.filter, err = bloom_filter.ReadBloomFilter(prefix + "-Filter.db")
+	if err != nil {
+		return nil, err
+	}
+	r.summary, err = LoadSummary(prefix + "-Summary.db")
+	if err != nil {
+		return nil, err
+	}
+	r.Tombstones, err = ReadRangeTombstones(prefix + "-RangeDel.db")
+	if err != nil {
+		return nil, err
+	}
+	r.index, err = os.OpenFile(prefix+"-Index.db", os.O_RDONLY, 0700)
+	if err != nil {
+		return nil, Errors.IO("open", prefix+"-Index.db", err)
+	}
+	r.data, err = os.OpenFile(prefix+"-Data.db", os.O_RDONLY, 0700)
+	if err != nil {
+		r.index.Close()
+		return nil, Errors.IO("open", prefix+"-Data.db", err)
+	}
+	info, err := r.data.Stat()
+	if err != nil {
+		r.Close()
+		return nil, Errors.IO("stat", prefix+"-Data.db", err)
+	}
+	r.dataSize = info.Size()
+	return &r, nil
+}
+
+// Get : Returns the element of the key, nil if the SSTable doesn't contain it
+func (r *Reader) Get(key string) (*Element, error) {
+	if key < r.summary.FirstKey || key > r.summary.LastKey || !r.filter.Contains(key) {
+		return nil, nil
+	}
+	indexOffset, found := r.summary.Elements[key]
+	if !found {
+		return nil, nil
+	}
+	dataOffset, err := readIndexEntry(r.index, key, int64(indexOffset))
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(io.NewSectionReader(r.data, dataOffset, math.MaxInt64-dataOffset))
+	element, _, err := ReadElement(br, r.data.Name(), dataOffset, r.dataSize)
+	if err != nil {
+		return nil, err
+	}
+	if element == nil || element.Key != key {
+		return nil, Errors.Corrupted(r.data.Name(), dataOffset, "key not found in estimated position")
+	}
+	return element, nil
+}
+
+// Close : Closes the Index and Data files
+func (r *Reader) Close() error {
+	err := r.index.Close()
+	if err != nil {
+		r.data.Close()
+		return Errors.IO("close", r.index.Name(), err)
+	}
+	return Errors.IO("close", r.data.Name(), r.data.Close())
+}
@@ -1,128 +1,271 @@
 package SSTable
 
 import (
-	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"project/structures/Bloom_Filter"
+	"project/structures/Errors"
 	"project/structures/memtable"
 	"project/structures/merkle"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 //=====================================================================================================================
 // Universal function
 
-func Panic(err error) {
+// TableNumber : Number of the SSTable from its directory name "SSTable<N>", false if the name isn't of that form
+func TableNumber(name string) (int, bool) {
+	if !strings.HasPrefix(name, "SSTable") {
+		return 0, false
+	}
+	number, err := strconv.Atoi(name[7:])
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+// TableName : Directory name of the SSTable with the given number
+func TableName(number int) string {
+	return "SSTable" + strconv.Itoa(number)
+}
+
+// TEMP_SUFFIX : A table is written in to the directory with its name followed by the suffix and renamed once complete
+const TEMP_SUFFIX = ".tmp"
+
+// SyncPath : Waits for the file or the directory to reach the disk
+func SyncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return Errors.IO("open", path, err)
+	}
+	err = file.Sync()
+	closeErr := file.Close()
 	if err != nil {
-		panic(err.Error())
+		return Errors.IO("sync", path, err)
 	}
+	return Errors.IO("close", path, closeErr)
 }
 
-func FindLargestFile(files []fs.FileInfo) string {
-	if len(files) == 0 {
-		return "SSTable1"
-	} else if len(files) == 1 {
-		latestNumber, err := strconv.Atoi(files[0].Name()[7:])
-		Panic(err)
-		return "SSTable" + strconv.Itoa(latestNumber+1)
+// RemoveTemporary : Removes the directories of the tables that were still being written when the process stopped
+func RemoveTemporary(dir string, level int) error {
+	files, err := ioutil.ReadDir(LevelDir(dir, level))
+	if err != nil {
+		return Errors.IO("read directory", LevelDir(dir, level), err)
 	}
-	latestFile := files[0].Name()
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), TEMP_SUFFIX) {
+			continue
+		}
+		path := filepath.Join(LevelDir(dir, level), file.Name())
+		err = os.RemoveAll(path)
+		if err != nil {
+			return Errors.IO("remove", path, err)
+		}
+	}
+	return nil
+}
 
+// ListTables : Names of the SSTable directories of the level, sorted from the oldest to the newest
+// Anything that isn't an SSTable directory is skipped
+func ListTables(dir string, level int) ([]string, error) {
+	files, err := ioutil.ReadDir(LevelDir(dir, level))
+	if err != nil {
+		return nil, Errors.IO("read directory", LevelDir(dir, level), err)
+	}
+	numbers := make([]int, 0, len(files))
 	for _, file := range files {
-		latestNumber, err := strconv.Atoi(latestFile[7:])
-		Panic(err)
-		currentNumber, err := strconv.Atoi(file.Name()[7:])
-		Panic(err)
-		if currentNumber > latestNumber {
-			latestFile = file.Name()
+		number, ok := TableNumber(file.Name())
+		if ok && file.IsDir() {
+			numbers = append(numbers, number)
 		}
 	}
-	latestNumber, err := strconv.Atoi(latestFile[7:])
-	Panic(err)
-	return "SSTable" + strconv.Itoa(latestNumber+1)
+	sort.Ints(numbers)
+	tables := make([]string, len(numbers))
+	for i, number := range numbers {
+		tables[i] = TableName(number)
+	}
+	return tables, nil
 }
 
 //=====================================================================================================================
 // SSTable
 // a) Writing
 
-func CreateSSTable(level int) string {
-	/* For each SSTable a new folder is created inside "Data/SSTable"
-	 The numeric number of the new SSTable is calculated based on the
-	 numeric number of the latest SSTable, for example:
-	-Data
-	--SSTable
-	---SSTable1
-	---SSTable2
-	---SSTable3
-	---SSTable4
-	The next SSTable will be: SSTable5
+// LevelDir : Path to the directory of the given level inside the SSTable directory
+func LevelDir(dir string, level int) string {
+	return filepath.Join(dir, "Level"+strconv.Itoa(level))
+}
+
+// TablePrefix : Path prefix shared by all the files of one SSTable, the component name is appended to it
+func TablePrefix(dir string, level int, SSTableDirName string) string {
+	return filepath.Join(LevelDir(dir, level), SSTableDirName, "usertable-"+strconv.Itoa(level))
+}
+
+func CreateSSTable(dir string, level int, name string) error {
+	/* For each SSTable a new folder is created inside the level directory, e.g. "Data/SSTable/default/Level1"
+	-Level1
+	--SSTable1
+	--SSTable2
+	--SSTable5
+	The numbers are handed out by the manifest of the tree (see LSM.Manifest) and are never reused
+	The files are written in to "SSTable5.tmp" first, see CommitSSTable
 	*/
-	files, err := ioutil.ReadDir("./Data/SSTable/Level" + strconv.Itoa(level))
-	Panic(err)
+	path := filepath.Join(LevelDir(dir, level), name)
+	err := os.Mkdir(path, 0755)
+	if err != nil {
+		return Errors.IO("create directory", path, err)
+	}
+	return nil
+}
 
-	var newDirName string
+// CommitSSTable : Waits for the files of the table written in to its temporary directory to reach the disk and moves
+// the directory in to place, a table found under its own name is always complete
+func CommitSSTable(files *SSTableFiles, dir string, level int, name string) error {
+	err := files.Sync()
+	closeErr := files.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	tmpPath := filepath.Join(LevelDir(dir, level), name+TEMP_SUFFIX)
+	err = SyncPath(tmpPath)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(LevelDir(dir, level), name)
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return Errors.IO("rename", tmpPath, err)
+	}
+	return SyncPath(LevelDir(dir, level))
+}
 
-	newDirName = FindLargestFile(files)
-	//Create a directory in path : Project/Data/SSTable
-	err = os.Mkdir("./Data/SSTable/Level"+strconv.Itoa(level)+"/"+newDirName, 0755)
-	Panic(err)
+// SSTableFiles : The open files of one SSTable that is being written
+type SSTableFiles struct {
+	Data, Index, TOC, Filter, MetaData, Summary, RangeDel *os.File
+}
 
-	return newDirName
+// Close : Closes all the files, the first error is returned
+func (f *SSTableFiles) Close() error {
+	var first error
+	for _, file := range []*os.File{f.Data, f.Index, f.TOC, f.Filter, f.MetaData, f.Summary, f.RangeDel} {
+		if file == nil {
+			continue
+		}
+		err := file.Close()
+		if err != nil && first == nil {
+			first = Errors.IO("close", file.Name(), err)
+		}
+	}
+	return first
 }
 
-func CreateFilesOfSSTable(SSTableDirName string, level int) (*os.File, *os.File, *os.File, *os.File, *os.File, *os.File) {
+// Sync : Waits for all the files to reach the disk, the first error is returned
+func (f *SSTableFiles) Sync() error {
+	for _, file := range []*os.File{f.Data, f.Index, f.TOC, f.Filter, f.MetaData, f.Summary, f.RangeDel} {
+		err := file.Sync()
+		if err != nil {
+			return Errors.IO("sync", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+func CreateFilesOfSSTable(dir string, SSTableDirName string, level int) (*SSTableFiles, error) {
 	/* Each SSTable folder will contain the next files:
 	usertable-1-Data.db; usertable-1-Index.db; usertable-1-TOC.db; usertable-1-Filter.db; usertable-1-Metadata.db
+	usertable-1-Summary.db; usertable-1-RangeDel.db
 	*/
-	levelStr := strconv.Itoa(level)
-	prefix := "./Data/SSTable/Level" + levelStr + "/" + SSTableDirName + "/usertable-" + levelStr
-	data, err := os.Create(prefix + "-Data.db")
-	Panic(err)
-	index, err := os.Create(prefix + "-Index.db")
-	Panic(err)
-	TOC, err := os.Create(prefix + "-TOC.db")
-	Panic(err)
-	filter, err := os.Create(prefix + "-Filter.db")
-	Panic(err)
-	metaData, err := os.Create(prefix + "-Metadata.txt")
-	Panic(err)
-	summary, err := os.Create(prefix + "-Summary.db")
-	Panic(err)
-	return data, index, TOC, filter, metaData, summary
-}
-
-func CreateTOC(level int, file *os.File) {
-	toc := [6]string{"usertable-" + strconv.Itoa(level) + "-Data.db",
+	prefix := TablePrefix(dir, level, SSTableDirName)
+	files := SSTableFiles{}
+	var err error
+	for _, component := range []struct {
+		file   **os.File
+		suffix string
+	}{
+		{&files.Data, "-Data.db"},
+		{&files.Index, "-Index.db"},
+		{&files.TOC, "-TOC.db"},
+		{&files.Filter, "-Filter.db"},
+		{&files.MetaData, "-Metadata.txt"},
+		{&files.Summary, "-Summary.db"},
+		{&files.RangeDel, "-RangeDel.db"},
+	} {
+		*component.file, err = os.Create(prefix + component.suffix)
+		if err != nil {
+			files.Close()
+			return nil, Errors.IO("create", prefix+component.suffix, err)
+		}
+	}
+	return &files, nil
+}
+
+func CreateTOC(level int, file *os.File) error {
+	toc := [7]string{"usertable-" + strconv.Itoa(level) + "-Data.db",
 		"usertable-" + strconv.Itoa(level) + "-Index.db",
 		"usertable-" + strconv.Itoa(level) + "-TOC.txt",
 		"usertable-" + strconv.Itoa(level) + "-Filter.db",
 		"usertable-" + strconv.Itoa(level) + "-Metadata.db",
-		"usertable-" + strconv.Itoa(level) + "-Summary.db"}
+		"usertable-" + strconv.Itoa(level) + "-Summary.db",
+		"usertable-" + strconv.Itoa(level) + "-RangeDel.db"}
 	for _, eachFile := range toc {
 		_, err := file.WriteString(eachFile + "\n")
-		Panic(err)
+		if err != nil {
+			return Errors.IO("write", file.Name(), err)
+		}
 	}
+	return nil
+}
 
+// Flush : Writes the memtable as the SSTable with the given name on the first level of the SSTable directory (dir)
+// Nothing is left under the name if the table couldn't be written whole
+func Flush(dir string, name string, s *memtable.SkipList, falsePositiveRate float64) error {
+	tmpPath := filepath.Join(LevelDir(dir, 1), name+TEMP_SUFFIX)
+	err := CreateSSTable(dir, 1, name+TEMP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	files, err := CreateFilesOfSSTable(dir, name+TEMP_SUFFIX, 1)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	err = writeSSTable(files, s, falsePositiveRate)
+	if err != nil {
+		files.Close()
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	err = CommitSSTable(files, dir, 1, name)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+	}
+	return err
 }
 
-func Flush(s *memtable.SkipList) {
-	newDirName := CreateSSTable(1)
-	data, index, TOC, filter, metaData, summary := CreateFilesOfSSTable(newDirName, 1)
-	defer data.Close()
-	defer index.Close()
-	defer TOC.Close()
-	defer filter.Close()
-	defer metaData.Close()
-	defer summary.Close()
+func writeSSTable(files *SSTableFiles, s *memtable.SkipList, falsePositiveRate float64) error {
+	data, index, filter, metaData, summary := files.Data, files.Index, files.Filter, files.MetaData, files.Summary
 
 	// Creating the TOC
-	CreateTOC(1, TOC)
+	err := CreateTOC(1, files.TOC)
+	if err != nil {
+		return err
+	}
 
 	// Initializing the Bloom Filter
+	// A memtable that holds only range tombstones still gets a filter, it contains no keys
+	expectedElements := s.Size
+	if expectedElements == 0 {
+		expectedElements = 1
+	}
 	bloomFilter := bloom_filter.BloomFilter{}
-	bloomFilter.InitializeBloomFilter(s.Size, bloom_filter.FALSE_POSITIVE_RATE)
+	bloomFilter.InitializeBloomFilter(expectedElements, falsePositiveRate)
 
 	dataOffset := 0
 	indexOffset := 0
@@ -135,24 +278,29 @@ func Flush(s *memtable.SkipList) {
 	node := s.Head.Next[0]
 
 	// Writing the first element of the index into the summary
+	if node != nil {
+		summaryStruct.FirstKey = node.Key
+	}
 
-	summaryStruct.FirstKey = node.Key
-
-	// Creating an array of values to be put in the merkle tree
-	hashVal := make([][20]byte, s.Capacity)
+	// Creating an array of values to be put in the merkle tree, one for every element as the Writer does
+	hashVal := make([][20]byte, expectedElements)
 	i := 0 // index of hashVal
 
 	for node != nil {
 		// Turn the element into a binary array and write it into the Data file
 		binData := DataSegmentToBinary(node)
 		_, err := data.Write(binData)
-		Panic(err)
+		if err != nil {
+			return Errors.IO("write", data.Name(), err)
+		}
 
 		bloomFilter.AddElementBF(node.Key)
 
-		binIndex := IndexSegmentToBinary(node.Key, dataOffset)
+		binIndex := IndexEntryToBinary(node.Key, dataOffset)
 		_, err = index.Write(binIndex)
-		Panic(err)
+		if err != nil {
+			return Errors.IO("write", index.Name(), err)
+		}
 		// After we write the element into the data segment, we increase the data offset by its size
 		dataOffset += len(binData)
 
@@ -162,6 +310,9 @@ func Flush(s *memtable.SkipList) {
 
 		hashVal[i] = merkle.Hash(node.Value)
 		i++
+		if node.Sequence() > summaryStruct.MaxSequence {
+			summaryStruct.MaxSequence = node.Sequence()
+		}
 
 		nodeNext := node.Next[0]
 		// Writing the last element of the index into the summary
@@ -170,11 +321,25 @@ func Flush(s *memtable.SkipList) {
 		}
 		node = nodeNext
 	}
+	// Writing the range tombstones
+	for i := range s.RangeTombstones {
+		if sequence := s.RangeTombstones[i].Sequence(); sequence > summaryStruct.MaxSequence {
+			summaryStruct.MaxSequence = sequence
+		}
+	}
+	err = WriteRangeTombstones(s.RangeTombstones, files.RangeDel)
+	if err != nil {
+		return err
+	}
+
 	// Writing the metadata
 	Root := merkle.BuildTreeLeaf(hashVal)
 	merkleTree := merkle.MerkleRoot{Root: Root}
 	merkle.PreorderRecursive(merkleTree.Root, metaData)
 
-	bloom_filter.WriteBloomFilter(&bloomFilter, "", filter) // Writing the bloom filter
-	WriteSummary(&summaryStruct, summary)                   // Writing the summary
+	err = bloom_filter.WriteBloomFilter(&bloomFilter, "", filter) // Writing the bloom filter
+	if err != nil {
+		return err
+	}
+	return WriteSummary(&summaryStruct, summary) // Writing the summary
 }
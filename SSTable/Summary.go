@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"project/structures/Errors"
+	"strconv"
 )
 
 //=====================================================================================================================
@@ -13,13 +16,14 @@ import (
 
 type Summary struct {
 	FirstKey, LastKey string
+	MaxSequence       uint64 // Biggest sequence number of the elements in the SSTable
 	Elements          map[string]int
 }
 
-func WriteSummary(summaryStruct *Summary, file *os.File) {
-	//+---------------------+----------------+--------------------+---------------+
-	//| First Key Size (8B) | First Key (?B) | Last Key Size (8B) | Last Key (?B) |
-	//+---------------------+----------------+--------------------+---------------+
+func WriteSummary(summaryStruct *Summary, file *os.File) error {
+	//+---------------------+----------------+--------------------+---------------+-------------------+
+	//| First Key Size (8B) | First Key (?B) | Last Key Size (8B) | Last Key (?B) | Max Sequence (8B) |
+	//+---------------------+----------------+--------------------+---------------+-------------------+
 	// Rest of the info:
 	//+---------------+----------+---------------------+
 	//| Key Size (8B) | Key (?B) | Offset In Index(8B) |
@@ -34,7 +38,9 @@ func WriteSummary(summaryStruct *Summary, file *os.File) {
 	first = append(first, binFirstEl...)
 
 	_, err := file.Write(first)
-	Panic(err)
+	if err != nil {
+		return Errors.IO("write", file.Name(), err)
+	}
 
 	binLastEl := []byte(summaryStruct.LastKey)
 	lastElSize := make([]byte, 8)
@@ -43,96 +49,216 @@ func WriteSummary(summaryStruct *Summary, file *os.File) {
 	last := make([]byte, 0, size2)
 	last = append(last, lastElSize...)
 	last = append(last, binLastEl...)
+	maxSequence := make([]byte, 8)
+	binary.LittleEndian.PutUint64(maxSequence, summaryStruct.MaxSequence)
+	last = append(last, maxSequence...)
 
 	_, err = file.Write(last)
-	Panic(err)
+	if err != nil {
+		return Errors.IO("write", file.Name(), err)
+	}
 
 	for key, offset := range summaryStruct.Elements {
 		binaryInfo := IndexSegmentToBinary(key, offset)
 		_, err = file.Write(binaryInfo)
-		Panic(err)
+		if err != nil {
+			return Errors.IO("write", file.Name(), err)
+		}
 	}
-
+	return nil
 }
 
-func ReadSummary(path string, key string) int64 {
+// ReadSummary : Returns the offset of the key in the Index file, or -1 if the key is not in the SSTable
+func ReadSummary(path string, key string) (int64, error) {
 	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
-	Panic(err)
+	if err != nil {
+		return -1, Errors.IO("open", path, err)
+	}
 	defer file.Close()
-	_, err = file.Seek(0, 0)
-	Panic(err)
 	br := bufio.NewReader(file)
 
+	var position int64 = 0
 	keySize := make([]byte, 8)
-	_, err = br.Read(keySize)
-	Panic(err)
+	err = readField(br, keySize, path, position)
+	if err != nil {
+		return -1, err
+	}
 	firstElement := make([]byte, binary.LittleEndian.Uint64(keySize))
-	_, err = br.Read(firstElement)
-	Panic(err)
+	err = readField(br, firstElement, path, position)
+	if err != nil {
+		return -1, err
+	}
 	if key < string(firstElement) {
-		return -1
+		return -1, nil
+	}
+	position += int64(8 + len(firstElement))
+	err = readField(br, keySize, path, position)
+	if err != nil {
+		return -1, err
 	}
-	keySize = make([]byte, 8)
-	_, err = br.Read(keySize)
-	Panic(err)
 	lastElement := make([]byte, binary.LittleEndian.Uint64(keySize))
-	_, err = br.Read(lastElement)
-	Panic(err)
+	err = readField(br, lastElement, path, position)
+	if err != nil {
+		return -1, err
+	}
 	if key > string(lastElement) {
-		return -1
+		return -1, nil
+	}
+	position += int64(8 + len(lastElement))
+	maxSequence := make([]byte, 8)
+	err = readField(br, maxSequence, path, position)
+	if err != nil {
+		return -1, err
 	}
+	position += 8
 
-	for err == nil {
-		keySize = make([]byte, 8)
-		_, err = br.Read(keySize)
+	for {
+		_, err = br.Peek(1)
+		if err == io.EOF {
+			return -1, nil
+		}
+		err = readField(br, keySize, path, position)
 		if err != nil {
-			break
+			return -1, err
 		}
 		currentKey := make([]byte, binary.LittleEndian.Uint64(keySize))
-		_, err = br.Read(currentKey)
+		err = readField(br, currentKey, path, position)
 		if err != nil {
-			break
+			return -1, err
 		}
 		offset := make([]byte, 8)
-		_, err = br.Read(offset)
+		err = readField(br, offset, path, position)
 		if err != nil {
-			break
+			return -1, err
 		}
 		if key == string(currentKey) {
+			return int64(binary.LittleEndian.Uint64(offset)), nil
+		}
+		position += int64(16 + len(currentKey))
+	}
+}
+
+// LoadSummary : Reads the whole Summary file, used when many keys are looked up in the same SSTable
+func LoadSummary(path string) (*Summary, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
+	if err != nil {
+		return nil, Errors.IO("open", path, err)
+	}
+	defer file.Close()
+	return readSummary(file)
+}
+
+// readSummary : Reads the whole opened Summary file from its beginning
+func readSummary(file *os.File) (*Summary, error) {
+	path := file.Name()
+	br := bufio.NewReader(io.NewSectionReader(file, 0, math.MaxInt64))
+
+	summary, position, err := readSummaryHeader(br, path)
+	if err != nil {
+		return nil, err
+	}
+	summary.Elements = make(map[string]int)
+	keySize := make([]byte, 8)
+	for {
+		_, err = br.Peek(1)
+		if err == io.EOF {
+			return summary, nil
+		}
+		err = readField(br, keySize, path, position)
+		if err != nil {
+			return nil, err
+		}
+		currentKey := make([]byte, binary.LittleEndian.Uint64(keySize))
+		err = readField(br, currentKey, path, position)
+		if err != nil {
+			return nil, err
+		}
+		offset := make([]byte, 8)
+		err = readField(br, offset, path, position)
+		if err != nil {
+			return nil, err
+		}
+		summary.Elements[string(currentKey)] = int(binary.LittleEndian.Uint64(offset))
+		position += int64(16 + len(currentKey))
+	}
+}
+
+// ReadSummaryHeader : Returns the first key, the last key and the biggest sequence number of the SSTable
+// The keys of the summary are not read, Elements stays nil
+func ReadSummaryHeader(path string) (*Summary, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
+	if err != nil {
+		return nil, Errors.IO("open", path, err)
+	}
+	defer file.Close()
+	summary, _, err := readSummaryHeader(bufio.NewReader(file), path)
+	return summary, err
+}
 
-			return int64(binary.LittleEndian.Uint64(offset))
+// readSummaryHeader : Reads the fields in front of the keys, the second return value is the position after them
+func readSummaryHeader(br *bufio.Reader, path string) (*Summary, int64, error) {
+	summary := Summary{}
+	var position int64 = 0
+	keySize := make([]byte, 8)
+	for _, bound := range []*string{&summary.FirstKey, &summary.LastKey} {
+		err := readField(br, keySize, path, position)
+		if err != nil {
+			return nil, 0, err
 		}
+		key := make([]byte, binary.LittleEndian.Uint64(keySize))
+		err = readField(br, key, path, position)
+		if err != nil {
+			return nil, 0, err
+		}
+		*bound = string(key)
+		position += int64(8 + len(key))
 	}
-	if err == io.EOF {
-		return -1
-	} else {
-		panic(err)
+	maxSequence := make([]byte, 8)
+	err := readField(br, maxSequence, path, position)
+	if err != nil {
+		return nil, 0, err
 	}
+	summary.MaxSequence = binary.LittleEndian.Uint64(maxSequence)
+	return &summary, position + 8, nil
 }
 
-func PrintSummary(path string) {
+func PrintSummary(path string) error {
 	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
-	Panic(err)
+	if err != nil {
+		return Errors.IO("open", path, err)
+	}
 	defer file.Close()
-	_, err = file.Seek(0, 0)
-	Panic(err)
 	br := bufio.NewReader(file)
 
 	keySize := make([]byte, 8)
-	_, err = br.Read(keySize)
-	Panic(err)
+	err = readField(br, keySize, path, 0)
+	if err != nil {
+		return err
+	}
 	firstElement := make([]byte, binary.LittleEndian.Uint64(keySize))
-	_, err = br.Read(firstElement)
-	Panic(err)
+	err = readField(br, firstElement, path, 0)
+	if err != nil {
+		return err
+	}
 	fmt.Println("First element of Index: ", string(firstElement))
 
 	keySize2 := make([]byte, 8)
-	_, err = br.Read(keySize2)
-	Panic(err)
+	err = readField(br, keySize2, path, 0)
+	if err != nil {
+		return err
+	}
 	lastElement := make([]byte, binary.LittleEndian.Uint64(keySize2))
-	_, err = br.Read(lastElement)
-	Panic(err)
+	err = readField(br, lastElement, path, 0)
+	if err != nil {
+		return err
+	}
 	fmt.Println("\nLast element of Index: ", string(lastElement))
+	maxSequence := make([]byte, 8)
+	err = readField(br, maxSequence, path, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nMax sequence: ", binary.LittleEndian.Uint64(maxSequence))
 
 	i := 1
 	for err == nil {
@@ -151,6 +277,39 @@ func PrintSummary(path string) {
 		if err != nil {
 			break
 		}
-		fmt.Println(string(i), ". Key: ", string(currentKey), " Offset: ", binary.LittleEndian.Uint64(offset))
+		fmt.Println(strconv.Itoa(i), ". Key: ", string(currentKey), " Offset: ", binary.LittleEndian.Uint64(offset))
+		i++
+	}
+	return nil
+}
+
+// ReadMaxSequence : Returns the biggest sequence number of the elements in the SSTable
+func ReadMaxSequence(path string) (uint64, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
+	if err != nil {
+		return 0, Errors.IO("open", path, err)
+	}
+	defer file.Close()
+	br := bufio.NewReader(file)
+
+	var position int64 = 0
+	keySize := make([]byte, 8)
+	// The first and the last key are skipped
+	for i := 0; i < 2; i++ {
+		err = readField(br, keySize, path, position)
+		if err != nil {
+			return 0, err
+		}
+		_, err = br.Discard(int(binary.LittleEndian.Uint64(keySize)))
+		if err != nil {
+			return 0, Errors.Corrupted(path, position, "record is cut short")
+		}
+		position += int64(8 + binary.LittleEndian.Uint64(keySize))
+	}
+	maxSequence := make([]byte, 8)
+	err = readField(br, maxSequence, path, position)
+	if err != nil {
+		return 0, err
 	}
+	return binary.LittleEndian.Uint64(maxSequence), nil
 }
@@ -0,0 +1,164 @@
+package SSTable
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	bloom_filter "project/structures/Bloom_Filter"
+	"project/structures/Errors"
+	"project/structures/memtable"
+	"project/structures/merkle"
+)
+
+//=====================================================================================================================
+// Writer
+
+// ElementToBinary : Record of the Data file holding the element, the same layout DataSegmentToBinary writes
+func ElementToBinary(element *Element) []byte {
+	tombStone := byte(0)
+	if element.Tombstone {
+		tombStone = TOMBSTONE
+	} else if element.Operand {
+		tombStone = OPERAND
+	}
+	record := make([]byte, DATA_HEADER_SIZE, DATA_HEADER_SIZE+len(element.Key)+len(element.Value))
+	binary.LittleEndian.PutUint32(record[0:], crc32.ChecksumIEEE(element.Value))
+	binary.LittleEndian.PutUint64(record[4:], element.Timestamp)
+	binary.LittleEndian.PutUint64(record[12:], element.Sequence)
+	record[20] = tombStone
+	binary.LittleEndian.PutUint64(record[21:], uint64(element.Expiry))
+	binary.LittleEndian.PutUint64(record[29:], uint64(len(element.Key)))
+	binary.LittleEndian.PutUint64(record[37:], uint64(len(element.Value)))
+	record = append(record, element.Key...)
+	return append(record, element.Value...)
+}
+
+// Writer : Writes a new SSTable one element at a time, the elements have to be added in the order of their keys
+// Used by the compactions, a memtable is written at once by Flush
+// The table is written in to a temporary directory that gets its name only once Finish is done
+type Writer struct {
+	Name        string // Directory of the SSTable inside its level, e.g. "SSTable3"
+	root        string // SSTable directory the level is in
+	level       int
+	dir         string // Temporary directory until the table is finished
+	files       *SSTableFiles
+	filter      bloom_filter.BloomFilter
+	summary     Summary
+	hashes      [][20]byte
+	dataOffset  int
+	indexOffset int
+}
+
+// NewWriter : Creates the SSTable with the given name on the level, expectedElements sizes its bloom filter
+func NewWriter(dir string, level int, name string, expectedElements int, falsePositiveRate float64) (*Writer, error) {
+	err := CreateSSTable(dir, level, name+TEMP_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	w := Writer{Name: name, root: dir, level: level, dir: filepath.Join(LevelDir(dir, level), name+TEMP_SUFFIX)}
+	w.files, err = CreateFilesOfSSTable(dir, name+TEMP_SUFFIX, level)
+	if err != nil {
+		os.RemoveAll(w.dir)
+		return nil, err
+	}
+	err = CreateTOC(level, w.files.TOC)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if expectedElements < 1 {
+		expectedElements = 1
+	}
+	w.filter.InitializeBloomFilter(expectedElements, falsePositiveRate)
+	w.summary.Elements = make(map[string]int)
+	return &w, nil
+}
+
+// Add : Appends the element to the Data file and records it in the index, the summary and the filter
+func (w *Writer) Add(element *Element) error {
+	binData := ElementToBinary(element)
+	_, err := w.files.Data.Write(binData)
+	if err != nil {
+		return Errors.IO("write", w.files.Data.Name(), err)
+	}
+	binIndex := IndexEntryToBinary(element.Key, w.dataOffset)
+	_, err = w.files.Index.Write(binIndex)
+	if err != nil {
+		return Errors.IO("write", w.files.Index.Name(), err)
+	}
+	if len(w.hashes) == 0 {
+		w.summary.FirstKey = element.Key
+	}
+	w.summary.LastKey = element.Key
+	w.summary.Elements[element.Key] = w.indexOffset
+	if element.Sequence > w.summary.MaxSequence {
+		w.summary.MaxSequence = element.Sequence
+	}
+	w.dataOffset += len(binData)
+	w.indexOffset += len(binIndex)
+	w.hashes = append(w.hashes, merkle.Hash(element.Value))
+	w.filter.AddElementBF(element.Key)
+	return nil
+}
+
+// Size : Number of bytes written to the Data file so far
+func (w *Writer) Size() int64 {
+	return int64(w.dataOffset)
+}
+
+// Count : Number of elements written so far
+func (w *Writer) Count() int {
+	return len(w.hashes)
+}
+
+// Finish : Writes the range tombstones, the metadata, the filter and the summary and moves the table in to place
+func (w *Writer) Finish(tombstones []memtable.RangeTombstone) error {
+	err := w.finish(tombstones)
+	if err != nil {
+		w.files.Close()
+		return err
+	}
+	err = CommitSSTable(w.files, w.root, w.level, w.Name)
+	if err != nil {
+		return err
+	}
+	w.dir = filepath.Join(LevelDir(w.root, w.level), w.Name)
+	return nil
+}
+
+func (w *Writer) finish(tombstones []memtable.RangeTombstone) error {
+	for i := range tombstones {
+		if sequence := tombstones[i].Sequence(); sequence > w.summary.MaxSequence {
+			w.summary.MaxSequence = sequence
+		}
+	}
+	err := WriteRangeTombstones(tombstones, w.files.RangeDel)
+	if err != nil {
+		return err
+	}
+	hashes := w.hashes
+	if len(hashes) == 0 {
+		// The merkle tree needs at least one leaf
+		hashes = make([][20]byte, 1)
+	}
+	Root := merkle.BuildTreeLeaf(hashes)
+	merkleTree := merkle.MerkleRoot{Root: Root}
+	merkle.PreorderRecursive(merkleTree.Root, w.files.MetaData)
+
+	err = bloom_filter.WriteBloomFilter(&w.filter, "", w.files.Filter)
+	if err != nil {
+		return err
+	}
+	return WriteSummary(&w.summary, w.files.Summary)
+}
+
+// Abort : Closes the files and removes the SSTable, finished or not
+func (w *Writer) Abort() error {
+	w.files.Close()
+	err := os.RemoveAll(w.dir)
+	if err != nil {
+		return Errors.IO("remove", w.dir, err)
+	}
+	return nil
+}
@@ -5,14 +5,6 @@ const (
 	DEFAULT_INTERVAL = 10
 )
 
-var MAX_REQ int
-var INTERVAL int64
-
-func SetDefaultParam() {
-	MAX_REQ = DEFAULT_MAX_REQUEST
-	INTERVAL = DEFAULT_INTERVAL
-}
-
 type TokenBucket struct {
 	MaxReq int
 	Interval int64
@@ -20,10 +12,22 @@ type TokenBucket struct {
 	LastReset int64
 }
 
-func NewTokenBucket() *TokenBucket {
+func NewTokenBucket(maxReq int, interval int64) *TokenBucket {
 	t := new(TokenBucket)
-	t.MaxReq = MAX_REQ
-	t.Interval = INTERVAL
+	t.MaxReq = maxReq
+	t.Interval = interval
 	return t
 }
 
+// Allow : Takes one token from the bucket, returns false when there are too many requests for the set time interval
+func (t *TokenBucket) Allow(now int64) bool {
+	if now-t.LastReset >= t.Interval {	// Interval has passed, counters are reset
+		t.LastReset = now
+		t.AvailableReq = t.MaxReq
+	}
+	if t.AvailableReq > 0 {
+		t.AvailableReq -= 1
+		return true
+	}
+	return false
+}
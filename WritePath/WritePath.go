@@ -1,53 +1,251 @@
 package WritePath
 
 import (
-	"io/ioutil"
-	"os"
-	"project/structures/SSTable"
+	"project/structures/LSM"
+	"project/structures/MergeOperator"
 	"project/structures/lru"
 	"project/structures/memtable"
 	wal "project/structures/mmap"
-	"strconv"
 	"time"
 )
 
-var WalSegmentName string  // Path to current Wal segment that gets appended
-var SegmentElements uint64   // Number of elements in current Wal segment
+// Family : Memtable, cache and SSTables of one column family
+// All the families of a database share one log, when any memtable is full all of them are made immutable
+type Family struct {
+	Name  string
+	Tree  *LSM.LSM
+	Mem   *memtable.SkipList
+	Log   wal.Range    // Records of the log that Mem holds
+	Imm   []*Immutable // Full memtables waiting to be flushed, from the oldest
+	Cache *lru.Cache
+}
 
-func WritePath(memtable *memtable.SkipList, cache *lru.Cache, key string, value []byte) {
+// Immutable : Memtable that no longer takes writes, the segments its records are in stay until it is flushed
+type Immutable struct {
+	Mem *memtable.SkipList
+	Log wal.Range
+}
 
-	if SegmentElements+1 > wal.SEGMENT_SIZE {	// Wal segment at capacity - new segment is created
-		CreateLogFile()
-		SegmentElements = 0
+// Memtables : The memtable and the immutable memtables of the family ordered from the newest, reads go through all of them
+func (family *Family) Memtables() []*memtable.SkipList {
+	memtables := []*memtable.SkipList{family.Mem}
+	for i := len(family.Imm) - 1; i >= 0; i-- {
+		memtables = append(memtables, family.Imm[i].Mem)
 	}
-	err := wal.Add(key, value, WalSegmentName, false)
+	return memtables
+}
+
+// Families : Column families of a database by name
+type Families map[string]*Family
+
+// Memtables : Memtables of the families by name, the log is loaded back in to them
+func (families Families) Memtables() map[string]*memtable.SkipList {
+	memtables := make(map[string]*memtable.SkipList, len(families))
+	for name, family := range families {
+		memtables[name] = family.Mem
+	}
+	return memtables
+}
+
+// WritePath : Writes the value under the key of the family, sequence is the sequence number given to the write
+// expiry is the time in seconds after which the value is treated as absent, 0 if it never expires
+func WritePath(log *wal.Wal, families Families, family *Family, key string, value []byte, sequence uint64, expiry int64) error {
+
+	err := log.Add(family.Name, key, value, false, sequence, expiry)
 	if err == nil { 		// Commit log confirmed entry
-		SegmentElements += 1
-		_, found := cache.Find(key)
+		family.Log.Add(log.Last())
+		_, found := family.Cache.Find(key)
 		if found {
-			cache.Update(key, value, uint64(time.Now().Unix()), false)
+			family.Cache.Update(key, value, uint64(time.Now().Unix()), sequence, false, expiry)
 		}
-		forFlush := memtable.Insert(key, value, time.Now().Unix())
+		forFlush := family.Mem.InsertWithExpiry(key, value, time.Now().Unix(), sequence, expiry)
 		if forFlush != nil {			// Memtable up to capacity, flush to disk
-			SSTable.Flush(forFlush)
-			memtable.NewSkipList()		// Reset memtable
-			wal.DeleteWal()
+			return flush(log, families)
 		}
 	}
+	return err
+}
+
+// flush : Makes the memtables immutable and gives the families new ones, the log continues in a new segment
+// The immutable memtables are written to the disk later by FlushImmutable
+func flush(log *wal.Wal, families Families) error {
+	err := log.Rotate()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if !family.Mem.Empty() {
+			family.Imm = append(family.Imm, &Immutable{Mem: family.Mem, Log: family.Log})
+			family.Mem = memtable.NewMemtable(family.Mem.MaxHeight, family.Mem.Capacity, family.Mem.CapacityBytes)
+		}
+		family.Log = wal.Range{}
+	}
+	return nil
+}
 
+// Flushing : Reports whether any family has an immutable memtable that wasn't flushed yet
+func (families Families) Flushing() bool {
+	for _, family := range families {
+		if len(family.Imm) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
-// CreateLogFile : Wal directory has n segments. Function creates (n+1)th segment to be current segment for appending
-func CreateLogFile() {
-	files, err := ioutil.ReadDir("./Wal")
+// FlushImmutable : Writes the immutable memtable that holds the oldest records of the log to the disk, false if there
+// was none
+// Afterwards the log segments whose records are all in the SSTables are removed, a segment stays as long as any
+// memtable of any family holds one of its records
+// If the flush fails, the data stays in the log and the flush is tried again
+// The memtable stays among the immutable ones while its SSTable is written, only one flush may run at a time
+func FlushImmutable(log *wal.Wal, families Families) (bool, error) {
+	var oldest *Family
+	for _, family := range families {
+		if len(family.Imm) > 0 && (oldest == nil || family.Imm[0].Log.First.Before(oldest.Imm[0].Log.First)) {
+			oldest = family
+		}
+	}
+	if oldest == nil {
+		return false, nil
+	}
+	err := oldest.Tree.Flush(oldest.Imm[0].Mem)
 	if err != nil {
-		panic(err.Error())
+		return false, err
+	}
+	oldest.Imm = oldest.Imm[1:]
+	return true, log.DeleteSegments(families.FirstSegment())
+}
+
+// FirstSegment : Log segment of the oldest record that is only in a memtable, 0 if every record is flushed
+func (families Families) FirstSegment() int {
+	first := 0
+	for _, family := range families {
+		ranges := []wal.Range{family.Log}
+		for _, immutable := range family.Imm {
+			ranges = append(ranges, immutable.Log)
+		}
+		for _, logRange := range ranges {
+			if !logRange.Empty() && (first == 0 || logRange.First.Segment < first) {
+				first = logRange.First.Segment
+			}
+		}
 	}
-	offset := strconv.Itoa(len(files)+1)
-	file, err := os.Create("./Wal"+ "/" + "wal_" + offset + ".db")
-	defer file.Close()
+	return first
+}
+
+// FlushMemtables : Writes every memtable that isn't empty to the SSTables of its family and resets it
+func FlushMemtables(families Families) error {
+	for _, family := range families {
+		if family.Mem.Empty() {
+			continue
+		}
+		err := family.Tree.Flush(family.Mem)
+		if err != nil {
+			return err
+		}
+		family.Mem.NewSkipList()		// Reset memtable
+		family.Log = wal.Range{}
+	}
+	return nil
+}
+
+// DeletePath : Logical delete, the tombstone is written to the log, the cache and the memtable of the family
+func DeletePath(log *wal.Wal, families Families, family *Family, key string, sequence uint64) error {
+
+	err := log.Add(family.Name, key, []byte(""), true, sequence, 0)
+	if err == nil { 		// Commit log confirmed entry
+		family.Log.Add(log.Last())
+		_, found := family.Cache.Find(key)
+		if found {
+			family.Cache.Update(key, []byte(""), uint64(time.Now().Unix()), sequence, true, 0)
+		}
+		// The tombstone gets its own sequence number, the key is inserted again and then deleted
+		a := family.Mem.Insert(key, []byte(""), time.Now().Unix(), sequence)
+		family.Mem.Delete(key)
+		if a != nil {			// Memtable up to capacity, flush to disk
+			return flush(log, families)
+		}
+	}
+	return err
+}
+
+// DeleteRangePath : Deletes every key of the family in [start, end) with one range tombstone
+// The tombstone is written to the log and the memtable, the cached elements of the range are dropped
+func DeleteRangePath(log *wal.Wal, families Families, family *Family, start, end string, sequence uint64) error {
+
+	err := log.AddDeleteRange(family.Name, start, end, sequence)
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	family.Log.Add(log.Last())
+	family.Cache.RemoveRange(start, end)
+	forFlush := family.Mem.DeleteRange(start, end, time.Now().Unix(), sequence)
+	if forFlush != nil {			// Memtable up to capacity, flush to disk
+		return flush(log, families)
 	}
-	WalSegmentName = "./Wal"+ "/" +"wal_" + offset + ".db"
-}
\ No newline at end of file
+	return nil
+}
+
+// MergePath : The merge operand is written to the log and applied to the element of the key in the memtable
+// The operand is checked against the memtable first, one the operator rejects is neither logged nor applied
+// The cached element of the key becomes stale, it is dropped and the next read folds the operand again
+func MergePath(log *wal.Wal, families Families, family *Family, op MergeOperator.MergeOperator, key string, operand []byte, sequence uint64) error {
+
+	now := time.Now().Unix()
+	err := family.Mem.CheckMerge(key, operand, now, sequence, op)
+	if err != nil {
+		return err
+	}
+	err = log.AddMerge(family.Name, key, operand, sequence)
+	if err != nil {
+		return err
+	}
+	family.Log.Add(log.Last())
+	family.Cache.Remove(key)
+	forFlush, err := family.Mem.Merge(key, operand, now, sequence, op)
+	if err != nil {
+		return err
+	}
+	if forFlush != nil {			// Memtable up to capacity, flush to disk
+		return flush(log, families)
+	}
+	return nil
+}
+
+// WriteBatch : The batch is logged as one record, then all of its operations are applied to the caches and the memtables
+// The operations get consecutive sequence numbers starting from sequence
+// Every family named in the batch has to be one of the families, otherwise nothing is written
+func WriteBatch(log *wal.Wal, families Families, batch *wal.WriteBatch, sequence uint64) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	memtables := families.Memtables()
+	// Checked before logging, a batch with an unknown family couldn't be loaded back from the log
+	err := batch.CheckFamilies(memtables)
+	if err != nil {
+		return err
+	}
+	err = log.AddBatch(batch, sequence)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	location := log.Last()
+	for i, entry := range batch.Entries {
+		families[entry.Family].Log.Add(location)
+		cache := families[entry.Family].Cache
+		_, found := cache.Find(entry.Key)
+		if found {
+			cache.Update(entry.Key, entry.Value, uint64(now), sequence+uint64(i), entry.Tombstone, 0)
+		}
+	}
+	full, err := batch.Apply(memtables, now, sequence, nil)
+	if err != nil {
+		return err
+	}
+	if full {			// Memtable up to capacity, flush to disk
+		return flush(log, families)
+	}
+	return nil
+}
@@ -3,10 +3,9 @@ package lru
 import (
 	"container/list"
 	"fmt"
+	"time"
 )
 
-var CAPACITY int
-
 const (
 	DEFAULT_CAPACITY = 10
 )
@@ -26,12 +25,19 @@ type Information struct {
 	Key       string
 	Value     []byte
 	Timestamp uint64
+	Sequence  uint64
 	Tombstone bool
+	Expiry    int64 // Time in seconds after which the element is treated as absent, 0 if it never expires
+}
+
+// Expired : Reports whether the element expired by the given time in seconds
+func (info *Information) Expired(now int64) bool {
+	return info.Expiry != 0 && info.Expiry <= now
 }
 
-func NewCache() *Cache {
+func NewCache(capacity int) *Cache {
 	c := new(Cache)
-	c.capacity = CAPACITY
+	c.capacity = capacity
 	c.dataMap = make(map[string]*list.Element)
 	c.data = list.New()
 	return c
@@ -40,19 +46,21 @@ func NewCache() *Cache {
 func (cache *Cache) ContainsKey(key string) {
 }
 
-func SetDefaultParam() {
-	CAPACITY = DEFAULT_CAPACITY
-}
-
 func (cache *Cache) PrintCapacity() {
 	fmt.Println(cache.capacity)
 }
 
 // Find : Returns Information object or nil and bool depending on whether the element was found by key
+// Expired elements are removed from the cache and reported as not found
 func (cache *Cache) Find(key string) (*Information, bool) {
 	listItem, found := cache.dataMap[key]
 	if found {
 		p := listItem.Value.(Pair)
+		if p.Value.Expired(time.Now().Unix()) {
+			delete(cache.dataMap, key)
+			cache.data.Remove(listItem)
+			return nil, false
+		}
 		if p.Value.Tombstone != true {
 			return &p.Value, true
 		} else {
@@ -83,14 +91,36 @@ func (cache *Cache) Add(key string, info Information) {
 
 }
 
-func (cache *Cache) Update(key string, value []byte, time uint64, tombstone bool) {
+func (cache *Cache) Update(key string, value []byte, time uint64, sequence uint64, tombstone bool, expiry int64) {
 	listItem, found := cache.dataMap[key]
 	if found {
 		pair := listItem.Value.(Pair)
-		inf := pair.Value
-		inf.Value = value
-		inf.Timestamp = time
-		inf.Tombstone = tombstone
+		pair.Value.Value = value
+		pair.Value.Timestamp = time
+		pair.Value.Sequence = sequence
+		pair.Value.Tombstone = tombstone
+		pair.Value.Expiry = expiry
+		// Pairs are stored by value, the updated copy has to be put back in the list
+		listItem.Value = pair
+	}
+}
+
+// Remove : Drops the element of the key from the cache, if it is there
+func (cache *Cache) Remove(key string) {
+	listItem, found := cache.dataMap[key]
+	if found {
+		delete(cache.dataMap, key)
+		cache.data.Remove(listItem)
+	}
+}
+
+// RemoveRange : Drops the elements of all the keys in [start, end) from the cache, an empty end means there is no upper bound
+func (cache *Cache) RemoveRange(start, end string) {
+	for key, listItem := range cache.dataMap {
+		if key >= start && (end == "" || key < end) {
+			delete(cache.dataMap, key)
+			cache.data.Remove(listItem)
+		}
 	}
 }
 
@@ -2,23 +2,22 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"project/structures/CRUD"
-	"project/structures/Initialization"
+	"project/structures/Configuration"
+	"project/structures/DB"
+	"project/structures/Errors"
 	"project/structures/ReadPath"
-	"project/structures/TokenBucket"
-	"project/structures/WritePath"
-	"project/structures/lru"
-	"project/structures/memtable"
-	wal "project/structures/mmap"
+	"strconv"
 	"strings"
-	"time"
 )
 
-func ReadUserInput(mem *memtable.SkipList, cache *lru.Cache) {
+func ReadUserInput(db *DB.DB) {
 	fmt.Println("Input the command you wish to be executed (c - create; r - read; u - update; d - delete)")
+	fmt.Println("(s - compare and swap; a - put if absent; i - increment; x - delete range)")
 	fmt.Println(">> ")
 	var crud string
 	fmt.Scanln(&crud)
@@ -31,32 +30,158 @@ func ReadUserInput(mem *memtable.SkipList, cache *lru.Cache) {
 		var value string
 		fmt.Println("Input the value: \n>>")
 		fmt.Scanln(&value)
-		CRUD.Create(mem, cache, key, []byte(value))
+		if err := CRUD.Create(db, key, []byte(value)); err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
 		fmt.Println("Successfully created an element ")
 	case "u", "U":
 		// Writing
 		var value string
 		fmt.Println("Input the value: \n>>")
 		fmt.Scanln(&value)
-		CRUD.Update(mem, cache, key, []byte(value))
+		if err := CRUD.Update(db, key, []byte(value)); err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
 		fmt.Println("Successfully updated an element ")
 	case "d", "D":
 		//Writing
-		CRUD.Delete(mem, cache, key)
+		if err := CRUD.Delete(db, key); err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
 		fmt.Println("Successfully deleted an element ")
+	case "x", "X":
+		// The key is the start of the range
+		var end string
+		fmt.Println("Input the end of the range (excluded), empty for no end: \n>>")
+		fmt.Scanln(&end)
+		if err := CRUD.DeleteRange(db, key, end); err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
+		fmt.Println("Successfully deleted the range ")
 	case "r", "R":
 		//Reading
-		element := CRUD.Read(mem, cache, key)
-		ReadPath.PrintElement(element)
+		printRead(db, key)
+	case "s", "S":
+		// Conditional write
+		var expected, value string
+		fmt.Println("Input the expected value: \n>>")
+		fmt.Scanln(&expected)
+		fmt.Println("Input the new value: \n>>")
+		fmt.Scanln(&value)
+		swapped, err := CRUD.CompareAndSwap(db, key, []byte(expected), []byte(value))
+		printConditional(swapped, err)
+	case "a", "A":
+		// Conditional write
+		var value string
+		fmt.Println("Input the value: \n>>")
+		fmt.Scanln(&value)
+		written, err := CRUD.PutIfAbsent(db, key, []byte(value))
+		printConditional(written, err)
+	case "i", "I":
+		var deltaStr string
+		fmt.Println("Input the number to add: \n>>")
+		fmt.Scanln(&deltaStr)
+		delta, err := strconv.ParseInt(deltaStr, 10, 64)
+		if err != nil {
+			fmt.Println("Invalid number, try again")
+			return
+		}
+		if err := printIncrement(db, key, delta); err != nil {
+			fmt.Println("Error: ", err)
+		}
 	default:
 		fmt.Println("Invalid command, try again")
 	}
 }
 
-func ReadFileInput(path string, mem *memtable.SkipList, cache *lru.Cache) {
+// printRead : Reads the key and prints the element, errors other than a missing key are printed as well
+func printRead(db *DB.DB, key string) {
+	element, err := CRUD.Read(db, key)
+	if err != nil && !errors.Is(err, Errors.ErrNotFound) {
+		fmt.Println("Error: ", err)
+		return
+	}
+	ReadPath.PrintElement(element)
+}
+
+// printConditional : Prints the outcome of a compare and swap or a put if absent
+func printConditional(written bool, err error) {
+	if err != nil {
+		fmt.Println("Error: ", err)
+	} else if written {
+		fmt.Println("Successfully written")
+	} else {
+		fmt.Println("Condition not met, nothing was written")
+	}
+}
+
+func printIncrement(db *DB.DB, key string, delta int64) error {
+	number, err := CRUD.Increment(db, key, delta)
+	if err != nil {
+		return err
+	}
+	fmt.Println("New value of ", key, ": ", number)
+	return nil
+}
+
+// printPage : Prints one page of a prefix scan and returns the token of the next page
+func printPage(db *DB.DB, prefix string, limit int, token string) (string, error) {
+	list, next, err := CRUD.PrefixScan(db, prefix, limit, token)
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		fmt.Println("No keys found")
+	}
+	for i, pair := range list {
+		fmt.Println(i+1, ". Key: ", pair.Key, "; Value: ", string(pair.Value))
+	}
+	if next != "" {
+		fmt.Println("Continuation token: ", next)
+	}
+	return next, nil
+}
+
+func ReadPrefixScan(db *DB.DB) {
+	var prefix string
+	fmt.Println("Input the key prefix: \n>> ")
+	fmt.Scanln(&prefix)
+	var limitStr string
+	fmt.Println("Input the number of keys per page: \n>> ")
+	fmt.Scanln(&limitStr)
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		fmt.Println("Invalid number of keys, try again")
+		return
+	}
+	token := ""
+	for {
+		token, err = printPage(db, prefix, limit, token)
+		if err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
+		if token == "" {
+			return
+		}
+		var next string
+		fmt.Println("Input N for the next page or X to return: \n>> ")
+		fmt.Scanln(&next)
+		if next != "n" && next != "N" {
+			return
+		}
+	}
+}
+
+func ReadFileInput(path string, db *DB.DB) {
 	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Error: ", err)
+		return
 	}
 	defer f.Close()
 	scanner := bufio.NewScanner(f)
@@ -64,62 +189,111 @@ func ReadFileInput(path string, mem *memtable.SkipList, cache *lru.Cache) {
 	for scanner.Scan() {
 		line := scanner.Text()
 		split := strings.Split(line, "|")
+		if len(split) < 3 {
+			fmt.Println("Skipping invalid line: ", line)
+			continue
+		}
 		function := split[0]
 		key := split[1]
 		value := split[2]
 		if function == "c" {
-			CRUD.Create(mem, cache, key, []byte(value))
+			err = CRUD.Create(db, key, []byte(value))
 		} else if function == "r" {
-			element := ReadPath.ReadPath(mem, cache, key)
-			ReadPath.PrintElement(element)
+			printRead(db, key)
 		} else if function == "u" {
-			CRUD.Update(mem, cache, key, []byte(value))
+			err = CRUD.Update(db, key, []byte(value))
 		} else if function == "d" {
-			CRUD.Delete(mem, cache, key)
+			err = CRUD.Delete(db, key)
+		} else if function == "x" {
+			// x|START|END, an empty END deletes everything from START on
+			err = CRUD.DeleteRange(db, key, value)
+		} else if function == "p" {
+			// p|PREFIX|LIMIT or p|PREFIX|LIMIT|TOKEN to continue from a previous page
+			limit, convErr := strconv.Atoi(value)
+			if convErr != nil || limit <= 0 {
+				fmt.Println("Skipping invalid line: ", line)
+				continue
+			}
+			token := ""
+			if len(split) > 3 {
+				token = split[3]
+			}
+			_, err = printPage(db, key, limit, token)
+		} else if function == "s" {
+			// s|KEY|EXPECTED|NEW
+			if len(split) < 4 {
+				fmt.Println("Skipping invalid line: ", line)
+				continue
+			}
+			var swapped bool
+			swapped, err = CRUD.CompareAndSwap(db, key, []byte(value), []byte(split[3]))
+			if err == nil && !swapped {
+				fmt.Println("Condition not met on line \"", line, "\"")
+			}
+		} else if function == "a" {
+			var written bool
+			written, err = CRUD.PutIfAbsent(db, key, []byte(value))
+			if err == nil && !written {
+				fmt.Println("Condition not met on line \"", line, "\"")
+			}
+		} else if function == "i" {
+			// i|KEY|DELTA
+			delta, convErr := strconv.ParseInt(value, 10, 64)
+			if convErr != nil {
+				fmt.Println("Skipping invalid line: ", line)
+				continue
+			}
+			err = printIncrement(db, key, delta)
+		}
+		if err != nil {
+			fmt.Println("Error on line \"", line, "\": ", err)
+			return
 		}
 	}
 	fmt.Println("Successfully read file")
 }
 
-func meni(mem *memtable.SkipList, cache *lru.Cache, tb *TokenBucket.TokenBucket) {
+func meni(db *DB.DB) {
 	var err error
 	for err == nil {
 		fmt.Println("Chose option: ")
 		fmt.Println("1) Input path to file")
 		fmt.Println("2) Input CRUD command")
 		fmt.Println("3) Compactions")
-		fmt.Println("4) Exit")
+		fmt.Println("4) Prefix scan")
+		fmt.Println("5) Exit")
 		fmt.Println(">> ")
 		var choice string
 		fmt.Scanln(&choice)
 		if choice == "1" {
 			fmt.Println("The file should be the following format: CRUD COMMAND|KEY|VALUE")
 			fmt.Println("Example: d|Mango|/ ; c|Papaya|Orange")
+			fmt.Println("Prefix scan: p|PREFIX|PAGE SIZE or p|PREFIX|PAGE SIZE|CONTINUATION TOKEN")
+			fmt.Println("Compare and swap: s|KEY|EXPECTED|NEW ; Put if absent: a|KEY|VALUE ; Increment: i|KEY|DELTA")
+			fmt.Println("Delete range: x|START|END")
 			fmt.Println("Input the file path or X to return: \n>> ")
 			var path string
 			fmt.Scanln(&path)
 			if path == "x" || path == "X"{
 				continue
 			}else {
-				ReadFileInput(path, mem, cache)
+				ReadFileInput(path, db)
 			}
 		} else if choice == "2" {
 			// TOKEN BUCKET ALGORITHM
-			if Now()-tb.LastReset >= tb.Interval {	// Interval has passed, counters are reset
-				tb.LastReset = Now()
-				tb.AvailableReq = tb.MaxReq
-				ReadUserInput(mem, cache)
-				tb.AvailableReq -= 1
-			} else {	// In interval
-				if tb.AvailableReq-1 > 0 {
-					ReadUserInput(mem, cache)
-					tb.AvailableReq -= 1
-				} // else : Too many requests for the set time interval
+			if db.Allow() {
+				ReadUserInput(db)
+			} else {
+				fmt.Println("Too many requests for the set time interval, try again later")
 			}
-			ReadUserInput(mem, cache)
 		} else if choice == "3"{
-			CRUD.Compact()
+			if err := CRUD.Compact(db); err != nil {
+				fmt.Println("Error: ", err)
+			}
 		} else if choice == "4" {
+			ReadPrefixScan(db)
+		} else if choice == "5" {
+			db.Close()
 			os.Exit(3)
 		} else {
 			fmt.Println("Invalid option, try again")
@@ -131,29 +305,16 @@ func meni(mem *memtable.SkipList, cache *lru.Cache, tb *TokenBucket.TokenBucket)
 
 func main() {
 
-	Initialization.Configure()
-	Initialization.CreateDataFiles()
-
-	// Initializing structures in memory
-	memtableInstance := memtable.SkipList{}
-	memtableInstance.NewSkipList()
-	cache := lru.NewCache()
-	tb := TokenBucket.NewTokenBucket()
-	tb.LastReset = Now()
-	tb.AvailableReq = tb.MaxReq
-
-	// Scanning wal directory
-	WritePath.WalSegmentName = wal.ScanWal(&memtableInstance)
-	if memtableInstance.Size == 0 {		// There is no leftover data from logs
-		WritePath.CreateLogFile()
-		WritePath.SegmentElements = 0
-	} else {
-		WritePath.SegmentElements = uint64(wal.CalculateSegmentSize(WritePath.WalSegmentName))
+	// walctl reads the log segments, the database isn't opened since that would replay them and change the log
+	if len(os.Args) > 1 && os.Args[1] == "walctl" {
+		os.Exit(walctl(os.Args[2:]))
 	}
 
-	meni(&memtableInstance, cache, tb)
-}
+	opts := DB.OptionsFromConfig(Configuration.LoadConfig())
+	db, err := DB.Open(".", opts)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-func Now() int64 {
-	return time.Now().Unix()
+	meni(db)
 }
@@ -4,17 +4,20 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"project/structures/MergeOperator"
 )
 
 var (
 	emptyString = ""
-	MAX_HEIGHT int
-	CAPACITY uint64
 )
 
 const (
 	DEFAULT_MAX_HEIGHT = 10
 	DEFAULT_CAPACITY = 100
+	DEFAULT_CAPACITY_BYTES = 4 << 20
+
+	// NODE_OVERHEAD : Approximate number of bytes a node takes besides its key, its value and its links
+	NODE_OVERHEAD = 128
 )
 
 
@@ -29,41 +32,104 @@ type SkipList struct {
 	Size      int
 	Head      *Node
 	Capacity  uint64
+	// Memtable is full once Bytes reaches it, 0 if only the number of elements counts
+	CapacityBytes uint64
+	// Approximate memory taken by the nodes and the range tombstones
+	Bytes uint64
+	// Range deletes written since the last flush, they hide the older elements of their range kept in the SSTables
+	RangeTombstones []RangeTombstone
+	// Sequence number of the newest snapshot that reads the memtable, 0 if there is none
+	// A version of a node that the snapshot can see is kept in Older when the node is overwritten
+	Pinned uint64
 }
 
 type Node struct {
 	// Elements are represented by nodes
+	// TimeStamp holds the time of the write in seconds (first 8B) and its sequence number (last 8B)
 	Key       string
 	Value     []byte
 	TimeStamp []byte
 	Tombstone bool
+	Expiry    int64 // Time in seconds after which the element is treated as absent, 0 if it never expires
+	Operand   bool  // Value is a merge operand that still has to be applied on top of the older value of the key
 	Next      []*Node
+	Older     *Node // Version the node replaced, kept while a snapshot might read it (see SkipList.Pinned)
+}
+
+// RangeTombstone : Deletes every key in [Start, End) written before it, an empty End means there is no upper bound
+type RangeTombstone struct {
+	Start, End string
+	TimeStamp  []byte // Time of the delete in seconds (first 8B) and its sequence number (last 8B), as in Node
+}
+
+// Sequence : Sequence number of the range delete
+func (t *RangeTombstone) Sequence() uint64 {
+	return binary.LittleEndian.Uint64(t.TimeStamp[8:])
 }
 
-func (n *Node) newNode(key *string, value *[]byte, level int, timestamp int64) {
+// Time : Time of the range delete in seconds
+func (t *RangeTombstone) Time() uint64 {
+	return binary.LittleEndian.Uint64(t.TimeStamp[:8])
+}
+
+// Covers : Reports whether the key is inside the range
+func (t *RangeTombstone) Covers(key string) bool {
+	return key >= t.Start && (t.End == "" || key < t.End)
+}
+
+// Deletes : Reports whether the tombstone hides the version of the key with the given sequence number and time
+// Versions are compared the same way as in SSTable.NewerVersion, by the sequence number and then by the time
+func (t *RangeTombstone) Deletes(key string, sequence, timestamp uint64) bool {
+	if !t.Covers(key) {
+		return false
+	}
+	if t.Sequence() != sequence {
+		return t.Sequence() > sequence
+	}
+	return t.Time() > timestamp
+}
+
+// TimeStampToBinary : 16B timestamp made of the time in seconds followed by the sequence number
+func TimeStampToBinary(timestamp int64, sequence uint64) []byte {
+	timeStampBin := make([]byte, 16)
+	binary.LittleEndian.PutUint64(timeStampBin[:8], uint64(timestamp))
+	binary.LittleEndian.PutUint64(timeStampBin[8:], sequence)
+	return timeStampBin
+}
+
+func (n *Node) newNode(key *string, value *[]byte, level int, timestamp int64, sequence uint64, expiry int64) {
 	n.Key = *key
 	n.Value = *value
-	timeStampBin := make([]byte, 16)
-	binary.LittleEndian.PutUint64(timeStampBin, uint64(timestamp))
-	n.TimeStamp = timeStampBin
+	n.TimeStamp = TimeStampToBinary(timestamp, sequence)
+	n.Expiry = expiry
 	n.Next = make([]*Node, level+1, level+1)
 	n.Tombstone = false
 }
 
-func SetDefaultParam() {
-	CAPACITY = DEFAULT_CAPACITY
-	MAX_HEIGHT = DEFAULT_MAX_HEIGHT
+// NewMemtable : Creates an empty skiplist with its own height and capacity limits
+// It is full once it holds capacity elements or takes capacityBytes of memory, whichever comes first
+func NewMemtable(maxHeight int, capacity uint64, capacityBytes uint64) *SkipList {
+	s := SkipList{MaxHeight: maxHeight, Capacity: capacity, CapacityBytes: capacityBytes}
+	s.NewSkipList()
+	return &s
 }
 
+// NewSkipList : Empties the skiplist, the height and capacity limits of the instance are kept
 func (s *SkipList) NewSkipList() {
 	Head := Node{}
 	l := []byte(emptyString)
-	Head.newNode(&emptyString, &l, 0, 0)
+	Head.newNode(&emptyString, &l, 0, 0, 0, 0)
 	s.Head = &Head
-	s.MaxHeight = MAX_HEIGHT
+	if s.MaxHeight == 0 {
+		s.MaxHeight = DEFAULT_MAX_HEIGHT
+	}
+	if s.Capacity == 0 {
+		s.Capacity = DEFAULT_CAPACITY
+	}
 	s.height = 0
-	s.Capacity = CAPACITY
 	s.Size = 0
+	s.Bytes = 0
+	s.RangeTombstones = nil
 }
 
 func (s *SkipList) SetMaxHeight(h int) {
@@ -76,7 +142,12 @@ func (s *SkipList) SetCapacity(c uint64) {
 
 // Insert : Adding or updating element
 // Returns skiplist to be flushed on disk when at capacity
-func (s *SkipList) Insert(key string, value []byte, timestamp int64) *SkipList {
+func (s *SkipList) Insert(key string, value []byte, timestamp int64, sequence uint64) *SkipList {
+	return s.InsertWithExpiry(key, value, timestamp, sequence, 0)
+}
+
+// InsertWithExpiry : Adding or updating element that expires at the given time in seconds
+func (s *SkipList) InsertWithExpiry(key string, value []byte, timestamp int64, sequence uint64, expiry int64) *SkipList {
 	update := make([]*Node, s.MaxHeight+1)
 	current := s.Head
 	for i := s.height; i >= 0; i-- {
@@ -99,7 +170,8 @@ func (s *SkipList) Insert(key string, value []byte, timestamp int64) *SkipList {
 		}
 
 		newNode := Node{}
-		newNode.newNode(&key, &value, newLevel, timestamp)
+		newNode.newNode(&key, &value, newLevel, timestamp, sequence, expiry)
+		s.Bytes += nodeBytes(&newNode)
 
 		// Updating references
 		for i := 0; i <= newLevel; i++ {
@@ -109,7 +181,7 @@ func (s *SkipList) Insert(key string, value []byte, timestamp int64) *SkipList {
 
 		s.Size += 1
 		// If max capacity is reached, skiplist is returned to be flushed on to the disk
-		if uint64(s.Size) >= s.Capacity {
+		if s.full() {
 			return s
 			//
 		}
@@ -118,15 +190,59 @@ func (s *SkipList) Insert(key string, value []byte, timestamp int64) *SkipList {
 
 	// Element found by key, to be updated
 	if current != nil && current.Key == key {
-		current.Value = value
-		timeStamp := make([]byte, 16)
-		binary.LittleEndian.PutUint64(timeStamp, uint64(timestamp))
-		current.TimeStamp = timeStamp
+		s.keep(current)
+		s.setValue(current, value)
+		current.Tombstone = false
+		current.Operand = false
+		current.TimeStamp = TimeStampToBinary(timestamp, sequence)
+		current.Expiry = expiry
+		// A bigger value can fill the memtable as well
+		if s.full() {
+			return s
+		}
 	}
 	return nil
 
 }
 
+// full : Reports whether the memtable reached the number of elements or the memory it may hold
+func (s *SkipList) full() bool {
+	if uint64(s.Size+len(s.RangeTombstones)) >= s.Capacity {
+		return true
+	}
+	return s.CapacityBytes > 0 && s.Bytes >= s.CapacityBytes
+}
+
+// nodeBytes : Approximate memory taken by the node
+func nodeBytes(n *Node) uint64 {
+	return uint64(NODE_OVERHEAD + len(n.Key) + len(n.Value) + 8*len(n.Next))
+}
+
+// keep : Saves the current version of the node before it is overwritten if a snapshot can still read it
+// Once no snapshot reads the memtable the versions kept earlier are dropped
+func (s *SkipList) keep(n *Node) {
+	if s.Pinned == 0 {
+		for older := n.Older; older != nil; older = older.Older {
+			s.Bytes -= nodeBytes(older)
+		}
+		n.Older = nil
+		return
+	}
+	if n.Sequence() > s.Pinned {
+		return
+	}
+	older := *n
+	older.Next = nil
+	n.Older = &older
+	s.Bytes += nodeBytes(&older)
+}
+
+// setValue : Replaces the value of the node and accounts for the change of its size
+func (s *SkipList) setValue(n *Node, value []byte) {
+	s.Bytes = s.Bytes - uint64(len(n.Value)) + uint64(len(value))
+	n.Value = value
+}
+
 // Find : Returns value of the element found by key
 func (s *SkipList) Find(key string) []byte {
 
@@ -165,6 +281,83 @@ func (s *SkipList) FindNode(key string) *Node {
 	return nil
 }
 
+// Merge : Adds the merge operand to the element of the key, it is applied right away if the memtable holds the value
+// A key that a range tombstone of the memtable deleted has no value left, the operand is applied on top of nothing
+// Otherwise the node keeps the operand, combined with the earlier operands of the key, until it is read or compacted
+// Returns skiplist to be flushed on disk when at capacity
+func (s *SkipList) Merge(key string, operand []byte, timestamp int64, sequence uint64, op MergeOperator.MergeOperator) (*SkipList, error) {
+	value, isOperand, err := s.merged(key, operand, timestamp, sequence, op)
+	if err != nil {
+		return nil, err
+	}
+	forFlush := s.Insert(key, value, timestamp, sequence)
+	s.FindNode(key).Operand = isOperand
+	return forFlush, nil
+}
+
+// CheckMerge : Returns the error Merge would return for the operand without changing the memtable
+// The operand is checked before it is logged, so a write that fails leaves nothing behind
+func (s *SkipList) CheckMerge(key string, operand []byte, timestamp int64, sequence uint64, op MergeOperator.MergeOperator) error {
+	_, _, err := s.merged(key, operand, timestamp, sequence, op)
+	return err
+}
+
+// merged : Value the node of the key gets once the operand is merged in to it, and whether it stays an operand
+func (s *SkipList) merged(key string, operand []byte, timestamp int64, sequence uint64, op MergeOperator.MergeOperator) ([]byte, bool, error) {
+	node := s.FindNode(key)
+	if node == nil {
+		if s.CoveringTombstoneAt(key, sequence) == nil {
+			return operand, true, nil
+		}
+		// The versions of the key in the SSTables are hidden by the range tombstone
+		value, err := MergeOperator.Apply(op, key, nil, [][]byte{operand})
+		return value, false, err
+	}
+	// A deleted or expired element means the key has no value the operand could be applied to
+	var existing []byte = nil
+	if node.Operand || (!node.Tombstone && !node.Expired(timestamp)) {
+		existing = node.Value
+	}
+	value, err := MergeOperator.Apply(op, key, existing, [][]byte{operand})
+	return value, node.Operand, err
+}
+
+// DeleteRange : Deletes every key in [start, end), an empty end means there is no upper bound
+// The nodes in the range get a tombstone, the range tombstone is kept for the keys that are only in the SSTables
+// Returns skiplist to be flushed on disk when at capacity, range tombstones count towards it
+func (s *SkipList) DeleteRange(start, end string, timestamp int64, sequence uint64) *SkipList {
+	for node := s.Seek(start); node != nil && (end == "" || node.Key < end); node = node.Next[0] {
+		s.keep(node)
+		s.setValue(node, []byte(""))
+		node.Tombstone = true
+		node.Operand = false
+		node.TimeStamp = TimeStampToBinary(timestamp, sequence)
+		node.Expiry = 0
+	}
+	s.RangeTombstones = append(s.RangeTombstones, RangeTombstone{Start: start, End: end, TimeStamp: TimeStampToBinary(timestamp, sequence)})
+	s.Bytes += uint64(NODE_OVERHEAD + len(start) + len(end))
+	if s.full() {
+		return s
+	}
+	return nil
+}
+
+// CoveringTombstoneAt : Returns the newest range tombstone with a sequence number up to the given one whose range
+// contains the key, nil if there is none
+func (s *SkipList) CoveringTombstoneAt(key string, sequence uint64) *RangeTombstone {
+	for i := len(s.RangeTombstones) - 1; i >= 0; i-- {
+		if s.RangeTombstones[i].Sequence() <= sequence && s.RangeTombstones[i].Covers(key) {
+			return &s.RangeTombstones[i]
+		}
+	}
+	return nil
+}
+
+// Empty : Reports whether the memtable holds neither elements nor range tombstones
+func (s *SkipList) Empty() bool {
+	return s.Size == 0 && len(s.RangeTombstones) == 0
+}
+
 // Delete : Logical, if element exists by key tombstone is set to true
 func (s *SkipList) Delete(key string) bool {
 
@@ -179,12 +372,45 @@ func (s *SkipList) Delete(key string) bool {
 	}
 	current = current.Next[0]
 	if current != nil && current.Key == key && current.Tombstone == false {
+		s.keep(current)
 		current.Tombstone = true
+		current.Operand = false
 		return true
 	}
 	return false
 }
 
+// Seek : Returns the first node whose key is greater than or equal to the given key, deleted nodes included
+func (s *SkipList) Seek(key string) *Node {
+	current := s.Head
+	for i := s.height; i >= 0; i-- {
+		for current.Next[i] != nil && current.Next[i].Key < key {
+			current = current.Next[i]
+		}
+	}
+	return current.Next[0]
+}
+
+// Sequence : Sequence number of the last write of the node
+func (n *Node) Sequence() uint64 {
+	return binary.LittleEndian.Uint64(n.TimeStamp[8:])
+}
+
+// Version : Returns the newest version of the node with a sequence number up to the given one, nil if there is none
+// Only the versions kept for a snapshot are found besides the current one (see SkipList.Pinned)
+func (n *Node) Version(sequence uint64) *Node {
+	version := n
+	for version != nil && version.Sequence() > sequence {
+		version = version.Older
+	}
+	return version
+}
+
+// Expired : Reports whether the element expired by the given time in seconds
+func (n *Node) Expired(now int64) bool {
+	return n.Expiry != 0 && n.Expiry <= now
+}
+
 // ExtractData : Vraca listu referenci na parove kljuc-vrednost
 func (s *SkipList) ExtractData() []*Pair {
 	h := s.Head
@@ -206,7 +432,7 @@ func (s *SkipList) roll() int {
 	// We roll until we don't get 1 from rand function and we did not
 	// outgrow maxHeight. BUT rand can give us 0, and if that is the case
 	// than we will just increase level, and wait for 1 from rand!
-	for ; rand.Int31n(2) == 1; level++ {
+	for ; rand.Int31n(2) == 1 && level < s.MaxHeight; level++ {
 		if level > s.height {
 			// When we get 1 from rand function and we did not
 			// outgrow maxHeight, that number becomes new height
@@ -0,0 +1,37 @@
+package memtable
+
+import (
+	"project/structures/MergeOperator"
+	"testing"
+)
+
+func TestMergeOnRangeDeletedKey(t *testing.T) {
+	s := NewMemtable(DEFAULT_MAX_HEIGHT, 1000, 0)
+	op := MergeOperator.Counter{}
+	s.Insert("a", []byte("5"), 1, 1)
+	s.DeleteRange("a", "m", 1, 2)
+
+	// "a" is in the memtable with a tombstone, "k" only in the SSTables the range tombstone covers
+	for _, key := range []string{"a", "k"} {
+		_, err := s.Merge(key, []byte("1"), 1, 3, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := s.FindNode(key)
+		if node.Operand || node.Tombstone || string(node.Value) != "1" {
+			t.Fatalf("%s is %q (operand %v, deleted %v), expected the value 1", key, node.Value, node.Operand, node.Tombstone)
+		}
+	}
+	// A key outside the range keeps the operand until the older value is known
+	_, err := s.Merge("x", []byte("1"), 1, 4, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node := s.FindNode("x"); !node.Operand || string(node.Value) != "1" {
+		t.Fatalf("x is %q (operand %v), expected the operand 1", node.Value, node.Operand)
+	}
+	err = s.CheckMerge("k", []byte("abc"), 1, 5, op)
+	if err == nil {
+		t.Fatal("an invalid operand passed the check")
+	}
+}
@@ -0,0 +1,145 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"project/structures/memtable"
+)
+
+var ErrInvalidBatch = errors.New("invalid write batch")
+
+// BatchEntry : One operation of a write batch
+type BatchEntry struct {
+	Family    string // Column family of the key
+	Key       string
+	Value     []byte
+	Tombstone bool
+}
+
+// WriteBatch : Operations that are logged as a single record and applied all together or not at all
+type WriteBatch struct {
+	Entries []BatchEntry
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.PutCF(DEFAULT_FAMILY, key, value)
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.DeleteCF(DEFAULT_FAMILY, key)
+}
+
+// PutCF : Writes the value under the key of the column family, one batch can write to several families
+func (b *WriteBatch) PutCF(family, key string, value []byte) {
+	b.Entries = append(b.Entries, BatchEntry{Family: family, Key: key, Value: value})
+}
+
+// DeleteCF : Deletes the key of the column family
+func (b *WriteBatch) DeleteCF(family, key string) {
+	b.Entries = append(b.Entries, BatchEntry{Family: family, Key: key, Value: []byte(""), Tombstone: true})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.Entries)
+}
+
+// Encode : Value of the batch record in the log
+func (b *WriteBatch) Encode() []byte {
+	//+------------------+-----...-----+
+	//| Entry Count (8B) | Entries ... |
+	//+------------------+-----...-----+
+	// Each entry:
+	//+---------------+------------------+---------------+-----------------+-...-+-...-+--...--+
+	//| Tombstone(1B) | Family Size (8B) | Key Size (8B) | Value Size (8B) | Fam | Key | Value |
+	//+---------------+------------------+---------------+-----------------+-...-+-...-+--...--+
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(len(b.Entries)))
+	for _, entry := range b.Entries {
+		header := make([]byte, 25)
+		if entry.Tombstone {
+			header[0] = 1
+		}
+		binary.LittleEndian.PutUint64(header[1:9], uint64(len(entry.Family)))
+		binary.LittleEndian.PutUint64(header[9:17], uint64(len(entry.Key)))
+		binary.LittleEndian.PutUint64(header[17:], uint64(len(entry.Value)))
+		data = append(data, header...)
+		data = append(data, []byte(entry.Family)...)
+		data = append(data, []byte(entry.Key)...)
+		data = append(data, entry.Value...)
+	}
+	return data
+}
+
+// DecodeWriteBatch : Reads the batch from the value of a batch record
+func DecodeWriteBatch(data []byte) (*WriteBatch, error) {
+	if len(data) < 8 {
+		return nil, ErrInvalidBatch
+	}
+	count := binary.LittleEndian.Uint64(data[:8])
+	data = data[8:]
+	b := NewWriteBatch()
+	for i := uint64(0); i < count; i++ {
+		if len(data) < 25 {
+			return nil, ErrInvalidBatch
+		}
+		familySize := binary.LittleEndian.Uint64(data[1:9])
+		keySize := binary.LittleEndian.Uint64(data[9:17])
+		valueSize := binary.LittleEndian.Uint64(data[17:25])
+		rest := uint64(len(data) - 25)
+		if rest < familySize || rest-familySize < keySize || rest-familySize-keySize < valueSize {
+			return nil, ErrInvalidBatch
+		}
+		entry := BatchEntry{Tombstone: data[0] == 1}
+		data = data[25:]
+		entry.Family = string(data[:familySize])
+		entry.Key = string(data[familySize : familySize+keySize])
+		entry.Value = data[familySize+keySize : familySize+keySize+valueSize]
+		b.Entries = append(b.Entries, entry)
+		data = data[familySize+keySize+valueSize:]
+	}
+	if len(data) != 0 {
+		return nil, ErrInvalidBatch
+	}
+	return b, nil
+}
+
+// CheckFamilies : Returns ErrUnknownFamily if an operation of the batch names a column family that isn't in memtables
+func (b *WriteBatch) CheckFamilies(memtables map[string]*memtable.SkipList) error {
+	for _, entry := range b.Entries {
+		if _, found := memtables[entry.Family]; !found {
+			return fmt.Errorf("%w %q", ErrUnknownFamily, entry.Family)
+		}
+	}
+	return nil
+}
+
+// Apply : Inserts all the operations in to the memtables of their column families, reports whether any memtable
+// reached its capacity, the memtables are flushed only after the whole batch was applied
+// Nothing is applied if the batch names a family that isn't in memtables, ErrUnknownFamily is returned
+// The operations get consecutive sequence numbers starting from sequence, the ones up to flushed[family] are in the
+// SSTables already and are left out, flushed is nil for a new batch
+func (b *WriteBatch) Apply(memtables map[string]*memtable.SkipList, timestamp int64, sequence uint64, flushed map[string]uint64) (bool, error) {
+	err := b.CheckFamilies(memtables)
+	if err != nil {
+		return false, err
+	}
+	full := false
+	for i, entry := range b.Entries {
+		if sequence+uint64(i) <= flushed[entry.Family] {
+			continue
+		}
+		mem := memtables[entry.Family]
+		if mem.Insert(entry.Key, entry.Value, timestamp, sequence+uint64(i)) != nil {
+			full = true
+		}
+		if entry.Tombstone {
+			mem.Delete(entry.Key)
+		}
+	}
+	return full, nil
+}
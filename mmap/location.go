@@ -0,0 +1,36 @@
+package wal
+
+// Location : Place of a record in the log, the number of its segment and the offset of the record in the segment
+// Segments are numbered from 1, the zero Location doesn't point to any record
+type Location struct {
+	Segment int
+	Offset  int64
+}
+
+// Before : Reports whether the location comes earlier in the log than the other one
+func (l Location) Before(other Location) bool {
+	if l.Segment != other.Segment {
+		return l.Segment < other.Segment
+	}
+	return l.Offset < other.Offset
+}
+
+// Range : Records of the log from First up to Last, both included, that a memtable holds
+// The segments from the one of First on are kept until the memtable is flushed
+type Range struct {
+	First Location
+	Last  Location
+}
+
+// Empty : Reports whether the range holds no record
+func (r Range) Empty() bool {
+	return r.First.Segment == 0
+}
+
+// Add : Extends the range with the record at the location, records are added in the order of the log
+func (r *Range) Add(location Location) {
+	if r.Empty() {
+		r.First = location
+	}
+	r.Last = location
+}
@@ -0,0 +1,309 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"project/structures/Errors"
+	"time"
+)
+
+/*
+   Every segment starts with a header that tells the format of its records
+   +--------------+-------------+
+   | Magic (4B)   | Version (1B)|
+   +--------------+-------------+
+   Magic = SEGMENT_MAGIC, the segments written before the header existed start with a record right away and are read
+   as LEGACY_VERSION
+   Version = FORMAT_VERSION for the segments written now
+
+   Record of FORMAT_VERSION
+   +----------+-----------+-----------------+----------------+-------------+------------------+---------------+-----------------+-...-+--...--+--...--+
+   | CRC (4B) | Type (1B) | Timestamp (8B)  | Sequence (8B)  | Expiry (8B) | Family Size (4B) | Key Size (4B) | Value Size (4B) | Fam | Key  | Value |
+   +----------+-----------+-----------------+----------------+-------------+------------------+---------------+-----------------+-...-+--...--+--...--+
+   CRC = CRC32 of everything that follows it, the header and the data of the record
+   Type = 0 - put 1 - delete 2 - write batch 3 - merge operand 4 - range delete, a range delete has the start of the
+   range as its key and the end as its value
+   A write batch record has an empty key and family, its value holds all the operations of the batch (see WriteBatch)
+   Timestamp = Time of the operation in seconds
+   Sequence = Sequence number of the operation, the operations of a write batch get consecutive sequence numbers
+   starting from the one in the record
+   Expiry = Time in seconds after which the element is treated as absent, 0 if it never expires
+   Fam = Name of the column family the record belongs to, all the families of a database share the log
+
+   Record of LEGACY_VERSION
+   +----------+-----------------+----------------+-------------+------------------+----------------+------------------+-...-+--...--+--...--+
+   | CRC (4B) | Timestamp (16B) | Tombstone (8B) | Expiry (8B) | Family Size (8B) | Key Size (21B) | Value Size (29B) | Fam | Key  | Value |
+   +----------+-----------------+----------------+-------------+------------------+----------------+------------------+-...-+--...--+--...--+
+   CRC = CRC32 of the value only
+   Timestamp = Time in seconds (first 8B) and the sequence number (last 8B)
+   Tombstone = Type of the record in its first byte
+   The sizes are kept in the first 8B of their fields
+*/
+
+const (
+	SEGMENT_MAGIC       = "WLOG"
+	SEGMENT_HEADER_SIZE = 5
+	LEGACY_VERSION      = 1
+	FORMAT_VERSION      = 2
+
+	RECORD_HEADER_SIZE = 4 + 1 + 8 + 8 + 8 + 4 + 4 + 4
+
+	LEGACY_KEY_SIZE    = 21
+	LEGACY_VALUE_SIZE  = 29
+	LEGACY_HEADER_SIZE = 4 + 16 + 8 + 8 + 8 + LEGACY_KEY_SIZE + LEGACY_VALUE_SIZE
+)
+
+// segmentHeader : Bytes every new segment starts with
+func segmentHeader() []byte {
+	return append([]byte(SEGMENT_MAGIC), FORMAT_VERSION)
+}
+
+// encodeRecord : Bytes of the record as they are appended to the segment
+func encodeRecord(recordType uint64, family, key string, value []byte, sequence uint64, expiry int64) []byte {
+	record := make([]byte, RECORD_HEADER_SIZE, RECORD_HEADER_SIZE+len(family)+len(key)+len(value))
+	record[4] = byte(recordType)
+	binary.LittleEndian.PutUint64(record[5:], uint64(time.Now().Unix()))
+	binary.LittleEndian.PutUint64(record[13:], sequence)
+	binary.LittleEndian.PutUint64(record[21:], uint64(expiry))
+	binary.LittleEndian.PutUint32(record[29:], uint32(len(family)))
+	binary.LittleEndian.PutUint32(record[33:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[37:], uint32(len(value)))
+	record = append(record, family...)
+	record = append(record, key...)
+	record = append(record, value...)
+	binary.LittleEndian.PutUint32(record, CRC32(record[4:]))
+	return record
+}
+
+// Record : One entry of a log segment
+type Record struct {
+	CRC       uint32
+	Timestamp int64
+	Sequence  uint64
+	Type      byte
+	Expiry    int64
+	Family    string
+	Key       string
+	Value     []byte
+	Offset    int64 // Position of the record in its segment
+	Size      int64 // Number of bytes the record takes in the segment
+}
+
+// SegmentReader : Reads the records of one segment in order and verifies their checksums
+type SegmentReader struct {
+	Path    string
+	Version byte  // Format of the records, LEGACY_VERSION for a segment without the header
+	Offset  int64 // Position of the next record
+	Size    int64 // Size of the segment
+	file    *os.File
+	br      *bufio.Reader
+	partial bool // The header of the segment is cut short
+	torn    bool
+}
+
+// OpenSegment : Opens the segment for reading, positioned on its first record
+func OpenSegment(path string) (*SegmentReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, Errors.IO("open", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, Errors.IO("stat", path, err)
+	}
+	r := SegmentReader{Path: path, Version: LEGACY_VERSION, Size: info.Size(), file: file, br: bufio.NewReader(file)}
+	header, err := r.br.Peek(SEGMENT_HEADER_SIZE)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, Errors.IO("read", path, err)
+	}
+	if len(header) < SEGMENT_HEADER_SIZE && string(header) == SEGMENT_MAGIC[:len(header)] {
+		// The segment was being created when the process stopped
+		r.Version = FORMAT_VERSION
+		r.partial = len(header) > 0
+		return &r, nil
+	}
+	if len(header) == SEGMENT_HEADER_SIZE && string(header[:4]) == SEGMENT_MAGIC {
+		r.Version = header[4]
+		if r.Version != FORMAT_VERSION {
+			file.Close()
+			return nil, Errors.Corrupted(path, 4, "unknown format version")
+		}
+		r.br.Discard(SEGMENT_HEADER_SIZE)
+		r.Offset = SEGMENT_HEADER_SIZE
+	}
+	return &r, nil
+}
+
+// Next : Reads the next record, nil at the end of the segment
+// ErrCorrupted is returned for a record that is cut short or doesn't match its checksum, the record is returned along
+// with the error when it could be read whole and the reader moves on to the record after it
+// A record cut short ends the segment, Torn tells whether the error was at the end of the segment
+// A record whose sizes reach past the end while a whole record follows it is broken, not cut short, see pastEnd
+func (r *SegmentReader) Next() (*Record, error) {
+	if r.partial {
+		r.partial = false
+		return nil, r.cutShort(0, "segment header is cut short")
+	}
+	if r.Offset >= r.Size {
+		return nil, nil
+	}
+	if r.Version == LEGACY_VERSION {
+		return r.nextLegacy()
+	}
+	offset := r.Offset
+	header := make([]byte, RECORD_HEADER_SIZE)
+	err := r.read(header)
+	if err != nil {
+		return nil, err
+	}
+	familySize := int64(binary.LittleEndian.Uint32(header[29:]))
+	keySize := int64(binary.LittleEndian.Uint32(header[33:]))
+	valueSize := int64(binary.LittleEndian.Uint32(header[37:]))
+	// The sizes are checked before anything is allocated, a broken header can hold any sizes
+	if offset+RECORD_HEADER_SIZE+familySize+keySize+valueSize > r.Size {
+		return nil, r.pastEnd(offset)
+	}
+	data := make([]byte, familySize+keySize+valueSize)
+	err = r.read(data)
+	if err != nil {
+		return nil, err
+	}
+	record := Record{
+		CRC:       binary.LittleEndian.Uint32(header),
+		Type:      header[4],
+		Timestamp: int64(binary.LittleEndian.Uint64(header[5:])),
+		Sequence:  binary.LittleEndian.Uint64(header[13:]),
+		Expiry:    int64(binary.LittleEndian.Uint64(header[21:])),
+		Family:    string(data[:familySize]),
+		Key:       string(data[familySize : familySize+keySize]),
+		Value:     data[familySize+keySize:],
+		Offset:    offset,
+		Size:      RECORD_HEADER_SIZE + int64(len(data)),
+	}
+	r.Offset += record.Size
+	crc := crc32.Update(CRC32(header[4:]), crc32.IEEETable, data)
+	if crc != record.CRC {
+		r.torn = r.Offset >= r.Size
+		return &record, Errors.Corrupted(r.Path, offset, "record checksum mismatch")
+	}
+	return &record, nil
+}
+
+// nextLegacy : Reads the next record of a LEGACY_VERSION segment, only its value is covered by the checksum
+func (r *SegmentReader) nextLegacy() (*Record, error) {
+	offset := r.Offset
+	header := make([]byte, LEGACY_HEADER_SIZE)
+	err := r.read(header)
+	if err != nil {
+		return nil, err
+	}
+	familySize := binary.LittleEndian.Uint64(header[36:])
+	keySize := binary.LittleEndian.Uint64(header[44:])
+	valueSize := binary.LittleEndian.Uint64(header[44+LEGACY_KEY_SIZE:])
+	remaining := uint64(r.Size - offset - LEGACY_HEADER_SIZE)
+	if familySize > remaining || keySize > remaining || valueSize > remaining || familySize+keySize+valueSize > remaining {
+		return nil, r.pastEnd(offset)
+	}
+	data := make([]byte, familySize+keySize+valueSize)
+	err = r.read(data)
+	if err != nil {
+		return nil, err
+	}
+	record := Record{
+		CRC:       binary.LittleEndian.Uint32(header),
+		Timestamp: int64(binary.LittleEndian.Uint64(header[4:])),
+		Sequence:  binary.LittleEndian.Uint64(header[12:]),
+		Type:      header[20],
+		Expiry:    int64(binary.LittleEndian.Uint64(header[28:])),
+		Family:    string(data[:familySize]),
+		Key:       string(data[familySize : familySize+keySize]),
+		Value:     data[familySize+keySize:],
+		Offset:    offset,
+		Size:      LEGACY_HEADER_SIZE + int64(len(data)),
+	}
+	r.Offset += record.Size
+	if CRC32(record.Value) != record.CRC {
+		r.torn = r.Offset >= r.Size
+		return &record, Errors.Corrupted(r.Path, offset, "record checksum mismatch")
+	}
+	return &record, nil
+}
+
+// read : Fills the buffer from the segment, a segment that ends first cuts the record short
+func (r *SegmentReader) read(buffer []byte) error {
+	_, err := io.ReadFull(r.br, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return r.cutShort(r.Offset, "record is cut short")
+	}
+	return Errors.IO("read", r.Path, err)
+}
+
+// pastEnd : Handles the record at the offset whose sizes reach past the end of the segment
+// A write cut off by a crash is the last one in the segment, the record is torn only if no whole record follows it
+// Otherwise its sizes are broken, ErrCorrupted is returned and reading goes on from the record that follows
+func (r *SegmentReader) pastEnd(offset int64) error {
+	rest := make([]byte, r.Size-offset-1)
+	_, err := r.file.ReadAt(rest, offset+1)
+	if err != nil && err != io.EOF {
+		return Errors.IO("read", r.Path, err)
+	}
+	for i := range rest {
+		if wholeRecord(rest[i:], r.Version) {
+			r.Offset = offset + 1 + int64(i)
+			_, err = r.file.Seek(r.Offset, io.SeekStart)
+			if err != nil {
+				return Errors.IO("seek", r.Path, err)
+			}
+			r.br.Reset(r.file)
+			return Errors.Corrupted(r.Path, offset, "record sizes reach past the end of the segment")
+		}
+	}
+	return r.cutShort(offset, "record is cut short")
+}
+
+// wholeRecord : Reports whether data starts with a whole record that matches its checksum
+// A legacy record without a value is never reported, its checksum covers nothing
+func wholeRecord(data []byte, version byte) bool {
+	if version == LEGACY_VERSION {
+		if len(data) < LEGACY_HEADER_SIZE {
+			return false
+		}
+		remaining := uint64(len(data) - LEGACY_HEADER_SIZE)
+		familySize := binary.LittleEndian.Uint64(data[36:])
+		keySize := binary.LittleEndian.Uint64(data[44:])
+		valueSize := binary.LittleEndian.Uint64(data[44+LEGACY_KEY_SIZE:])
+		if valueSize == 0 || familySize > remaining || keySize > remaining || valueSize > remaining || familySize+keySize+valueSize > remaining {
+			return false
+		}
+		start := LEGACY_HEADER_SIZE + familySize + keySize
+		return CRC32(data[start:start+valueSize]) == binary.LittleEndian.Uint32(data)
+	}
+	if len(data) < RECORD_HEADER_SIZE {
+		return false
+	}
+	size := RECORD_HEADER_SIZE + int64(binary.LittleEndian.Uint32(data[29:])) +
+		int64(binary.LittleEndian.Uint32(data[33:])) + int64(binary.LittleEndian.Uint32(data[37:]))
+	return size <= int64(len(data)) && CRC32(data[4:size]) == binary.LittleEndian.Uint32(data)
+}
+
+// cutShort : Ends the segment at the record that starts at the offset, nothing after it can be read
+func (r *SegmentReader) cutShort(offset int64, reason string) error {
+	r.Offset = r.Size
+	r.torn = true
+	return Errors.Corrupted(r.Path, offset, reason)
+}
+
+// Torn : Reports whether the last error came from the tail of the segment, no record follows the broken one
+// A tail like that is left by a write that was cut off by a crash
+func (r *SegmentReader) Torn() bool {
+	return r.torn
+}
+
+func (r *SegmentReader) Close() error {
+	return Errors.IO("close", r.Path, r.file.Close())
+}
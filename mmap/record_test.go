@@ -0,0 +1,195 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"project/structures/Errors"
+	"testing"
+	"time"
+)
+
+// writeKeys : Logs the keys k1..kn with the values v1..vn and returns the offset of every record in its segment
+func writeKeys(t *testing.T, dir string, segmentSize uint64, n int) []int64 {
+	t.Helper()
+	w := openTestWal(t, dir, segmentSize)
+	var offsets []int64
+	for i := 1; i <= n; i++ {
+		err := w.Add(DEFAULT_FAMILY, fmt.Sprint("k", i), []byte(fmt.Sprint("v", i)), false, uint64(i), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, w.Last().Offset)
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offsets
+}
+
+// fileSize : Size of the file, the test fails if it can't be found
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// legacyRecord : Bytes of the record as a LEGACY_VERSION segment holds them
+func legacyRecord(recordType byte, family, key string, value []byte, sequence uint64) []byte {
+	record := make([]byte, LEGACY_HEADER_SIZE)
+	binary.LittleEndian.PutUint32(record, CRC32(value))
+	binary.LittleEndian.PutUint64(record[4:], uint64(time.Now().Unix()))
+	binary.LittleEndian.PutUint64(record[12:], sequence)
+	record[20] = recordType
+	binary.LittleEndian.PutUint64(record[36:], uint64(len(family)))
+	binary.LittleEndian.PutUint64(record[44:], uint64(len(key)))
+	binary.LittleEndian.PutUint64(record[44+LEGACY_KEY_SIZE:], uint64(len(value)))
+	record = append(record, family...)
+	record = append(record, key...)
+	return append(record, value...)
+}
+
+func TestTornTailIsCutOff(t *testing.T) {
+	record := int64(len(encodeRecord(RECORD_PUT, DEFAULT_FAMILY, "k3", []byte("v3"), 3, 0)))
+	// The crash cut the last record in its payload, in its header or right after the segment header
+	for _, kept := range []int64{record - 1, RECORD_HEADER_SIZE - 1, 1} {
+		dir := t.TempDir()
+		offsets := writeKeys(t, dir, DEFAULT_SEGMENT_SIZE, 3)
+		path := filepath.Join(dir, "wal_1.db")
+		err := os.Truncate(path, offsets[2]+kept)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, mem, sequence, err := scan(t, dir, nil)
+		if err != nil {
+			t.Fatalf("scan with %d bytes of the last record returned %v", kept, err)
+		}
+		expectNode(t, mem, "k2", "v2")
+		if mem.FindNode("k3") != nil || sequence != 2 {
+			t.Fatalf("the torn record was loaded with %d of its bytes", kept)
+		}
+		if size := fileSize(t, path); size != offsets[2] {
+			t.Fatalf("segment is %d bytes after the repair, expected %d", size, offsets[2])
+		}
+		// The log goes on after the last whole record
+		err = w.Add(DEFAULT_FAMILY, "k4", []byte("v4"), false, 4, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		_, mem, _, err = scan(t, dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNode(t, mem, "k2", "v2")
+		expectNode(t, mem, "k4", "v4")
+	}
+}
+
+func TestBrokenSizeIsNotTorn(t *testing.T) {
+	dir := t.TempDir()
+	offsets := writeKeys(t, dir, DEFAULT_SEGMENT_SIZE, 3)
+	path := filepath.Join(dir, "wal_1.db")
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The value size of the second record reaches past the end of the segment
+	_, err = file.WriteAt([]byte{0, 0, 0, 1}, offsets[1]+37)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := fileSize(t, path)
+
+	_, _, _, err = scan(t, dir, nil)
+	if !errors.Is(err, Errors.ErrCorrupted) {
+		t.Fatalf("scan returned %v, expected a corruption", err)
+	}
+	if fileSize(t, path) != size {
+		t.Fatal("the segment was truncated")
+	}
+	w, mem, sequence, err := scan(t, dir, func(w *Wal) { w.SkipCorrupted = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNode(t, mem, "k1", "v1")
+	expectNode(t, mem, "k3", "v3")
+	if mem.FindNode("k2") != nil || sequence != 3 || len(w.Skipped) != 1 {
+		t.Fatalf("k2 loaded %v, last sequence %d, skipped %v", mem.FindNode("k2") != nil, sequence, w.Skipped)
+	}
+	if fileSize(t, path) != size {
+		t.Fatal("the segment was truncated")
+	}
+}
+
+func TestCutRecordBeforeTheLastSegment(t *testing.T) {
+	dir := t.TempDir()
+	offsets := writeKeys(t, dir, 2, 3)
+	path := filepath.Join(dir, "wal_1.db")
+	err := os.Truncate(path, offsets[1]+RECORD_HEADER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = scan(t, dir, nil)
+	if !errors.Is(err, Errors.ErrCorrupted) {
+		t.Fatalf("scan returned %v, expected a corruption", err)
+	}
+	if size := fileSize(t, path); size != offsets[1]+RECORD_HEADER_SIZE {
+		t.Fatalf("segment is %d bytes, it was truncated", size)
+	}
+}
+
+func TestLegacySegment(t *testing.T) {
+	dir := t.TempDir()
+	var segment []byte
+	segment = append(segment, legacyRecord(RECORD_PUT, DEFAULT_FAMILY, "k1", []byte("v1"), 1)...)
+	segment = append(segment, legacyRecord(RECORD_DELETE, DEFAULT_FAMILY, "k2", nil, 2)...)
+	// A record the crash cut short after its header
+	torn := legacyRecord(RECORD_PUT, DEFAULT_FAMILY, "k3", []byte("v3"), 3)
+	path := filepath.Join(dir, "wal_1.db")
+	err := os.WriteFile(path, append(segment, torn[:LEGACY_HEADER_SIZE+2]...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, mem, sequence, err := scan(t, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNode(t, mem, "k1", "v1")
+	expectNode(t, mem, "k2", "")
+	if mem.FindNode("k3") != nil || sequence != 2 {
+		t.Fatal("the torn record was loaded")
+	}
+	if size := fileSize(t, path); size != int64(len(segment)) {
+		t.Fatalf("segment is %d bytes after the repair, expected %d", size, len(segment))
+	}
+	// The records of the current format go to a new segment
+	err = w.Add(DEFAULT_FAMILY, "k3", []byte("v3"), false, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	version, _, err := CalculateSegmentSize(filepath.Join(dir, "wal_2.db"))
+	if err != nil || version != FORMAT_VERSION {
+		t.Fatalf("new segment has version %d (%v)", version, err)
+	}
+	_, mem, sequence, err = scan(t, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNode(t, mem, "k1", "v1")
+	expectNode(t, mem, "k2", "")
+	expectNode(t, mem, "k3", "v3")
+	if sequence != 3 {
+		t.Fatalf("last sequence is %d, expected 3", sequence)
+	}
+}
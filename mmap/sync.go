@@ -0,0 +1,142 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"project/structures/Errors"
+	"time"
+)
+
+var ErrUnknownSyncMode = errors.New("unknown wal sync mode")
+
+// Sync modes of the log, they decide when the appended records are forced to the disk
+// SYNC_ALWAYS : A write returns once its record is synced, the writers waiting at the same time share one sync
+// SYNC_INTERVAL : The log is synced every SyncInterval, a crash loses at most the writes of the last interval
+// SYNC_NONE : The log is left to the operating system, the writes survive the process but not the machine crashing
+const (
+	SYNC_ALWAYS   = "always"
+	SYNC_INTERVAL = "interval"
+	SYNC_NONE     = "none"
+
+	DEFAULT_SYNC_INTERVAL = 100 // Milliseconds
+)
+
+// Position : Number of bytes appended to the log, a write passes it to Sync once its record is appended
+func (w *Wal) Position() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written
+}
+
+// Sync : Waits until the records up to the position are synced, in SYNC_ALWAYS mode only
+// It has to be called without holding the lock that serializes the appends, the writers that append in the meantime
+// join the next sync instead of each one syncing on its own (group commit)
+// In the other modes it returns straight away, with the error of a sync that failed, if any
+func (w *Wal) Sync(position uint64) error {
+	if w.SyncMode == SYNC_ALWAYS {
+		return w.syncTo(position)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// syncTo : Syncs the current segment unless the records up to the position are durable already
+// One writer syncs at a time, the others wait for it and sync once more if their records came after it started
+func (w *Wal) syncTo(position uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.err == nil && w.durable < position {
+		if w.syncing {
+			w.synced.Wait()
+			continue
+		}
+		// Everything appended so far is covered by this sync
+		target, file := w.written, w.file
+		w.syncing = true
+		w.mu.Unlock()
+		err := file.Sync()
+		w.mu.Lock()
+		w.syncing = false
+		w.synced.Broadcast()
+		if err != nil {
+			w.err = Errors.IO("sync", file.Name(), err)
+		} else if target > w.durable {
+			w.durable = target
+		}
+	}
+	return w.err
+}
+
+// syncPeriodically : Syncs the records appended since the last sync every SyncInterval until the log is closed
+func (w *Wal) syncPeriodically() {
+	defer w.stopped.Done()
+	ticker := time.NewTicker(w.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.syncTo(w.Position())
+		}
+	}
+}
+
+// closeSegment : Syncs the current segment unless the mode is SYNC_NONE and closes it
+// Every record appended to it counts as durable afterwards, the sync running meanwhile is waited for
+func (w *Wal) closeSegment() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.syncing {
+		w.synced.Wait()
+	}
+	if w.file == nil {
+		return nil
+	}
+	file := w.file
+	if w.SyncMode != SYNC_NONE && w.durable < w.written {
+		err := file.Sync()
+		if err != nil {
+			w.err = Errors.IO("sync", file.Name(), err)
+			return w.err
+		}
+	}
+	w.file = nil
+	w.durable = w.written
+	w.synced.Broadcast()
+	return Errors.IO("close", file.Name(), file.Close())
+}
+
+// Close : Stops the periodic syncs, syncs and closes the current segment
+// The error of a sync that failed earlier is returned as well
+func (w *Wal) Close() error {
+	select {
+	case <-w.stop:
+		return nil
+	default:
+		close(w.stop)
+	}
+	w.stopped.Wait()
+	err := w.closeSegment()
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// syncDir : Waits for the entries of the directory to reach the disk
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return Errors.IO("open", dir, err)
+	}
+	err = Errors.IO("sync", dir, file.Sync())
+	closeErr := Errors.IO("close", dir, file.Close())
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,102 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// appendSynced : Appends the record with the appends serialized by mu, then waits for it to be synced without mu held,
+// as the database does
+func appendSynced(w *Wal, mu *sync.Mutex, key string, value []byte, sequence uint64) error {
+	mu.Lock()
+	err := w.Add(DEFAULT_FAMILY, key, value, false, sequence, 0)
+	position := w.Position()
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return w.Sync(position)
+}
+
+func TestConcurrentWritersShareSyncs(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWal(t, dir, DEFAULT_SEGMENT_SIZE)
+	var mu sync.Mutex
+	var sequence uint64 = 0
+	var writers sync.WaitGroup
+	for writer := 0; writer < 8; writer++ {
+		writers.Add(1)
+		go func(writer int) {
+			defer writers.Done()
+			for i := 0; i < 50; i++ {
+				mu.Lock()
+				sequence++
+				next := sequence
+				mu.Unlock()
+				err := appendSynced(w, &mu, fmt.Sprintf("w%d-%d", writer, i), []byte("v"), next)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(writer)
+	}
+	writers.Wait()
+	w.Close()
+
+	_, mem, last, err := scan(t, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 400 {
+		t.Fatalf("last sequence is %d, expected 400", last)
+	}
+	for writer := 0; writer < 8; writer++ {
+		for i := 0; i < 50; i++ {
+			expectNode(t, mem, fmt.Sprintf("w%d-%d", writer, i), "v")
+		}
+	}
+}
+
+// BenchmarkAppend : Appends records of 100 bytes in every sync mode, a write returns once the mode lets it
+// The writers share the records of the run, with several of them the ones waiting for a sync share it
+func BenchmarkAppend(b *testing.B) {
+	for _, mode := range []string{SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NONE} {
+		for _, writers := range []int{1, 16} {
+			b.Run(fmt.Sprintf("%s/writers=%d", mode, writers), func(b *testing.B) {
+				w, err := NewWal(b.TempDir(), DEFAULT_SEGMENT_SIZE, mode, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer w.Close()
+				w.SegmentBytes = DEFAULT_SEGMENT_BYTES
+				value := make([]byte, 100)
+				b.SetBytes(int64(len(encodeRecord(RECORD_PUT, DEFAULT_FAMILY, "key", value, 0, 0))))
+				var mu sync.Mutex
+				var sequence uint64 = 0
+				var running sync.WaitGroup
+				b.ResetTimer()
+				for writer := 0; writer < writers; writer++ {
+					running.Add(1)
+					go func() {
+						defer running.Done()
+						for {
+							next := atomic.AddUint64(&sequence, 1)
+							if next > uint64(b.N) {
+								return
+							}
+							err := appendSynced(w, &mu, "key", value, next)
+							if err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}()
+				}
+				running.Wait()
+			})
+		}
+	}
+}
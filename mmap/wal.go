@@ -1,81 +1,328 @@
 package wal
 
 import (
-	"bufio"
-	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/edsrzf/mmap-go"
 	"hash/crc32"
 	"io/ioutil"
-	"log"
 	"os"
-	"project/structures/SSTable"
+	"path/filepath"
+	"project/structures/Errors"
+	"project/structures/MergeOperator"
 	"project/structures/memtable"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-/*
-   +---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
-   |    CRC (4B)   | Timestamp (16B) | Tombstone(1B) | Key Size (8B) | Value Size (8B) | Key | Value |
-   +---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
-   CRC = 32bit hash computed over the payload using CRC
-   Key Size = Length of the Key data
-   Tombstone = If this record was deleted and has a value 0 - append 1 - deleted
-   Value Size = Length of the Value data
-   Key = Key data
-   Value = Value data
-   Timestamp = Timestamp of the operation in seconds
-*/
+// The layout of the segments and of their records is described in record.go
 
 const (
-	T_SIZE = 8
-	C_SIZE = 4
+	DEFAULT_SEGMENT_SIZE  = 100
+	DEFAULT_SEGMENT_BYTES = 1 << 20
 
-	CRC_SIZE       = T_SIZE + C_SIZE
-	TOMBSTONE_SIZE = CRC_SIZE + 1
-	KEY_SIZE       = TOMBSTONE_SIZE + T_SIZE
-	VALUE_SIZE     = KEY_SIZE + T_SIZE
+	DEFAULT_FAMILY = "default" // Column family of the writes that don't name one
+)
+
+var ErrUnknownFamily = errors.New("unknown column family")
 
-	DEFAULT_SEGMENT_SIZE = 100
+// Record types, stored in the type field of the record
+const (
+	RECORD_PUT          = 0
+	RECORD_DELETE       = 1
+	RECORD_BATCH        = 2
+	RECORD_MERGE        = 3
+	RECORD_DELETE_RANGE = 4
 )
 
-var SEGMENT_SIZE uint64
+func  CRC32(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
 
-func SetDefaultParam() {
-	SEGMENT_SIZE = uint64(DEFAULT_SEGMENT_SIZE)
 }
 
+// Wal : Write ahead log made of numbered segments (wal_1.db, wal_2.db, ...) inside Dir
+// The current segment is kept open and the records are appended to it, when they reach the disk depends on SyncMode
+// (see sync.go)
+type Wal struct {
+	Dir             string
+	SegmentName     string                      // Path to current Wal segment that gets appended
+	SegmentElements uint64                      // Number of elements in current Wal segment
+	SegmentSize     uint64                      // Number of appends per segment
+	SegmentBytes    uint64                      // Size a segment may reach, 0 if only the number of appends counts
+	MergeOperator   MergeOperator.MergeOperator // Applies the merge operands when the log is read back
+	SyncMode        string                      // SYNC_ALWAYS, SYNC_INTERVAL or SYNC_NONE
+	SyncInterval    time.Duration               // Time between two syncs in SYNC_INTERVAL mode
+	SkipCorrupted   bool                        // ScanWal skips the broken records instead of failing
+	Skipped         []error                     // Broken records skipped by the last ScanWal, see ReadData
+	Flushed         map[string]uint64           // Sequence of the newest write of each family in its SSTables, see ReadData
+
+	file    *os.File   // Current segment opened for appending, nil until the first append to it
+	size    int64      // Size of the current segment, a record that fails half way is cut off there
+	mu      sync.Mutex // Guards the fields below and the file, the appends are serialized by the caller
+	synced  *sync.Cond // Signalled whenever a sync finishes
+	written uint64     // Bytes appended since the log was opened, counted over all the segments
+	last    Location   // Location of the record appended last
+	durable uint64     // Bytes of written that are known to be on the disk
+	syncing bool       // A sync is running, the writers that come meanwhile wait for it and share the next one
+	err     error      // A sync that failed leaves the log in an unknown state, every later sync returns the error
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
 
-func  CRC32(data []byte) uint32 {
-	return crc32.ChecksumIEEE(data)
+// NewWal : Log in dir whose segments take segmentSize appends, mode is one of the SYNC_ modes (SYNC_ALWAYS if empty)
+// ErrUnknownSyncMode is returned for any other mode, in SYNC_INTERVAL mode the log is synced every interval
+// (DEFAULT_SYNC_INTERVAL milliseconds if it isn't positive) until it is closed
+func NewWal(dir string, segmentSize uint64, mode string, interval time.Duration) (*Wal, error) {
+	if mode == "" {
+		mode = SYNC_ALWAYS
+	}
+	if mode != SYNC_ALWAYS && mode != SYNC_INTERVAL && mode != SYNC_NONE {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSyncMode, mode)
+	}
+	if interval <= 0 {
+		interval = DEFAULT_SYNC_INTERVAL * time.Millisecond
+	}
+	w := Wal{Dir: dir, SegmentSize: segmentSize, SyncMode: mode, SyncInterval: interval, stop: make(chan struct{})}
+	w.synced = sync.NewCond(&w.mu)
+	if mode == SYNC_INTERVAL {
+		w.stopped.Add(1)
+		go w.syncPeriodically()
+	}
+	return &w, nil
+}
 
+// Add : Appends the record of the key in the column family to the current segment
+// A new segment is started when the current one is at capacity
+func (w *Wal) Add(family, key string, value []byte, ts bool, sequence uint64, expiry int64) error {
+	if ts {
+		return w.append(RECORD_DELETE, family, key, value, sequence, expiry)
+	}
+	return w.append(RECORD_PUT, family, key, value, sequence, expiry)
+}
+
+// AddMerge : Appends the merge operand of the key in the column family to the current segment
+func (w *Wal) AddMerge(family, key string, operand []byte, sequence uint64) error {
+	return w.append(RECORD_MERGE, family, key, operand, sequence, 0)
 }
 
-type WalSegment struct {
-	NumElements int
+// AddDeleteRange : Appends the deletion of the keys in [start, end) of the column family to the current segment
+func (w *Wal) AddDeleteRange(family, start, end string, sequence uint64) error {
+	return w.append(RECORD_DELETE_RANGE, family, start, []byte(end), sequence, 0)
+}
+
+func (w *Wal) append(recordType uint64, family, key string, value []byte, sequence uint64, expiry int64) error {
+	record := encodeRecord(recordType, family, key, value, sequence, expiry)
+	full, err := w.full(len(record))
+	if err != nil {
+		return err
+	}
+	if full {	// Wal segment at capacity - new segment is created
+		err := w.CreateLogFile()
+		if err != nil {
+			return err
+		}
+		w.SegmentElements = 0
+	}
+	err = w.write(record)
+	if err == nil { 		// Commit log confirmed entry
+		w.SegmentElements += 1
+	}
+	return err
 }
 
+// full : Reports whether the record doesn't fit in to the current segment, by the number of appends or by its size
+// A record bigger than SegmentBytes gets a segment of its own
+func (w *Wal) full(recordSize int) (bool, error) {
+	if w.SegmentName == "" || w.SegmentElements+1 > w.SegmentSize {
+		return true, nil
+	}
+	if w.SegmentBytes == 0 || w.SegmentElements == 0 {
+		return false, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.open()
+	if err != nil {
+		return false, err
+	}
+	return uint64(w.size)+uint64(recordSize) > w.SegmentBytes, nil
+}
 
-func Append(file *os.File, data []byte) error {
-	currentLen, err := fileLen(file)
+// CreateLogFile : Creates the segment following the last one in the Wal directory to be current segment for appending
+// The previous segment is synced and closed, the new one is kept open
+func (w *Wal) CreateLogFile() error {
+	err := w.closeSegment()
 	if err != nil {
 		return err
 	}
-	err = file.Truncate(currentLen + int64(len(data))) // povecanje fajla za duzinu podatka
-	if err != nil { return err }
-	//mmapf, err := mmap.MapRegion(file, int(currentLen)+len(data), mmap.RDWR, 0, 0)
-	mmapf, err := mmap.Map(file, mmap.RDWR, 0)
+	numbers, _, err := w.segments()
 	if err != nil {
 		return err
 	}
-	defer mmapf.Unmap()
-	copy(mmapf[currentLen:], data) // upsuejmo sadrzaj iz podatka na disk u opsegu [currentLen:]
-	mmapf.Flush()
+	offset := 1
+	if len(numbers) > 0 {
+		offset = numbers[len(numbers)-1] + 1
+	}
+	name := filepath.Join(w.Dir, "wal_"+strconv.Itoa(offset)+".db")
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return Errors.IO("create", name, err)
+	}
+	header := segmentHeader()
+	_, err = file.Write(header)
+	if err != nil {
+		file.Close()
+		os.Remove(name)
+		return Errors.IO("write", name, err)
+	}
+	if w.SyncMode != SYNC_NONE {
+		// The new segment has to be found in the directory after a crash, or the records synced to it are lost
+		err = syncDir(w.Dir)
+		if err != nil {
+			file.Close()
+			os.Remove(name)
+			return err
+		}
+	}
+	w.mu.Lock()
+	w.file, w.size = file, int64(len(header))
+	w.written += uint64(len(header))
+	w.mu.Unlock()
+	w.SegmentName = name
+	return nil
+}
+
+// write : Appends the encoded record to the current segment, opened first if the log continues a segment left by the
+// last run
+// A record that isn't written whole is cut off so the next one doesn't land behind a torn record
+func (w *Wal) write(record []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.open()
+	if err != nil {
+		return err
+	}
+	n, err := w.file.Write(record)
+	if err != nil {
+		if n > 0 {
+			w.file.Truncate(w.size)
+		}
+		return Errors.IO("write", w.SegmentName, err)
+	}
+	number, _ := segmentNumber(filepath.Base(w.SegmentName))
+	w.last = Location{Segment: number, Offset: w.size}
+	w.size += int64(n)
+	w.written += uint64(n)
 	return nil
 }
 
+// segments : Returns the sorted numbers of all segments in the Wal directory and their file names
+func (w *Wal) segments() ([]int, map[int]string, error) {
+	return ListSegments(w.Dir)
+}
+
+// ListSegments : Returns the sorted numbers of all segments in the directory and their file names
+func ListSegments(dir string) ([]int, map[int]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, Errors.IO("read directory", dir, err)
+	}
+	m := make(map[int]string)
+	numbers := make([]int, 0, len(files))
+	for _, file := range files {
+		fileName := file.Name()
+		num, ok := segmentNumber(fileName)
+		if !ok {
+			continue
+		}
+		m[num] = fileName
+		numbers = append(numbers, num)
+	}
+	sort.Ints(numbers)
+	return numbers, m, nil
+}
+
+// segmentNumber : Number of the segment from its file name "wal_<N>.db", false if the name isn't of that form
+func segmentNumber(fileName string) (int, bool) {
+	tokens := strings.Split(fileName, "_")
+	if len(tokens) != 2 {
+		return 0, false
+	}
+	labels := strings.Split(tokens[1], ".")
+	num, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
+
+// open : Opens the current segment for appending unless it is open already, has to be called with mu held
+func (w *Wal) open() error {
+	if w.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(w.SegmentName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return Errors.IO("open", w.SegmentName, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return Errors.IO("stat", w.SegmentName, err)
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+// Last : Location of the record appended last, the write paths add it to the range of the memtable it went in to
+func (w *Wal) Last() Location {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+// Rotate : Syncs and closes the current segment, the next append starts a new one
+func (w *Wal) Rotate() error {
+	if w.SegmentName == "" {
+		return nil
+	}
+	err := w.closeSegment()
+	if err != nil {
+		return err
+	}
+	w.SegmentName = ""
+	w.SegmentElements = 0
+	return nil
+}
+
+// DeleteSegments : Removes the segments numbered below before, every record in them is flushed to the SSTables
+// before is the segment of the oldest record still held only by a memtable, 0 if there is none and every segment
+// can go, the current segment is kept either way since the log goes on in it
+func (w *Wal) DeleteSegments(before int) error {
+	numbers, m, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, num := range numbers {
+		if before != 0 && num >= before {
+			break
+		}
+		path := filepath.Join(w.Dir, m[num])
+		if path == w.SegmentName {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return Errors.IO("remove", path, err)
+		}
+	}
+	return nil
+}
+
+
 // Map maps an entire file into memory
 
 // prot argument
@@ -88,7 +335,9 @@ func Append(file *os.File, data []byte) error {
 // mmap.ANON - The mapped memory will not be backed by a file. If ANON is set in flags, f is ignored.
 func Read(fileName string ) ([]byte, error) {
 	file, err := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE, 0644)
-	fatal(err)
+	if err != nil {
+		return nil, Errors.IO("open", fileName, err)
+	}
 	defer file.Close()
 	mmapf, err := mmap.Map(file, mmap.RDONLY, 0)
 	if err != nil {
@@ -102,7 +351,9 @@ func Read(fileName string ) ([]byte, error) {
 
 func readRange(startIndex, endIndex int, fileName string) ([]byte, error) {
 	file, err := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE, 0644)
-	fatal(err)
+	if err != nil {
+		return nil, Errors.IO("open", fileName, err)
+	}
 	defer file.Close()
 	if startIndex < 0 || endIndex < 0 || startIndex > endIndex {
 		return nil, errors.New("indices invalid")
@@ -120,208 +371,237 @@ func readRange(startIndex, endIndex int, fileName string) ([]byte, error) {
 	return result, nil
 }
 
-func fileLen(file *os.File) (int64, error) {
-	info, err := file.Stat()
-	if err != nil {
-		return 0, err
-	}
-	return info.Size(), nil
+// AddBatch : Appends the whole batch to the current segment as one record
+// sequence is the sequence number of the first operation of the batch
+func (w *Wal) AddBatch(batch *WriteBatch, sequence uint64) error {
+	return w.append(RECORD_BATCH, "", "", batch.Encode(), sequence, 0)
 }
 
-
-func fatal(err error) {
+// ScanWal : Gathers data from log segments to load in to the memtables, sets the last log segment as the current one
+// memtables holds the memtable of every column family by name
+// flush is called whenever a memtable reaches its capacity during the scan, it has to flush and empty all of them
+// Every record is verified, a torn record at the end of the last segment was never acknowledged and is cut off
+// A broken record anywhere else fails the scan with ErrCorrupted, unless SkipCorrupted is set (see ReadData)
+// The biggest sequence number found in the segments is returned, along with the range of the log every memtable left
+// with records holds, the segments before all of the ranges are removed
+func (w *Wal) ScanWal(memtables map[string]*memtable.SkipList, flush func() error) (uint64, map[string]Range, error) {
+	var lastSequence uint64 = 0
+	ranges := make(map[string]Range)
+	err := w.closeSegment()
 	if err != nil {
-		log.Fatal(err)
+		return 0, nil, err
 	}
-}
-
-func Add(key string, value []byte, fileName string, ts bool) error {
-	f, err := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE, 0644)
-	fatal(err)
-	defer f.Close()
-
-	crc := CRC32(value)
-
-	crc_final := make([]byte, 4)
-	binary.LittleEndian.PutUint32(crc_final, crc)
-
-
-	Time := time.Now().Unix()
-	timeStamp := make([]byte, 16)
-	binary.LittleEndian.PutUint64(timeStamp, uint64(Time))
-
-	tombstone := make([]byte, 8)
-	if ts == false {
-		binary.LittleEndian.PutUint64(tombstone, uint64(0))
-	} else {
-		binary.LittleEndian.PutUint64(tombstone, uint64(1))
+	numbers, m, err := w.segments()
+	if err != nil {
+		return 0, nil, err
 	}
-
-	keyLine := make([]byte, KEY_SIZE)
-	binary.LittleEndian.PutUint64(keyLine, uint64(len([]byte(key))))
-
-	valueLine := make([]byte, VALUE_SIZE)
-	binary.LittleEndian.PutUint64(valueLine, uint64(len(value)))
-
-	temp := make([]byte, 0)
-
-	temp = append(temp, crc_final...)
-	temp = append(temp, timeStamp...)
-	temp = append(temp, tombstone...)
-	temp = append(temp, keyLine...)
-	temp = append(temp, valueLine...)
-	temp = append(temp, []byte(key)...)
-	temp = append(temp, value...)
-
-	err = Append(f, temp)
-	return err
-
-}
-
-// ScanWal : Gathers data from log segments to load in to memtable, returns path to last log segment
-func ScanWal(memtableInstance *memtable.SkipList) string {
-	files, err := ioutil.ReadDir("./Wal")
-	SSTable.Panic(err)
-	m := make(map[int]string)
-	for _, file := range files {
-		fileName := file.Name()
-		tokens := strings.Split(fileName, "_")
-		labels := strings.Split(tokens[1], ".")
-		num, _ := strconv.Atoi(labels[0])
-		m[num] = fileName
+	w.SegmentName = ""
+	w.SegmentElements = 0
+	w.Skipped = nil
+	for i, num := range numbers { 		// Read data from all log segments, add to memtable
+		tail := i == len(numbers)-1
+		err = w.ReadData(filepath.Join(w.Dir, m[num]), tail, memtables, ranges, &lastSequence, flush)
+		if err != nil {
+			return 0, nil, err
+		}
 	}
-	if len(m) > 0 {
-		segmentCounter := 0 			// Memtable consists of data from these segments -- they are not to be deleted as they're not flushed yet
-		for i := 1; i <= len(m); i++ {		// Read data from all log segments, add to memtable
-			ReadData("./Wal/"+m[i], memtableInstance, &segmentCounter)
+	if len(ranges) > 0 {
+		// The log goes on in the last segment, the records appended to it join the ranges of the memtables
+		w.SegmentName = filepath.Join(w.Dir, m[numbers[len(numbers)-1]])
+		version, size, err := CalculateSegmentSize(w.SegmentName)
+		if err != nil {
+			return 0, nil, err
 		}
-		lowWatermark := len(files) - segmentCounter // Index up to which segments are deleted
-		// Last segmentCounter segments are still active
-		if lowWatermark > 0 {
-			for i := 1; i <= lowWatermark; i++ {
-				err := os.Remove("./Wal/" + m[i])
-				SSTable.Panic(err)
+		w.SegmentElements = uint64(size)
+		if version != FORMAT_VERSION {
+			// Records of the current format can't follow the ones of an older format, the log goes on in a new
+			// segment and the old one is removed with the others once the memtables are flushed
+			err = w.CreateLogFile()
+			if err != nil {
+				return 0, nil, err
 			}
+			w.SegmentElements = 0
+		}
+	}
+	// The segments no memtable holds records of were flushed during the scan or before it
+	first := 0
+	for _, logRange := range ranges {
+		if first == 0 || logRange.First.Segment < first {
+			first = logRange.First.Segment
 		}
-		path := "./Wal/wal_" + strconv.Itoa(len(files)) + ".db"
-		return path
 	}
-	return ""
+	err = w.DeleteSegments(first)
+	if err != nil {
+		return 0, nil, err
+	}
+	return lastSequence, ranges, nil
 }
 
 // ReadData : Reads from a wal segment to insert to memtable
-func ReadData(path string, memtableInstance *memtable.SkipList, segmentCounter *int) {
-	//+---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
-	//|    CRC (4B)   | Timestamp (16B) | Tombstone(1B) | Key Size (8B) | Value Size (8B) | Key | Value |
-	//+---------------+-----------------+---------------+---------------+-----------------+-...-+--...--+
-
-	file, err := os.OpenFile(path, os.O_RDONLY, 0700)
-	SSTable.Panic(err)
-	defer file.Close()
-	_, err = file.Seek(0, 0)
-	SSTable.Panic(err)
-	br := bufio.NewReader(file)
+// A record cut short or failing its checksum at the end of the tail (last) segment is a write that a crash cut off,
+// it was never confirmed so reading stops there and the segment is truncated before the log continues in it
+// Any other broken record returns ErrCorrupted, or is skipped and added to Skipped if SkipCorrupted is set
+// lastSequence is raised to the biggest sequence number found in the segment
+// ranges gets the location of every record applied to the memtable of its family, the flush empties all of them
+// Merge operands are applied with op, one it rejects was checked before it was logged and returns ErrCorrupted
+// (or is skipped as well), without op ErrNoMergeOperator is returned
+// A record of a column family that isn't in memtables returns ErrUnknownFamily, its data would be lost otherwise
+// The records of a family up to its sequence in Flushed are in the SSTables already, they are skipped, a merge
+// operand applied twice would change the value
+func (w *Wal) ReadData(path string, tail bool, memtables map[string]*memtable.SkipList, ranges map[string]Range, lastSequence *uint64, flush func() error) error {
+	reader, err := OpenSegment(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	op := w.MergeOperator
+	number, _ := segmentNumber(filepath.Base(path))
+	logged := func(family string, offset int64) {
+		logRange := ranges[family]
+		logRange.Add(Location{Segment: number, Offset: offset})
+		ranges[family] = logRange
+	}
 
-	for err == nil {
-		crc := make([]byte, 4)
-		_, err = br.Read(crc)
-		if err != nil {
-			break
-		}
-		timeStamp := make([]byte, 16)
-		_, err = br.Read(timeStamp)
-		t := binary.LittleEndian.Uint64(timeStamp)
-		timestamp := int64(t)
-		if err != nil {
-			break
-		}
-		tombstone := make([]byte, 8)
-		_, err = br.Read(tombstone)
-		if err != nil {
-			break
-		}
-		keySize := make([]byte, KEY_SIZE)
-		_, err = br.Read(keySize)
-		if err != nil {
-			break
-		}
-		valueSize := make([]byte, VALUE_SIZE)
-		_, err = br.Read(valueSize)
-		if err != nil {
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, Errors.ErrCorrupted) {
+			var corrupted *Errors.CorruptedError
+			if tail && reader.Torn() && errors.As(err, &corrupted) {
+				err = repairTail(path, reader.Version, corrupted.Offset)
+				if err != nil {
+					return err
+				}
+				break
+			}
+			if !w.SkipCorrupted {
+				return err
+			}
+			w.Skipped = append(w.Skipped, err)
+			continue
+		} else if err != nil {
+			return err
+		} else if record == nil {
 			break
 		}
-		key := make([]byte, binary.LittleEndian.Uint64(keySize))
-		_, err = br.Read(key)
-		value := make([]byte, binary.LittleEndian.Uint64(valueSize))
-		_, err = br.Read(value)
-		forFlush := memtableInstance.Insert(string(key), value, timestamp)
-
-		if tombstone[0] == 1 {
-			memtableInstance.Delete(string(key))
+		var forFlush *memtable.SkipList
+		full := false
+		if record.Type == RECORD_BATCH {
+			batch, err := DecodeWriteBatch(record.Value)
+			if err != nil {
+				err = Errors.Corrupted(path, record.Offset, err.Error())
+				if !w.SkipCorrupted {
+					return err
+				}
+				// None of the operations of the batch are applied
+				w.Skipped = append(w.Skipped, err)
+				continue
+			}
+			full, err = batch.Apply(memtables, record.Timestamp, record.Sequence, w.Flushed)
+			if err != nil {
+				return fmt.Errorf("%w (file %s, offset %d)", err, path, record.Offset)
+			}
+			for i, entry := range batch.Entries {
+				if record.Sequence+uint64(i) > w.Flushed[entry.Family] {
+					logged(entry.Family, record.Offset)
+				}
+			}
+			if last := record.Sequence + uint64(batch.Len()) - 1; last > *lastSequence {
+				*lastSequence = last
+			}
+		} else if memtableInstance, found := memtables[record.Family]; !found {
+			return fmt.Errorf("%w %q (file %s, offset %d)", ErrUnknownFamily, record.Family, path, record.Offset)
+		} else if record.Sequence <= w.Flushed[record.Family] {
+			// A flush in the middle of the segment during an earlier scan brought the record to the SSTables
+			if record.Sequence > *lastSequence {
+				*lastSequence = record.Sequence
+			}
+		} else if record.Type == RECORD_MERGE {
+			if record.Sequence > *lastSequence {
+				*lastSequence = record.Sequence
+			}
+			forFlush, err = memtableInstance.Merge(record.Key, record.Value, record.Timestamp, record.Sequence, op)
+			if errors.Is(err, MergeOperator.ErrNoMergeOperator) {
+				return fmt.Errorf("%w (file %s, offset %d)", err, path, record.Offset)
+			} else if err != nil {
+				err = Errors.Corrupted(path, record.Offset, "merge operand can't be applied: "+err.Error())
+				if !w.SkipCorrupted {
+					return err
+				}
+				w.Skipped = append(w.Skipped, err)
+				continue
+			}
+			logged(record.Family, record.Offset)
+		} else if record.Type == RECORD_DELETE_RANGE {
+			forFlush = memtableInstance.DeleteRange(record.Key, string(record.Value), record.Timestamp, record.Sequence)
+			logged(record.Family, record.Offset)
+			if record.Sequence > *lastSequence {
+				*lastSequence = record.Sequence
+			}
+		} else {
+			forFlush = memtableInstance.InsertWithExpiry(record.Key, record.Value, record.Timestamp, record.Sequence, record.Expiry)
+			if record.Type == RECORD_DELETE {
+				memtableInstance.Delete(record.Key)
+			}
+			logged(record.Family, record.Offset)
+			if record.Sequence > *lastSequence {
+				*lastSequence = record.Sequence
+			}
 		}
-		if forFlush != nil { 				// Memtable up to capacity, flush to disk
-			SSTable.Flush(forFlush)
-			memtableInstance.NewSkipList() 	// Reset memtable
+		if full || forFlush != nil { 		// Memtable up to capacity, all the memtables are flushed to disk and reset
+			err = flush()
+			if err != nil {
+				return err
+			}
+			for family := range ranges {
+				delete(ranges, family)
+			}
 		}
 	}
-
-	if memtableInstance.Size > 0 {	// Segment still has active data in the memtable
-		*segmentCounter += 1
-	} else {						// All previous segments including this one had data flushed - memtable is empty
-		*segmentCounter = 0
-	}
-
+	return nil
 }
 
-func DeleteWal() {
-	files, err := ioutil.ReadDir("./Wal")
-	SSTable.Panic(err)
-	for _, file := range files {
-		err = os.Remove("Wal/" + file.Name())
-		SSTable.Panic(err)
+// repairTail : Cuts the torn record starting at the offset off the end of the segment
+// A segment left without its whole header gets the header again, so the records appended later can be read back
+func repairTail(path string, version byte, offset int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return Errors.IO("open", path, err)
 	}
-}
-
-func CalculateSegmentSize(filename string) int {
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0700)
-	SSTable.Panic(err)
 	defer file.Close()
-	SSTable.Panic(err)
-	br := bufio.NewReader(file)
-
-	segmentSize := 0
-
-	for err == nil {
-		crc := make([]byte, 4)
-		_, err = br.Read(crc)
-		if err != nil {
-			break
-		}
-		timeStamp := make([]byte, 16)
-		_, err = br.Read(timeStamp)
-		if err != nil {
-			break
-		}
-		tombstone := make([]byte, 8)
-		_, err = br.Read(tombstone)
-		if err != nil {
-			break
-		}
-		keySize := make([]byte, KEY_SIZE)
-		_, err = br.Read(keySize)
+	if version == FORMAT_VERSION && offset < SEGMENT_HEADER_SIZE {
+		offset = 0
+	}
+	err = file.Truncate(offset)
+	if err != nil {
+		return Errors.IO("truncate", path, err)
+	}
+	if offset == 0 {
+		_, err = file.WriteAt(segmentHeader(), 0)
 		if err != nil {
-			break
+			return Errors.IO("write", path, err)
 		}
-		valueSize := make([]byte, VALUE_SIZE)
-		_, err = br.Read(valueSize)
-		if err != nil {
+	}
+	return Errors.IO("sync", path, file.Sync())
+}
+
+// CalculateSegmentSize : Format version of the segment and the number of records in it
+func CalculateSegmentSize(filename string) (byte, int, error) {
+	reader, err := OpenSegment(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer reader.Close()
+	segmentSize := 0
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, Errors.ErrCorrupted) {
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		} else if record == nil {
 			break
 		}
-		key := make([]byte, binary.LittleEndian.Uint64(keySize))
-		_, err = br.Read(key)
-		value := make([]byte, binary.LittleEndian.Uint64(valueSize))
-		_, err = br.Read(value)
 		segmentSize += 1
 	}
-	return segmentSize
+	return reader.Version, segmentSize, nil
 }
@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"errors"
+	"project/structures/Errors"
+	"project/structures/MergeOperator"
+	"project/structures/memtable"
+	"testing"
+)
+
+// openTestWal : Log in the directory whose segments take segmentSize appends, records reach the disk on every append
+func openTestWal(t *testing.T, dir string, segmentSize uint64) *Wal {
+	t.Helper()
+	w, err := NewWal(dir, segmentSize, SYNC_ALWAYS, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// scan : Reads the log in the directory back in to a new memtable of the default family
+// configure sets the fields of the log before the scan, it can be nil
+func scan(t *testing.T, dir string, configure func(w *Wal)) (*Wal, *memtable.SkipList, uint64, error) {
+	t.Helper()
+	w := openTestWal(t, dir, DEFAULT_SEGMENT_SIZE)
+	if configure != nil {
+		configure(w)
+	}
+	mem := memtable.NewMemtable(memtable.DEFAULT_MAX_HEIGHT, 1000, 0)
+	memtables := map[string]*memtable.SkipList{DEFAULT_FAMILY: mem}
+	sequence, _, err := w.ScanWal(memtables, func() error {
+		t.Fatal("the memtable was flushed during the scan")
+		return nil
+	})
+	return w, mem, sequence, err
+}
+
+// expectNode : Fails the test unless the memtable holds the value under the key, an empty value stands for a deleted key
+func expectNode(t *testing.T, mem *memtable.SkipList, key, value string) {
+	t.Helper()
+	node := mem.FindNode(key)
+	if node == nil {
+		t.Fatalf("%s was not loaded back", key)
+	}
+	if value == "" {
+		if !node.Tombstone {
+			t.Fatalf("%s is %q, expected it to be deleted", key, node.Value)
+		}
+		return
+	}
+	if node.Tombstone || string(node.Value) != value {
+		t.Fatalf("%s is %q (deleted %v), expected %q", key, node.Value, node.Tombstone, value)
+	}
+}
+
+func TestReplayRejectedMergeOperand(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWal(t, dir, DEFAULT_SEGMENT_SIZE)
+	// The counter can't add anything to a value that isn't a number
+	err := w.Add(DEFAULT_FAMILY, "k", []byte("abc"), false, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddMerge(DEFAULT_FAMILY, "k", []byte("1"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Add(DEFAULT_FAMILY, "after", []byte("v"), false, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	_, _, _, err = scan(t, dir, func(w *Wal) { w.MergeOperator = MergeOperator.Counter{} })
+	if !errors.Is(err, Errors.ErrCorrupted) {
+		t.Fatalf("scan returned %v, expected a corruption", err)
+	}
+	_, _, _, err = scan(t, dir, nil)
+	if !errors.Is(err, MergeOperator.ErrNoMergeOperator) {
+		t.Fatalf("scan without a merge operator returned %v", err)
+	}
+
+	w, mem, sequence, err := scan(t, dir, func(w *Wal) {
+		w.MergeOperator = MergeOperator.Counter{}
+		w.SkipCorrupted = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNode(t, mem, "k", "abc")
+	expectNode(t, mem, "after", "v")
+	if sequence != 3 {
+		t.Fatalf("last sequence is %d, expected 3", sequence)
+	}
+	if len(w.Skipped) != 1 || !errors.Is(w.Skipped[0], Errors.ErrCorrupted) {
+		t.Fatalf("skipped %v, expected the merge operand", w.Skipped)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"project/structures/Configuration"
+	"project/structures/DB"
+	"project/structures/Errors"
+	"project/structures/Initialization"
+	"project/structures/MergeOperator"
+	wal "project/structures/mmap"
+	"text/tabwriter"
+	"time"
+)
+
+// walctl : Inspects the log segments of a database without opening it, the segments are only read
+// walctl list | dump | verify | replay, run walctl without a command for the flags of each one
+// The exit status is 0 on success, 1 if verify found broken records or the command failed and 2 on a usage error
+func walctl(args []string) int {
+	if len(args) == 0 {
+		walctlUsage()
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "list":
+		err = walctlList(args[1:])
+	case "dump":
+		err = walctlDump(args[1:])
+	case "verify":
+		err = walctlVerify(args[1:])
+	case "replay":
+		err = walctlReplay(args[1:])
+	default:
+		walctlUsage()
+		return 2
+	}
+	if errors.Is(err, flag.ErrHelp) || errors.Is(err, errUsage) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "walctl:", err)
+		return 1
+	}
+	return 0
+}
+
+var errUsage = errors.New("usage")
+
+func walctlUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: walctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "  list    [-dir DIR] [-from N] [-to N]                segments with their format, size and records")
+	fmt.Fprintln(os.Stderr, "  dump    [-dir DIR] [-from N] [-to N] [-json]        every record with its checksum status")
+	fmt.Fprintln(os.Stderr, "  verify  [-dir DIR] [-from N] [-to N]                checks the checksum of every record")
+	fmt.Fprintln(os.Stderr, "  replay  [-dir DIR] [-from N] [-to N] -out DIR       loads the segments in to a new data directory")
+	fmt.Fprintln(os.Stderr, "          [-skip-corrupted] [-merge counter|append] [-delimiter D]")
+	fmt.Fprintln(os.Stderr, "DIR is the data directory of the database, its segments are in DIR/Wal")
+}
+
+// segmentFlags : Flags every command takes, the data directory and the range of segment numbers, both ends included
+type segmentFlags struct {
+	dir      string
+	from, to int
+}
+
+func newFlagSet(name string, sf *segmentFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet("walctl "+name, flag.ContinueOnError)
+	fs.StringVar(&sf.dir, "dir", ".", "data directory of the database")
+	fs.IntVar(&sf.from, "from", 0, "first segment number, 0 for the first segment")
+	fs.IntVar(&sf.to, "to", 0, "last segment number, 0 for the last segment")
+	return fs
+}
+
+// selected : Paths of the segments in the range ordered by their number
+func (sf *segmentFlags) selected() ([]int, []string, error) {
+	dir := Initialization.WalDir(sf.dir)
+	numbers, names, err := wal.ListSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var picked []int
+	var paths []string
+	for _, number := range numbers {
+		if (sf.from == 0 || number >= sf.from) && (sf.to == 0 || number <= sf.to) {
+			picked = append(picked, number)
+			paths = append(paths, filepath.Join(dir, names[number]))
+		}
+	}
+	if len(picked) == 0 {
+		return nil, nil, fmt.Errorf("no segments in %s between %d and %d", dir, sf.from, sf.to)
+	}
+	return picked, paths, nil
+}
+
+// walEntry : One record as dump prints it, a write batch lists its operations in Entries
+type walEntry struct {
+	Segment   int          `json:"segment"`
+	Offset    int64        `json:"offset"`
+	Type      string       `json:"type"`
+	Timestamp int64        `json:"timestamp"`
+	Sequence  uint64       `json:"sequence"`
+	Expiry    int64        `json:"expiry,omitempty"`
+	Tombstone bool         `json:"tombstone"`
+	Family    string       `json:"family"`
+	Key       string       `json:"key"`
+	ValueSize int          `json:"value_size"`
+	CRC       string       `json:"crc"` // ok, mismatch or torn for a record cut short
+	Error     string       `json:"error,omitempty"`
+	Entries   []batchEntry `json:"entries,omitempty"`
+}
+
+type batchEntry struct {
+	Family    string `json:"family"`
+	Key       string `json:"key"`
+	Tombstone bool   `json:"tombstone"`
+	ValueSize int    `json:"value_size"`
+}
+
+var recordTypes = map[byte]string{
+	wal.RECORD_PUT:          "put",
+	wal.RECORD_DELETE:       "delete",
+	wal.RECORD_BATCH:        "batch",
+	wal.RECORD_MERGE:        "merge",
+	wal.RECORD_DELETE_RANGE: "delete-range",
+}
+
+// segmentSummary : What list and verify report for one segment
+type segmentSummary struct {
+	number      int
+	path        string
+	version     byte
+	size        int64
+	records     int
+	broken      []error
+	torn        bool
+	first, last uint64 // Smallest and biggest sequence number of the records
+	firstTime   int64
+	lastTime    int64
+	families    map[string]bool
+}
+
+// readSegment : Reads every record of the segment, each one is passed to visit along with the error of a broken one
+// A record cut short has no data, visit gets nil for it
+func readSegment(number int, path string, visit func(record *wal.Record, err error) error) (*segmentSummary, error) {
+	reader, err := wal.OpenSegment(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	summary := segmentSummary{number: number, path: path, version: reader.Version, size: reader.Size, families: make(map[string]bool)}
+	for {
+		record, err := reader.Next()
+		if err != nil && !errors.Is(err, Errors.ErrCorrupted) {
+			return nil, err
+		}
+		if err == nil && record == nil {
+			break
+		}
+		if err != nil {
+			summary.broken = append(summary.broken, err)
+			summary.torn = reader.Torn()
+		}
+		if record != nil {
+			summary.records++
+			if summary.first == 0 || record.Sequence < summary.first {
+				summary.first = record.Sequence
+			}
+			if record.Sequence > summary.last {
+				summary.last = record.Sequence
+			}
+			if summary.firstTime == 0 {
+				summary.firstTime = record.Timestamp
+			}
+			summary.lastTime = record.Timestamp
+			if err == nil {
+				for _, family := range recordFamilies(record) {
+					summary.families[family] = true
+				}
+			}
+		}
+		if visit != nil {
+			err = visit(record, err)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &summary, nil
+}
+
+// recordFamilies : Column families the record writes to, the operations of a batch can name several
+func recordFamilies(record *wal.Record) []string {
+	if record.Type != wal.RECORD_BATCH {
+		return []string{record.Family}
+	}
+	batch, err := wal.DecodeWriteBatch(record.Value)
+	if err != nil {
+		return nil
+	}
+	var families []string
+	for _, entry := range batch.Entries {
+		families = append(families, entry.Family)
+	}
+	return families
+}
+
+func formatTime(seconds int64) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+// walctlList : Prints one line for every segment
+func walctlList(args []string) error {
+	var sf segmentFlags
+	fs := newFlagSet("list", &sf)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	numbers, paths, err := sf.selected()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tVERSION\tBYTES\tRECORDS\tSEQUENCES\tFIRST WRITE\tLAST WRITE\tBROKEN")
+	for i, path := range paths {
+		summary, err := readSegment(numbers[i], path, nil)
+		if err != nil {
+			return err
+		}
+		broken := fmt.Sprint(len(summary.broken))
+		if summary.torn {
+			broken += " (torn tail)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d-%d\t%s\t%s\t%s\n", filepath.Base(path), summary.version, summary.size,
+			summary.records, summary.first, summary.last, formatTime(summary.firstTime), formatTime(summary.lastTime), broken)
+	}
+	return w.Flush()
+}
+
+// walctlDump : Prints every record of the segments as a table or as one JSON object per line
+// The values aren't printed, only their size
+func walctlDump(args []string) error {
+	var sf segmentFlags
+	fs := newFlagSet("dump", &sf)
+	asJSON := fs.Bool("json", false, "one JSON object per record")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	numbers, paths, err := sf.selected()
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	var table *tabwriter.Writer
+	encoder := json.NewEncoder(out)
+	if !*asJSON {
+		table = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "SEGMENT\tOFFSET\tTYPE\tSEQUENCE\tTIME\tTOMBSTONE\tFAMILY\tKEY\tVALUE SIZE\tCRC")
+	}
+	for i, path := range paths {
+		number := numbers[i]
+		_, err = readSegment(number, path, func(record *wal.Record, broken error) error {
+			entry := newWalEntry(number, record, broken)
+			if *asJSON {
+				return encoder.Encode(entry)
+			}
+			printWalEntry(table, path, &entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if table != nil {
+		return table.Flush()
+	}
+	return nil
+}
+
+// newWalEntry : Record as dump prints it, record is nil for a record cut short
+func newWalEntry(segment int, record *wal.Record, broken error) walEntry {
+	entry := walEntry{Segment: segment, CRC: "ok"}
+	var corrupted *Errors.CorruptedError
+	if errors.As(broken, &corrupted) {
+		entry.Offset = corrupted.Offset
+		entry.Error = corrupted.Reason
+		entry.CRC = "mismatch"
+	}
+	if record == nil {
+		entry.CRC = "torn"
+		return entry
+	}
+	entry.Offset = record.Offset
+	entry.Type = recordTypes[record.Type]
+	if entry.Type == "" {
+		entry.Type = fmt.Sprintf("unknown(%d)", record.Type)
+	}
+	entry.Timestamp = record.Timestamp
+	entry.Sequence = record.Sequence
+	entry.Expiry = record.Expiry
+	entry.Tombstone = record.Type == wal.RECORD_DELETE || record.Type == wal.RECORD_DELETE_RANGE
+	entry.Family = record.Family
+	entry.Key = record.Key
+	entry.ValueSize = len(record.Value)
+	if record.Type == wal.RECORD_BATCH && broken == nil {
+		batch, err := wal.DecodeWriteBatch(record.Value)
+		if err != nil {
+			entry.Error = err.Error()
+			return entry
+		}
+		for _, operation := range batch.Entries {
+			entry.Entries = append(entry.Entries, batchEntry{Family: operation.Family, Key: operation.Key,
+				Tombstone: operation.Tombstone, ValueSize: len(operation.Value)})
+		}
+	}
+	return entry
+}
+
+// printWalEntry : One line of the dump table, the operations of a batch follow it indented
+func printWalEntry(w io.Writer, path string, entry *walEntry) {
+	crc := entry.CRC
+	if entry.Error != "" {
+		crc += " (" + entry.Error + ")"
+	}
+	if entry.CRC == "torn" {
+		fmt.Fprintf(w, "%s\t%d\t-\t-\t-\t-\t-\t-\t-\t%s\n", filepath.Base(path), entry.Offset, crc)
+		return
+	}
+	fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%v\t%s\t%q\t%d\t%s\n", filepath.Base(path), entry.Offset, entry.Type,
+		entry.Sequence, formatTime(entry.Timestamp), entry.Tombstone, entry.Family, entry.Key, entry.ValueSize, crc)
+	for i, operation := range entry.Entries {
+		fmt.Fprintf(w, "\t\t  %d\t%d\t\t%v\t%s\t%q\t%d\t\n", i, entry.Sequence+uint64(i), operation.Tombstone,
+			operation.Family, operation.Key, operation.ValueSize)
+	}
+}
+
+// walctlVerify : Checks every record of the segments, the broken ones are printed
+// A torn record at the end of the last segment is a write cut off by a crash, the next open drops it, so it is only
+// reported, any other broken record fails the verification
+func walctlVerify(args []string) error {
+	var sf segmentFlags
+	fs := newFlagSet("verify", &sf)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	numbers, paths, err := sf.selected()
+	if err != nil {
+		return err
+	}
+	all, _, err := wal.ListSegments(Initialization.WalDir(sf.dir))
+	if err != nil {
+		return err
+	}
+	records, failed := 0, 0
+	for i, path := range paths {
+		summary, err := readSegment(numbers[i], path, nil)
+		if err != nil {
+			return err
+		}
+		records += summary.records
+		tail := numbers[i] == all[len(all)-1]
+		for j, broken := range summary.broken {
+			if tail && summary.torn && j == len(summary.broken)-1 {
+				fmt.Println("torn tail, dropped on the next open:", broken)
+				continue
+			}
+			fmt.Println("broken:", broken)
+			failed++
+		}
+	}
+	fmt.Printf("%d segments, %d records, %d broken\n", len(paths), records, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d broken records: %w", failed, Errors.ErrCorrupted)
+	}
+	return nil
+}
+
+// walctlReplay : Loads the records of the segments in to a new data directory
+// The segments are copied in to the log of the new directory and the database is opened there, which replays them the
+// way a restart does, the original segments are left untouched
+// The column families found in the records are created with the options of the configuration
+func walctlReplay(args []string) error {
+	var sf segmentFlags
+	fs := newFlagSet("replay", &sf)
+	out := fs.String("out", "", "new data directory, it must not exist or be empty")
+	skip := fs.Bool("skip-corrupted", false, "skip the broken records instead of stopping at the first one")
+	merge := fs.String("merge", "", "merge operator of the merge records, counter or append")
+	delimiter := fs.String("delimiter", "", "delimiter of the append merge operator")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "walctl replay: -out is required")
+		return errUsage
+	}
+	opts := DB.OptionsFromConfig(Configuration.LoadConfig())
+	opts.WalSkipCorrupted = *skip
+	switch *merge {
+	case "":
+	case "counter":
+		opts.MergeOperator = MergeOperator.Counter{}
+	case "append":
+		opts.MergeOperator = MergeOperator.Append{Delimiter: *delimiter}
+	default:
+		fmt.Fprintln(os.Stderr, "walctl replay: unknown merge operator", *merge)
+		return errUsage
+	}
+	numbers, paths, err := sf.selected()
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(*out)
+	if err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", *out)
+	} else if err != nil && !os.IsNotExist(err) {
+		return Errors.IO("read directory", *out, err)
+	}
+	walDir := Initialization.WalDir(*out)
+	err = os.MkdirAll(walDir, 0755)
+	if err != nil {
+		return Errors.IO("create directory", walDir, err)
+	}
+
+	for i, path := range paths {
+		summary, err := readSegment(numbers[i], path, nil)
+		if err != nil {
+			return err
+		}
+		for family := range summary.families {
+			if _, found := opts.ColumnFamilies[family]; !found && family != DB.DEFAULT_COLUMN_FAMILY {
+				if opts.ColumnFamilies == nil {
+					opts.ColumnFamilies = make(map[string]DB.ColumnFamilyOptions)
+				}
+				opts.ColumnFamilies[family] = DB.ColumnFamilyOptions{}
+			}
+		}
+		err = copyFile(path, filepath.Join(walDir, filepath.Base(path)))
+		if err != nil {
+			return err
+		}
+	}
+	db, err := DB.Open(*out, opts)
+	if err != nil {
+		return err
+	}
+	for _, skipped := range db.SkippedRecords() {
+		fmt.Println("skipped:", skipped)
+	}
+	fmt.Printf("replayed %d segments (%d to %d) in to %s\n", len(paths), numbers[0], numbers[len(numbers)-1], *out)
+	return db.Close()
+}
+
+// copyFile : Copies the file to the new path, which must not exist
+func copyFile(from, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return Errors.IO("open", from, err)
+	}
+	defer source.Close()
+	target, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return Errors.IO("create", to, err)
+	}
+	_, err = io.Copy(target, source)
+	if err != nil {
+		target.Close()
+		return Errors.IO("write", to, err)
+	}
+	err = Errors.IO("sync", to, target.Sync())
+	closeErr := Errors.IO("close", to, target.Close())
+	if err != nil {
+		return err
+	}
+	return closeErr
+}